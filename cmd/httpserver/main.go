@@ -11,7 +11,10 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/ratludu/httpfromtcp/internal/accesslog"
+	"github.com/ratludu/httpfromtcp/internal/compress"
 	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/metrics"
 	"github.com/ratludu/httpfromtcp/internal/request"
 	"github.com/ratludu/httpfromtcp/internal/response"
 	"github.com/ratludu/httpfromtcp/internal/server"
@@ -21,7 +24,7 @@ const port = 42069
 
 func main() {
 
-	HandlerFunc := func(w *response.Writer, r *request.Request) {
+	HandlerFunc := func(w response.Writer, r *request.Request) {
 
 		switch {
 		case r.RequestLine.RequestTarget == "/yourproblem":
@@ -61,18 +64,15 @@ func main() {
 				}
 
 				fullBody = append(fullBody, data[:n]...)
-				w.WriteBody([]byte(fmt.Sprintf("%x\r\n", n)))
-				w.WriteBody(data[:n])
-				w.WriteBody([]byte("\r\n"))
+				w.WriteChunkedBody(data[:n])
 			}
-			w.WriteBody([]byte("0\r\n"))
 			trailingHeader := headers.NewHeaders()
 			sum := fmt.Sprintf("%x", sha256.Sum256(fullBody))
 			sumLength := strconv.Itoa(len(fullBody))
 
 			trailingHeader.Set("X-Content-SHA256", sum)
 			trailingHeader.Set("X-Content-Length", sumLength)
-			w.WriteHeaders(trailingHeader)
+			w.WriteTrailers(trailingHeader)
 		case strings.HasPrefix(r.RequestLine.RequestTarget, "/video"):
 			vid, err := os.ReadFile("assets/vim.mp4")
 			if err != nil {
@@ -94,7 +94,19 @@ func main() {
 			w.WriteBody(message)
 		}
 	}
-	s, err := server.Serve(port, HandlerFunc)
+	logged := accesslog.Middleware(accesslog.Options{
+		Sinks: []accesslog.Sink{accesslog.CombinedSink(os.Stdout)},
+	})
+	m := metrics.New(metrics.Options{
+		Route: metrics.ByPrefix("/yourproblem", "/myproblem", "/httpbin", "/video"),
+	})
+	s := &server.Server{
+		Handler:    m.Middleware(logged(compress.Middleware(HandlerFunc))),
+		Port:       port,
+		ConnState:  m.ConnState,
+		ParseError: m.ParseError,
+	}
+	err := s.Start()
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
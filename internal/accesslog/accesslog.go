@@ -0,0 +1,240 @@
+// Package accesslog records every request the server answers. Entries go
+// to one or more sinks: log/slog, or the Common and Combined Log Formats
+// that log tooling already understands.
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// DefaultRequestIDHeader is where request IDs are read from, and written
+// to when the client didn't send one.
+const DefaultRequestIDHeader = "x-request-id"
+
+// Entry is one served request.
+type Entry struct {
+	Time       time.Time
+	Method     string
+	Target     string
+	Proto      string
+	Status     int
+	Bytes      int
+	Duration   time.Duration
+	RemoteAddr string
+	UserAgent  string
+	Referer    string
+	RequestID  string
+}
+
+// Sink receives entries. Write is called from many connections at once.
+type Sink interface {
+	Write(e *Entry) error
+}
+
+// Sampler decides whether an entry is logged.
+type Sampler func(e *Entry) bool
+
+// SampleRate logs the given fraction of requests, but every server error,
+// since those are the ones worth looking at.
+func SampleRate(rate float64) Sampler {
+	return func(e *Entry) bool {
+		return e.Status >= 500 || rand.Float64() < rate
+	}
+}
+
+type Options struct {
+	Sinks []Sink
+	// Sampler picks the entries to log. Nil logs everything.
+	Sampler Sampler
+	// RequestIDHeader names the header carrying the request ID. Requests
+	// without one get a random ID set on their headers, so handlers log the
+	// same value. The ID is sent back on the response too, so clients and
+	// proxies can match their logs against ours.
+	RequestIDHeader string
+}
+
+// Middleware logs each request to opts.Sinks once the handler returns.
+func Middleware(opts Options) func(server.Handler) server.Handler {
+
+	idHeader := opts.RequestIDHeader
+	if idHeader == "" {
+		idHeader = DefaultRequestIDHeader
+	}
+	idHeader = strings.ToLower(idHeader)
+
+	return func(next server.Handler) server.Handler {
+		return func(w response.Writer, r *request.Request) {
+
+			start := time.Now()
+			id, err := r.Headers.GetString(idHeader)
+			if err != nil || id == "" {
+				id = newRequestID()
+				r.Headers.Set(idHeader, id)
+			}
+
+			tw := response.NewTrackingWriter(response.BeforeHeaders(w, func(h headers.Headers) {
+				if _, err := h.GetString(idHeader); err != nil {
+					h.Set(idHeader, id)
+				}
+			}))
+			// logged in a defer so requests whose handler panics are
+			// logged too, with the 500 the server answers them with
+			returned := false
+			defer func() {
+				status := tw.Status()
+				if !returned && status == 0 {
+					status = response.InternalServerError
+				}
+				e := &Entry{
+					Time:       start,
+					Method:     r.RequestLine.Method,
+					Target:     r.RequestLine.RequestTarget,
+					Proto:      "HTTP/" + r.RequestLine.HttpVersion,
+					Status:     status.GetCode(),
+					Bytes:      tw.BytesWritten(),
+					Duration:   time.Since(start),
+					RemoteAddr: r.RemoteAddr,
+					RequestID:  id,
+				}
+				e.UserAgent, _ = r.Headers.GetString("user-agent")
+				e.Referer, _ = r.Headers.GetString("referer")
+
+				if opts.Sampler != nil && !opts.Sampler(e) {
+					return
+				}
+				for _, sink := range opts.Sinks {
+					err := sink.Write(e)
+					if err != nil {
+						fmt.Println("Error:", err)
+					}
+				}
+			}()
+
+			next(tw, r)
+			returned = true
+		}
+	}
+}
+
+func newRequestID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+type slogSink struct {
+	logger *slog.Logger
+}
+
+// SlogSink logs entries as structured records at Info level, or Error
+// for 5xx responses.
+func SlogSink(logger *slog.Logger) Sink {
+	return &slogSink{logger: logger}
+}
+
+func (s *slogSink) Write(e *Entry) error {
+	level := slog.LevelInfo
+	if e.Status >= 500 {
+		level = slog.LevelError
+	}
+	s.logger.LogAttrs(context.Background(), level, "request",
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("proto", e.Proto),
+		slog.Int("status", e.Status),
+		slog.Int("bytes", e.Bytes),
+		slog.Duration("duration", e.Duration),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("user_agent", e.UserAgent),
+		slog.String("request_id", e.RequestID),
+	)
+	return nil
+}
+
+type lineSink struct {
+	mu       sync.Mutex
+	w        io.Writer
+	combined bool
+}
+
+// CommonSink writes entries to w in the Common Log Format.
+func CommonSink(w io.Writer) Sink {
+	return &lineSink{w: w}
+}
+
+// CombinedSink writes entries to w in the Combined Log Format, which adds
+// the referer and user agent to the Common one.
+func CombinedSink(w io.Writer) Sink {
+	return &lineSink{w: w, combined: true}
+}
+
+func (s *lineSink) Write(e *Entry) error {
+	line := FormatCommon(e)
+	if s.combined {
+		line += fmt.Sprintf(" %s %s", quote(e.Referer), quote(e.UserAgent))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.WriteString(s.w, line+"\n")
+	return err
+}
+
+// FormatCommon renders e as a Common Log Format line, without the newline.
+func FormatCommon(e *Entry) string {
+
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		host = "-"
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.Itoa(e.Bytes)
+	}
+	requestLine := fmt.Sprintf("%s %s %s", e.Method, e.Target, e.Proto)
+
+	return fmt.Sprintf("%s - - [%s] %s %d %s", host, e.Time.Format(clfTimeFormat), quote(requestLine), e.Status, bytes)
+}
+
+// quote wraps s in double quotes, escaping anything that could break the
+// line apart or be mistaken for the closing quote.
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memorySink struct {
+	entries []*Entry
+}
+
+func (m *memorySink) Write(e *Entry) error {
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func chunked(w response.Writer, r *request.Request) {
+	w.WriteStatusLine(response.Ok)
+	h := response.GetDefaultHeaders(0, "text/plain")
+	h.Del("content-length")
+	h.Set("transfer-encoding", "chunked")
+	w.WriteHeaders(h)
+	w.WriteChunkedBody([]byte("hello "))
+	w.WriteChunkedBody([]byte("world"))
+	w.WriteChunkedBodyDone()
+}
+
+func TestMiddleware(t *testing.T) {
+	sink := &memorySink{}
+	var seenID string
+	handler := Middleware(Options{Sinks: []Sink{sink}})(func(w response.Writer, r *request.Request) {
+		seenID, _ = r.Headers.GetString("x-request-id")
+		chunked(w, r)
+	})
+
+	req := servertest.NewRequest("GET", "/greet?x=1").Header("User-Agent", "curl/8.0").RemoteAddr("203.0.113.9:5555").Request()
+	rec := servertest.NewRecorder()
+	handler(rec, req)
+
+	require.Len(t, sink.entries, 1)
+	e := sink.entries[0]
+	assert.Equal(t, "GET", e.Method)
+	assert.Equal(t, "/greet?x=1", e.Target)
+	assert.Equal(t, "HTTP/1.1", e.Proto)
+	assert.Equal(t, 200, e.Status)
+	assert.Equal(t, len("hello world"), e.Bytes)
+	assert.Equal(t, "203.0.113.9:5555", e.RemoteAddr)
+	assert.Equal(t, "curl/8.0", e.UserAgent)
+	assert.Len(t, e.RequestID, 16)
+	assert.Equal(t, e.RequestID, seenID)
+	assert.Equal(t, e.RequestID, rec.Header("X-Request-Id"))
+
+	// Test: a request ID sent by the client is kept
+	req = servertest.NewRequest("GET", "/").Header("X-Request-Id", "abc-123").Request()
+	rec = servertest.NewRecorder()
+	handler(rec, req)
+	require.Len(t, sink.entries, 2)
+	assert.Equal(t, "abc-123", sink.entries[1].RequestID)
+	assert.Equal(t, "abc-123", rec.Header("X-Request-Id"))
+}
+
+func TestMiddleware_Panics(t *testing.T) {
+	sink := &memorySink{}
+	handler := Middleware(Options{Sinks: []Sink{sink}})(func(w response.Writer, r *request.Request) {
+		panic("boom")
+	})
+
+	// Test: the panic carries on to the server, and the 500 it answers
+	// with is logged
+	assert.PanicsWithValue(t, "boom", func() {
+		handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/").Request())
+	})
+	require.Len(t, sink.entries, 1)
+	assert.Equal(t, 500, sink.entries[0].Status)
+}
+
+func TestSampling(t *testing.T) {
+	sink := &memorySink{}
+	status := response.Ok
+	handler := Middleware(Options{Sinks: []Sink{sink}, Sampler: SampleRate(0)})(func(w response.Writer, r *request.Request) {
+		w.WriteStatusLine(status)
+		w.WriteHeaders(response.GetDefaultHeaders(0, "text/plain"))
+	})
+
+	for range 10 {
+		handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/").Request())
+	}
+	assert.Empty(t, sink.entries)
+
+	// Test: server errors are always kept
+	status = response.InternalServerError
+	handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/").Request())
+	assert.Len(t, sink.entries, 1)
+}
+
+func TestFormats(t *testing.T) {
+	e := &Entry{
+		Time:       time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Method:     "GET",
+		Target:     "/apache_pb.gif",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Bytes:      2326,
+		RemoteAddr: "127.0.0.1:41234",
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  `Mozilla/4.08 "quoted"`,
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, CommonSink(buf).Write(e))
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326`+"\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, CombinedSink(buf).Write(e))
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""`+"\n", buf.String())
+
+	// Test: empty fields and control characters can't break the line
+	e.Bytes = 0
+	e.Referer = ""
+	e.UserAgent = "evil\nagent"
+	buf.Reset()
+	require.NoError(t, CombinedSink(buf).Write(e))
+	assert.True(t, strings.HasSuffix(buf.String(), `200 - "-" "evil\x0aagent"`+"\n"))
+
+	// Test: slog
+	buf.Reset()
+	require.NoError(t, SlogSink(slog.New(slog.NewJSONHandler(buf, nil))).Write(e))
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "INFO", record["level"])
+	assert.Equal(t, "/apache_pb.gif", record["target"])
+	assert.Equal(t, float64(200), record["status"])
+}
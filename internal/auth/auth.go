@@ -0,0 +1,186 @@
+// Package auth checks the credentials in a request's Authorization header
+// before handing it on. It speaks three schemes: Basic (RFC 7617), Bearer
+// tokens (RFC 6750) and Digest (RFC 7616). Requests without acceptable
+// credentials get a 401 whose WWW-Authenticate header offers every scheme
+// configured.
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// UserHeader carries the name of the authenticated user to the handler.
+// Any value the client sent is removed first.
+const UserHeader = "x-remote-user"
+
+var ErrMalformed = fmt.Errorf("Error: malformed authorization header")
+
+// BasicChecker checks a user name and password, e.g. an *Htpasswd.
+type BasicChecker interface {
+	Check(user, password string) bool
+}
+
+// TokenValidator checks a bearer token and names the user it belongs to.
+type TokenValidator func(token string) (user string, ok bool)
+
+type Options struct {
+	// Realm names the protection space in challenges. Empty means
+	// "restricted".
+	Realm string
+	// Basic enables the Basic scheme. Basic sends passwords in the clear,
+	// so it belongs behind TLS.
+	Basic BasicChecker
+	// Bearer enables bearer tokens.
+	Bearer TokenValidator
+	// Digest enables the Digest scheme, with SHA-256 and MD5.
+	Digest DigestCredentials
+	// NonceTTL is how long a Digest nonce stays good. Zero means
+	// DefaultNonceTTL.
+	NonceTTL time.Duration
+}
+
+// User is the name of the user the middleware let r through for.
+func User(r *request.Request) string {
+	user, _ := r.Headers.GetString(UserHeader)
+	return user
+}
+
+// New returns a middleware that lets requests through only with valid
+// credentials for one of the schemes in opts.
+func New(opts Options) func(server.Handler) server.Handler {
+
+	if opts.Realm == "" {
+		opts.Realm = "restricted"
+	}
+	var d *digest
+	if opts.Digest != nil {
+		d = newDigest(opts.Realm, opts.Digest, opts.NonceTTL)
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w response.Writer, r *request.Request) {
+
+			r.Headers.Del(UserHeader)
+			var c challenge
+			value, err := r.Headers.GetString("authorization")
+			if err == nil {
+				scheme, credentials, _ := strings.Cut(strings.TrimSpace(value), " ")
+				credentials = strings.TrimSpace(credentials)
+
+				user, ok := "", false
+				switch {
+				case strings.EqualFold(scheme, "basic") && opts.Basic != nil:
+					user, ok = checkBasic(opts.Basic, credentials)
+				case strings.EqualFold(scheme, "bearer") && opts.Bearer != nil:
+					user, ok = opts.Bearer(credentials)
+					c.invalidToken = !ok
+				case strings.EqualFold(scheme, "digest") && d != nil:
+					user, ok, c.stale = d.check(r, credentials)
+				}
+				if ok {
+					r.Headers.Set(UserHeader, user)
+					next(w, r)
+					return
+				}
+			}
+
+			h := headers.NewHeaders()
+			h.Set("www-authenticate", c.header(opts, d))
+			he := server.HandlerError{StatusCode: response.Unauthorized, Message: "Unauthorized", Headers: h}
+			he.Write(w)
+		}
+	}
+}
+
+// challenge is what went wrong with the credentials, if anything, for the
+// 401 to say.
+type challenge struct {
+	invalidToken bool
+	stale        bool
+}
+
+// header lists a challenge for every scheme configured, strongest first.
+// Challenges share one header, separated by commas (RFC 9110, section
+// 11.6.1).
+func (c challenge) header(opts Options, d *digest) string {
+
+	var challenges []string
+	if d != nil {
+		challenges = append(challenges, d.challenges(c.stale)...)
+	}
+	if opts.Bearer != nil {
+		bearer := "Bearer realm=" + quote(opts.Realm)
+		if c.invalidToken {
+			bearer += `, error="invalid_token"`
+		}
+		challenges = append(challenges, bearer)
+	}
+	if opts.Basic != nil {
+		challenges = append(challenges, "Basic realm="+quote(opts.Realm)+`, charset="UTF-8"`)
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// quote makes s a quoted-string.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// parseParams reads a comma separated list of auth-params, name=token or
+// name="quoted-string". Names are lower cased.
+func parseParams(s string) (map[string]string, error) {
+
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, ErrMalformed
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, ErrMalformed
+			}
+			value, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ',' {
+			return nil, ErrMalformed
+		}
+		if _, dup := params[name]; dup {
+			return nil, ErrMalformed
+		}
+		params[name] = value
+	}
+}
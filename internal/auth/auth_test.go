@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func whoami(w response.Writer, r *request.Request) {
+	user := User(r)
+	w.WriteStatusLine(response.Ok)
+	w.WriteHeaders(response.GetDefaultHeaders(len(user), "text/plain"))
+	w.WriteBody([]byte(user))
+}
+
+func basic(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	file := "# users\nalice:" + string(hash) + "\n\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+
+	h, err := ParseHtpasswd(strings.NewReader(file))
+	require.NoError(t, err)
+	assert.True(t, h.Check("alice", "s3cret"))
+	assert.False(t, h.Check("alice", "wrong"))
+	assert.True(t, h.Check("bob", "password"))
+	assert.False(t, h.Check("bob", "Password"))
+	assert.False(t, h.Check("carol", "password"))
+
+	_, err = ParseHtpasswd(strings.NewReader("carol:$apr1$salt$hash\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+	_, err = ParseHtpasswd(strings.NewReader("no colon\n"))
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestBasic(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	require.NoError(t, err)
+	handler := New(Options{Realm: "admin", Basic: h})(whoami)
+
+	rec := servertest.Do(handler, servertest.NewRequest("GET", "/").Header("Authorization", basic("bob", "password")))
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "bob", rec.Body.String())
+
+	for _, value := range []string{"", basic("bob", "nope"), "Basic !!!", "Basic " + base64.StdEncoding.EncodeToString([]byte("bob"))} {
+		b := servertest.NewRequest("GET", "/")
+		if value != "" {
+			b.Header("Authorization", value)
+		}
+		rec = servertest.Do(handler, b)
+		assert.Equal(t, response.Unauthorized, rec.Code, value)
+		assert.Equal(t, `Basic realm="admin", charset="UTF-8"`, rec.Header("WWW-Authenticate"))
+	}
+
+	// Test: clients can't claim a user
+	rec = servertest.Do(handler, servertest.NewRequest("GET", "/").Header("Authorization", basic("bob", "password")).Header(UserHeader, "root"))
+	assert.Equal(t, "bob", rec.Body.String())
+}
+
+func TestBearer(t *testing.T) {
+	handler := New(Options{Bearer: func(token string) (string, bool) {
+		return "svc", token == "abc.def"
+	}})(whoami)
+
+	rec := servertest.Do(handler, servertest.NewRequest("GET", "/").Header("Authorization", "bearer abc.def"))
+	assert.Equal(t, "svc", rec.Body.String())
+
+	rec = servertest.Do(handler, servertest.NewRequest("GET", "/"))
+	assert.Equal(t, response.Unauthorized, rec.Code)
+	assert.Equal(t, `Bearer realm="restricted"`, rec.Header("WWW-Authenticate"))
+
+	rec = servertest.Do(handler, servertest.NewRequest("GET", "/").Header("Authorization", "Bearer wrong"))
+	assert.Equal(t, `Bearer realm="restricted", error="invalid_token"`, rec.Header("WWW-Authenticate"))
+
+	// Test: schemes that aren't configured are refused
+	rec = servertest.Do(handler, servertest.NewRequest("GET", "/").Header("Authorization", basic("svc", "abc.def")))
+	assert.Equal(t, response.Unauthorized, rec.Code)
+}
+
+// digestClient answers a challenge the way a browser would.
+func digestClient(t *testing.T, challenge, method, uri, user, password string, nc int) string {
+
+	p, err := parseParams(strings.TrimPrefix(challenge, "Digest "))
+	require.NoError(t, err)
+	algorithm := p["algorithm"]
+	cnonce := "0a4f113b"
+	ncs := fmt.Sprintf("%08x", nc)
+	ha1 := hashHex(algorithm, user+":"+p["realm"]+":"+password)
+	ha2 := hashHex(algorithm, method+":"+uri)
+	resp := hashHex(algorithm, ha1+":"+p["nonce"]+":"+ncs+":"+cnonce+":auth:"+ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", uri="%s", algorithm=%s, nonce="%s", nc=%s, cnonce="%s", qop=auth, response="%s", opaque="%s"`,
+		user, p["realm"], uri, algorithm, p["nonce"], ncs, cnonce, resp, p["opaque"])
+}
+
+func TestDigest(t *testing.T) {
+	opts := Options{Realm: "api@example.org", Digest: DigestPasswords(map[string]string{"Mufasa": "Circle of Life"})}
+	d := newDigest(opts.Realm, opts.Digest, time.Minute)
+	challenges := d.challenges(false)
+	require.Len(t, challenges, 2)
+	assert.Contains(t, challenges[0], "algorithm=SHA-256")
+	assert.Contains(t, challenges[1], "algorithm=MD5")
+
+	for i := range challenges {
+		// both challenges share a nonce, so each algorithm gets a fresh one
+		c := d.challenges(false)[i]
+		req := servertest.NewRequest("GET", "/dir/index.html").Request()
+		creds := strings.TrimPrefix(digestClient(t, c, "GET", "/dir/index.html", "Mufasa", "Circle of Life", 1), "Digest ")
+		user, ok, stale := d.check(req, creds)
+		assert.True(t, ok)
+		assert.False(t, stale)
+		assert.Equal(t, "Mufasa", user)
+
+		// Test: replays are refused, higher counts aren't
+		_, ok, _ = d.check(req, creds)
+		assert.False(t, ok)
+		creds = strings.TrimPrefix(digestClient(t, c, "GET", "/dir/index.html", "Mufasa", "Circle of Life", 2), "Digest ")
+		_, ok, _ = d.check(req, creds)
+		assert.True(t, ok)
+	}
+
+	c := challenges[0]
+	req := servertest.NewRequest("GET", "/dir/index.html").Request()
+	bad := []string{
+		digestClient(t, c, "GET", "/dir/index.html", "Mufasa", "wrong", 9),
+		digestClient(t, c, "GET", "/dir/index.html", "Scar", "Circle of Life", 9),
+		digestClient(t, c, "POST", "/dir/index.html", "Mufasa", "Circle of Life", 9),
+		digestClient(t, c, "GET", "/other", "Mufasa", "Circle of Life", 9),
+		strings.Replace(digestClient(t, c, "GET", "/dir/index.html", "Mufasa", "Circle of Life", 9), `nonce="`, `nonce="x`, 1),
+	}
+	for _, creds := range bad {
+		_, ok, _ := d.check(req, strings.TrimPrefix(creds, "Digest "))
+		assert.False(t, ok, creds)
+	}
+
+	// Test: expired nonces with the right password are stale
+	d.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, ok, stale := d.check(req, strings.TrimPrefix(digestClient(t, c, "GET", "/dir/index.html", "Mufasa", "Circle of Life", 10), "Digest "))
+	assert.False(t, ok)
+	assert.True(t, stale)
+	assert.Contains(t, d.challenges(true)[0], "stale=true")
+}
+
+func TestMiddleware_Challenges(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	require.NoError(t, err)
+	handler := New(Options{
+		Realm:  "all",
+		Basic:  h,
+		Bearer: func(string) (string, bool) { return "", false },
+		Digest: DigestPasswords(map[string]string{"bob": "password"}),
+	})(whoami)
+
+	rec := servertest.Do(handler, servertest.NewRequest("GET", "/"))
+	assert.Equal(t, response.Unauthorized, rec.Code)
+	challenge := rec.Header("WWW-Authenticate")
+	assert.True(t, strings.HasPrefix(challenge, `Digest realm="all", qop="auth", algorithm=SHA-256`), challenge)
+	assert.Contains(t, challenge, `Bearer realm="all"`)
+	assert.True(t, strings.HasSuffix(challenge, `Basic realm="all", charset="UTF-8"`), challenge)
+
+	// Test: a full Digest round trip through the middleware
+	first, _, _ := strings.Cut(challenge, ", Digest ")
+	rec = servertest.Do(handler, servertest.NewRequest("GET", "/x?y=1").Header("Authorization", digestClient(t, first, "GET", "/x?y=1", "bob", "password", 1)))
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "bob", rec.Body.String())
+
+	rec = servertest.Do(handler, servertest.NewRequest("GET", "/").Header("Authorization", basic("bob", "password")))
+	assert.Equal(t, "bob", rec.Body.String())
+}
+
+func TestParseParams(t *testing.T) {
+	p, err := parseParams(`username="Mufasa", realm="a \"quoted\" realm",nc=00000001 , qop=auth`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"username": "Mufasa", "realm": `a "quoted" realm`, "nc": "00000001", "qop": "auth"}, p)
+
+	for _, s := range []string{`a="unterminated`, `=x`, `a="x" junk`, `a=1, a=2`} {
+		_, err := parseParams(s)
+		assert.ErrorIs(t, err, ErrMalformed, s)
+	}
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnsupportedHash = fmt.Errorf("Error: unsupported password hash")
+
+// dummyHash is checked against for unknown users, so they take as long to
+// turn away as a wrong password does.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Htpasswd holds users and password hashes in the format Apache's
+// htpasswd writes: one "user:hash" per line. Hashes are bcrypt
+// ("$2y$...", from htpasswd -B) or unsalted SHA-1 ("{SHA}...", from
+// htpasswd -s). Other formats are refused when parsing.
+type Htpasswd struct {
+	users map[string]string
+}
+
+// LoadHtpasswd reads an htpasswd file.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd reads htpasswd entries from r. Blank lines and lines
+// starting with # are skipped.
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+
+	h := &Htpasswd{users: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%w: line %d", ErrMalformed, n)
+		}
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%w: line %d", ErrUnsupportedHash, n)
+		}
+		h.users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Check reports whether password is user's.
+func (h *Htpasswd) Check(user, password string) bool {
+
+	hash, ok := h.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	sum := sha1.Sum([]byte(password))
+	want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// checkBasic decodes Basic credentials, base64 of "user:password", and
+// checks them.
+func checkBasic(checker BasicChecker, credentials string) (string, bool) {
+
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+	return user, checker.Check(user, password)
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+)
+
+// DefaultNonceTTL is how long a Digest nonce stays good by default. Clients
+// with an expired nonce are told it's stale, and retry with a fresh one
+// without asking the user again.
+const DefaultNonceTTL = 5 * time.Minute
+
+// DigestCredentials looks up the HA1 of a user for the Digest scheme: the
+// hex digest, under algorithm ("SHA-256" or "MD5"), of
+// "user:realm:password". Storing HA1 rather than the password is what
+// htdigest files do.
+type DigestCredentials func(user, realm, algorithm string) (ha1 string, ok bool)
+
+// DigestPasswords serves Digest credentials from plain text passwords,
+// keyed by user.
+func DigestPasswords(passwords map[string]string) DigestCredentials {
+	return func(user, realm, algorithm string) (string, bool) {
+		password, ok := passwords[user]
+		if !ok {
+			return "", false
+		}
+		return hashHex(algorithm, user+":"+realm+":"+password), true
+	}
+}
+
+// digestAlgorithms are offered in order of preference.
+var digestAlgorithms = []string{"SHA-256", "MD5"}
+
+func newHash(algorithm string) hash.Hash {
+	if algorithm == "MD5" {
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+func hashHex(algorithm, s string) string {
+	h := newHash(algorithm)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digest issues and checks nonces. A nonce is its issue time signed with
+// a key of the server's, so nothing is stored until a client uses one.
+// The highest nonce count used with each nonce is then kept until the
+// nonce expires, so requests can't be replayed.
+type digest struct {
+	realm  string
+	creds  DigestCredentials
+	ttl    time.Duration
+	key    []byte
+	opaque string
+	now    func() time.Time
+
+	mu        sync.Mutex
+	counts    map[string]nonceCount
+	lastSweep time.Time
+}
+
+type nonceCount struct {
+	nc     uint64
+	issued time.Time
+}
+
+func newDigest(realm string, creds DigestCredentials, ttl time.Duration) *digest {
+
+	if ttl <= 0 {
+		ttl = DefaultNonceTTL
+	}
+	d := &digest{
+		realm:  realm,
+		creds:  creds,
+		ttl:    ttl,
+		key:    make([]byte, 32),
+		now:    time.Now,
+		counts: make(map[string]nonceCount),
+	}
+	rand.Read(d.key)
+	opaque := make([]byte, 16)
+	rand.Read(opaque)
+	d.opaque = hex.EncodeToString(opaque)
+	return d
+}
+
+func (d *digest) newNonce() string {
+
+	b := make([]byte, 8, 24)
+	binary.BigEndian.PutUint64(b, uint64(d.now().UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(append(b, d.sign(b)...))
+}
+
+func (d *digest) sign(ts []byte) []byte {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(ts)
+	return mac.Sum(nil)[:16]
+}
+
+// checkNonce reports whether nonce is one of ours, and when it was
+// issued.
+func (d *digest) checkNonce(nonce string) (time.Time, bool) {
+
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 24 {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(b[8:], d.sign(b[:8])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))), true
+}
+
+// challenges offers a fresh nonce under each algorithm. stale tells the
+// client its last nonce expired but its credentials were right.
+func (d *digest) challenges(stale bool) []string {
+
+	nonce := d.newNonce()
+	var challenges []string
+	for _, algorithm := range digestAlgorithms {
+		c := "Digest realm=" + quote(d.realm) + `, qop="auth", algorithm=` + algorithm +
+			", nonce=" + quote(nonce) + ", opaque=" + quote(d.opaque)
+		if stale {
+			c += ", stale=true"
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges
+}
+
+// check verifies the Digest credentials of r (RFC 7616, section 3.4).
+func (d *digest) check(r *request.Request, credentials string) (user string, ok, stale bool) {
+
+	p, err := parseParams(credentials)
+	if err != nil {
+		return "", false, false
+	}
+	user = p["username"]
+	if user == "" || p["realm"] != d.realm || p["uri"] != r.RequestLine.RequestTarget ||
+		p["opaque"] != d.opaque || p["qop"] != "auth" || p["cnonce"] == "" || p["userhash"] == "true" {
+		return "", false, false
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 32)
+	if err != nil || len(p["nc"]) != 8 {
+		return "", false, false
+	}
+
+	algorithm := p["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	base, sess := strings.CutSuffix(algorithm, "-sess")
+	base = strings.ToUpper(base)
+	if base != "MD5" && base != "SHA-256" {
+		return "", false, false
+	}
+
+	issued, ok := d.checkNonce(p["nonce"])
+	if !ok {
+		return "", false, false
+	}
+
+	ha1, known := d.creds(user, d.realm, base)
+	if sess {
+		ha1 = hashHex(base, ha1+":"+p["nonce"]+":"+p["cnonce"])
+	}
+	ha2 := hashHex(base, r.RequestLine.Method+":"+p["uri"])
+	want := hashHex(base, ha1+":"+p["nonce"]+":"+p["nc"]+":"+p["cnonce"]+":auth:"+ha2)
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(p["response"])), []byte(want)) != 1 || !known {
+		return "", false, false
+	}
+
+	if d.now().Sub(issued) > d.ttl {
+		return "", false, true
+	}
+	if !d.use(p["nonce"], nc, issued) {
+		return "", false, false
+	}
+	return user, true, false
+}
+
+// use records nc against nonce, and reports whether it's higher than any
+// count used with the nonce before.
+func (d *digest) use(nonce string, nc uint64, issued time.Time) bool {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if now.Sub(d.lastSweep) > d.ttl {
+		for n, c := range d.counts {
+			if now.Sub(c.issued) > d.ttl {
+				delete(d.counts, n)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	if c, ok := d.counts[nonce]; ok && nc <= c.nc {
+		return false
+	}
+	d.counts[nonce] = nonceCount{nc: nc, issued: issued}
+	return true
+}
@@ -0,0 +1,423 @@
+// Package cache is a shared HTTP cache (RFC 9111) kept in memory, in
+// front of handlers that are expensive to run. It stores responses with
+// explicit freshness from Cache-Control or Expires, keeps a variant per
+// Vary, and serves stale responses where stale-while-revalidate and
+// stale-if-error allow (RFC 5861).
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/cachecontrol"
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+const (
+	DefaultMaxBytes      = 64 << 20
+	DefaultMaxEntryBytes = 1 << 20
+)
+
+type Options struct {
+	// MaxBytes bounds the memory stored responses take, bodies and
+	// headers. The least recently used go first. Zero means
+	// DefaultMaxBytes.
+	MaxBytes int64
+	// MaxEntryBytes is the largest body stored. Zero means
+	// DefaultMaxEntryBytes.
+	MaxEntryBytes int
+}
+
+// Cache holds stored responses, least recently used at the back of lru.
+// Each key, the host and target of GET requests, has a variant per set of
+// values for the fields its responses vary on.
+type Cache struct {
+	opts Options
+	now  func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string][]*entry
+	lru      *list.List
+	elems    map[*entry]*list.Element
+	size     int64
+	inflight map[string]*call
+}
+
+// call is a fetch other requests for the same key wait on rather than
+// running the handler themselves.
+type call struct {
+	done chan struct{}
+	// entry is what the fetch stored, nil if nothing.
+	entry *entry
+}
+
+func New(opts Options) *Cache {
+
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxEntryBytes <= 0 {
+		opts.MaxEntryBytes = DefaultMaxEntryBytes
+	}
+	return &Cache{
+		opts:     opts,
+		now:      time.Now,
+		entries:  make(map[string][]*entry),
+		lru:      list.New(),
+		elems:    make(map[*entry]*list.Element),
+		inflight: make(map[string]*call),
+	}
+}
+
+// Len reports how many responses are stored.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Size reports the bytes stored responses take.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Middleware serves GET and HEAD requests from the cache where it can,
+// with an Age header, and stores what next answers GET requests with.
+// Concurrent misses for a key share one call to next. Other methods go
+// straight to next, and drop what's stored for their target.
+//
+// Conditional requests are passed on as they are; put
+// conditional.Middleware outside the cache to answer them from stored
+// responses.
+func (c *Cache) Middleware(next server.Handler) server.Handler {
+	return func(w response.Writer, r *request.Request) {
+
+		key := cacheKey(r)
+		method := r.RequestLine.Method
+		if method != "GET" && method != "HEAD" {
+			next(w, r)
+			// RFC 9111, section 4.4
+			c.invalidate(key)
+			return
+		}
+
+		cc := cachecontrol.Parse(value(r.Headers, "cache-control"))
+		if cc.Has("no-store") {
+			next(w, r)
+			return
+		}
+
+		var stale *entry
+		if !cc.Has("no-cache") {
+			now := c.now()
+			e := c.lookup(key, r)
+			if e != nil {
+				age := e.age(now)
+				maxAge, limited := cc.Duration("max-age")
+				switch {
+				case limited && age > maxAge:
+					stale = e
+				case age < e.lifetime:
+					c.serve(w, r, e, age)
+					return
+				case age < e.lifetime+e.staleWhileRevalidate:
+					c.revalidate(key, r, next)
+					c.serve(w, r, e, age)
+					return
+				default:
+					stale = e
+				}
+			}
+		}
+
+		if method == "HEAD" {
+			next(w, r)
+			return
+		}
+		c.fetch(w, r, key, next, stale)
+	}
+}
+
+// fetch runs next for a miss, or waits for the same miss already being
+// fetched and shares its response if it fits r.
+func (c *Cache) fetch(w response.Writer, r *request.Request, key string, next server.Handler, stale *entry) {
+
+	c.mu.Lock()
+	if cl, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-cl.done
+		if cl.entry != nil && cl.entry.matches(r) {
+			c.serve(w, r, cl.entry, cl.entry.age(c.now()))
+			return
+		}
+		// not storable, or another variant; fetch on our own
+		c.miss(w, r, next, stale)
+		return
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[key] = cl
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+	cl.entry = c.miss(w, r, next, stale)
+}
+
+// miss runs next, stores its response if it can and sends it to w. A
+// server error inside stale's stale-if-error window sends stale instead.
+func (c *Cache) miss(w response.Writer, r *request.Request, next server.Handler, stale *entry) *entry {
+
+	start := c.now()
+	var candidate *entry
+	useStale := false
+	bw := c.capture(w, r, next, func(status response.StatusCode, h headers.Headers) bool {
+		if c.staleIfError(stale, status) {
+			useStale = true
+			return true
+		}
+		e, ok := policy(r, status, h, start)
+		candidate = e
+		return ok
+	})
+	if bw == nil {
+		return nil
+	}
+
+	if useStale {
+		c.serve(w, r, stale, stale.age(c.now()))
+		return nil
+	}
+
+	e := c.store(cacheKey(r), candidate, bw)
+	write(w, r, e.status, e.header, e.body)
+	return e
+}
+
+// capture runs next, holding its response back, up to MaxEntryBytes of
+// body, if keep wants it. Responses keep doesn't want, or that outgrow the
+// limit, go straight through to w; a nil w discards them, for fetches
+// nobody is waiting on. It returns the captured response, or nil if there
+// isn't one.
+func (c *Cache) capture(w response.Writer, r *request.Request, next server.Handler, keep func(status response.StatusCode, h headers.Headers) bool) *response.BufferedWriter {
+
+	captured := false
+	bw := response.NewBufferedWriter(w, response.BufferHooks{
+		Headers: func(bw *response.BufferedWriter) (bool, error) {
+			return keep(bw.Status, bw.Header), nil
+		},
+		// stored responses lose their trailers
+		Complete: func(*response.BufferedWriter, headers.Headers) error {
+			captured = true
+			return nil
+		},
+	})
+	bw.Limit = c.opts.MaxEntryBytes
+	next(bw, r)
+
+	bw.Close()
+	if !captured {
+		return nil
+	}
+	return bw
+}
+
+// staleIfError reports whether stale may stand in for a response with
+// status.
+func (c *Cache) staleIfError(stale *entry, status response.StatusCode) bool {
+
+	switch status {
+	case response.InternalServerError, 502, response.ServiceUnavailable, 504:
+	default:
+		return false
+	}
+	return stale != nil && stale.age(c.now()) < stale.lifetime+stale.staleIfError
+}
+
+// revalidate fetches a fresh response for key in the background, unless a
+// fetch is already under way.
+func (c *Cache) revalidate(key string, r *request.Request, next server.Handler) {
+
+	c.mu.Lock()
+	if _, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		return
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[key] = cl
+	c.mu.Unlock()
+
+	// the handler is done with r once the response goes out, so the
+	// background fetch gets a copy
+	bg := &request.Request{
+		RequestLine: r.RequestLine,
+		Headers:     maps.Clone(r.Headers),
+		Body:        r.Body,
+		RemoteAddr:  r.RemoteAddr,
+		LocalAddr:   r.LocalAddr,
+	}
+	bg.RequestLine.Method = "GET"
+	for _, h := range []string{"cache-control", "if-none-match", "if-modified-since", "if-match", "if-unmodified-since", "if-range", "range"} {
+		bg.Headers.Del(h)
+	}
+
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				fmt.Printf("Error: panic revalidating %s: %v\n%s", key, v, debug.Stack())
+			}
+			c.mu.Lock()
+			delete(c.inflight, key)
+			c.mu.Unlock()
+			close(cl.done)
+		}()
+
+		start := c.now()
+		var candidate *entry
+		bw := c.capture(nil, bg, next, func(status response.StatusCode, h headers.Headers) bool {
+			e, ok := policy(bg, status, h, start)
+			candidate = e
+			return ok
+		})
+		if bw != nil {
+			cl.entry = c.store(key, candidate, bw)
+		}
+	}()
+}
+
+// store fills in e from the captured response and adds it, replacing the
+// variant it stands for and evicting the least recently used entries to
+// make room. Entries too big to ever fit aren't added, but still returned
+// for sending.
+func (c *Cache) store(key string, e *entry, bw *response.BufferedWriter) *entry {
+
+	e.key = key
+	e.header = bw.Header
+	e.body = bw.Body.Bytes()
+	e.header.Del("age")
+	if bw.Chunked {
+		e.header.Del("transfer-encoding")
+		e.header.Set("content-length", strconv.Itoa(len(e.body)))
+	}
+	e.size = int64(len(key) + len(e.body))
+	for k, v := range e.header {
+		e.size += int64(len(k) + len(v))
+	}
+	if e.size > c.opts.MaxBytes {
+		return e
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, old := range c.entries[key] {
+		if slices.Equal(old.vary, e.vary) && slices.Equal(old.values, e.values) {
+			c.remove(old)
+			break
+		}
+	}
+	c.entries[key] = append(c.entries[key], e)
+	c.elems[e] = c.lru.PushFront(e)
+	c.size += e.size
+
+	for c.size > c.opts.MaxBytes {
+		c.remove(c.lru.Back().Value.(*entry))
+	}
+	return e
+}
+
+// lookup finds the variant of key that fits r, and marks it recently
+// used.
+func (c *Cache) lookup(key string, r *request.Request) *entry {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries[key] {
+		if e.matches(r) {
+			c.lru.MoveToFront(c.elems[e])
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *Cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries[key] {
+		c.remove(e)
+	}
+}
+
+// remove drops e. c.mu must be held.
+func (c *Cache) remove(e *entry) {
+
+	elem, ok := c.elems[e]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.elems, e)
+	c.size -= e.size
+
+	variants := c.entries[e.key]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = variants
+	}
+}
+
+// serve sends e from the cache, with its current age. Stored entries are
+// never changed, so serving one needs no lock.
+func (c *Cache) serve(w response.Writer, r *request.Request, e *entry, age time.Duration) {
+	h := maps.Clone(e.header)
+	h.Set("age", strconv.FormatInt(int64(age/time.Second), 10))
+	write(w, r, e.status, h, e.body)
+}
+
+func write(w response.Writer, r *request.Request, status response.StatusCode, h headers.Headers, body []byte) {
+
+	err := w.WriteStatusLine(status)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if r.RequestLine.Method == "HEAD" || len(body) == 0 {
+		return
+	}
+	_, err = w.WriteBody(body)
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+}
+
+// cacheKey is the host and target of r.
+func cacheKey(r *request.Request) string {
+	return value(r.Headers, "host") + " " + r.RequestLine.RequestTarget
+}
@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCache(opts Options) (*Cache, *servertest.Clock) {
+	c, clock := New(opts), servertest.NewClock()
+	c.now = clock.Now
+	return c, clock
+}
+
+// origin answers "v1", "v2"... with the given headers, counting calls.
+type origin struct {
+	calls  atomic.Int32
+	status atomic.Int32
+	header map[string]string
+}
+
+func newOrigin(header map[string]string) *origin {
+	o := &origin{header: header}
+	o.status.Store(int32(response.Ok))
+	return o
+}
+
+func (o *origin) handle(w response.Writer, r *request.Request) {
+	n := o.calls.Add(1)
+	body := "v" + strconv.Itoa(int(n))
+	h := response.GetDefaultHeaders(len(body), "text/plain")
+	for k, v := range o.header {
+		h.Set(k, v)
+	}
+	w.WriteStatusLine(response.StatusCode(o.status.Load()))
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func TestMiddleware_Freshness(t *testing.T) {
+	c, clock := newTestCache(Options{})
+	o := newOrigin(map[string]string{"cache-control": "max-age=60"})
+	h := c.Middleware(o.handle)
+
+	rec := servertest.Do(h, servertest.NewRequest("GET", "/report"))
+	assert.Equal(t, "v1", rec.Body.String())
+	assert.Empty(t, rec.Header("Age"))
+
+	clock.Advance(30 * time.Second)
+	rec = servertest.Do(h, servertest.NewRequest("GET", "/report"))
+	assert.Equal(t, "v1", rec.Body.String())
+	assert.Equal(t, "30", rec.Header("Age"))
+	assert.Equal(t, "2", rec.Header("Content-Length"))
+
+	// Test: HEAD is served from the stored GET
+	rec = servertest.Do(h, servertest.NewRequest("HEAD", "/report"))
+	assert.Empty(t, rec.Body.String())
+	assert.Equal(t, "30", rec.Header("Age"))
+	assert.Equal(t, int32(1), o.calls.Load())
+
+	// Test: other targets and hosts are other keys
+	assert.Equal(t, "v2", servertest.Do(h, servertest.NewRequest("GET", "/report?page=2")).Body.String())
+	assert.Equal(t, "v3", servertest.Do(h, servertest.NewRequest("GET", "/report").Header("Host", "other.org")).Body.String())
+
+	clock.Advance(31 * time.Second)
+	rec = servertest.Do(h, servertest.NewRequest("GET", "/report"))
+	assert.Equal(t, "v4", rec.Body.String())
+
+	// Test: request directives
+	assert.Equal(t, "v4", servertest.Do(h, servertest.NewRequest("GET", "/report")).Body.String())
+	assert.Equal(t, "v5", servertest.Do(h, servertest.NewRequest("GET", "/report").Header("Cache-Control", "no-cache")).Body.String())
+	assert.Equal(t, "v6", servertest.Do(h, servertest.NewRequest("GET", "/report").Header("Cache-Control", "no-store")).Body.String())
+	assert.Equal(t, "v5", servertest.Do(h, servertest.NewRequest("GET", "/report")).Body.String())
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, "v7", servertest.Do(h, servertest.NewRequest("GET", "/report").Header("Cache-Control", "max-age=5")).Body.String())
+
+	// Test: unsafe methods invalidate
+	servertest.Do(h, servertest.NewRequest("POST", "/report"))
+	assert.Equal(t, "v9", servertest.Do(h, servertest.NewRequest("GET", "/report")).Body.String())
+}
+
+func TestMiddleware_NotStored(t *testing.T) {
+	cases := []struct {
+		header map[string]string
+		req    *servertest.RequestBuilder
+	}{
+		{map[string]string{"cache-control": "private, max-age=60"}, nil},
+		{map[string]string{"cache-control": "no-store, max-age=60"}, nil},
+		{map[string]string{"cache-control": "no-cache, max-age=60"}, nil},
+		{map[string]string{"cache-control": "max-age=60", "set-cookie": "id=1"}, nil},
+		{map[string]string{"cache-control": "max-age=60", "vary": "*"}, nil},
+		{map[string]string{"cache-control": "max-age=0"}, nil},
+		{map[string]string{"expires": "0"}, nil},
+		{map[string]string{"last-modified": "Mon, 01 Jan 2024 00:00:00 GMT"}, nil},
+		{map[string]string{"cache-control": "max-age=60"}, servertest.NewRequest("GET", "/").Header("Authorization", "Bearer x")},
+	}
+	for _, tc := range cases {
+		c, _ := newTestCache(Options{})
+		o := newOrigin(tc.header)
+		h := c.Middleware(o.handle)
+		req := tc.req
+		if req == nil {
+			req = servertest.NewRequest("GET", "/")
+		}
+		servertest.Do(h, req)
+		servertest.Do(h, req)
+		assert.Equal(t, int32(2), o.calls.Load(), "%v", tc.header)
+		assert.Equal(t, 0, c.Len())
+	}
+
+	// Test: public responses are shared even with authorization
+	c, _ := newTestCache(Options{})
+	o := newOrigin(map[string]string{"cache-control": "public, max-age=60"})
+	h := c.Middleware(o.handle)
+	servertest.Do(h, servertest.NewRequest("GET", "/").Header("Authorization", "Bearer x"))
+	assert.Equal(t, "v1", servertest.Do(h, servertest.NewRequest("GET", "/")).Body.String())
+
+	// Test: bodies over the limit stream through
+	c, _ = newTestCache(Options{MaxEntryBytes: 1})
+	o = newOrigin(map[string]string{"cache-control": "max-age=60"})
+	h = c.Middleware(o.handle)
+	assert.Equal(t, "v1", servertest.Do(h, servertest.NewRequest("GET", "/")).Body.String())
+	assert.Equal(t, "v2", servertest.Do(h, servertest.NewRequest("GET", "/")).Body.String())
+}
+
+func TestMiddleware_Expires(t *testing.T) {
+	c, clock := newTestCache(Options{})
+	now := clock.Now()
+	o := newOrigin(map[string]string{
+		"date":    now.Format(headers.TimeFormat),
+		"expires": now.Add(time.Minute).Format(headers.TimeFormat),
+		"age":     "15",
+	})
+	h := c.Middleware(o.handle)
+
+	servertest.Do(h, servertest.NewRequest("GET", "/"))
+	rec := servertest.Do(h, servertest.NewRequest("GET", "/"))
+	assert.Equal(t, "v1", rec.Body.String())
+	assert.Equal(t, "15", rec.Header("Age"))
+
+	// Test: the age it arrived with counts against its lifetime
+	clock.Advance(46 * time.Second)
+	assert.Equal(t, "v2", servertest.Do(h, servertest.NewRequest("GET", "/")).Body.String())
+}
+
+func TestMiddleware_Vary(t *testing.T) {
+	c, _ := newTestCache(Options{})
+	o := newOrigin(map[string]string{"cache-control": "max-age=60", "vary": "Accept-Language, accept-encoding"})
+	h := c.Middleware(o.handle)
+
+	en := func() *servertest.RequestBuilder {
+		return servertest.NewRequest("GET", "/").Header("Accept-Language", "en").Header("Accept-Encoding", "gzip, br")
+	}
+	assert.Equal(t, "v1", servertest.Do(h, en()).Body.String())
+	assert.Equal(t, "v2", servertest.Do(h, servertest.NewRequest("GET", "/").Header("Accept-Language", "fr")).Body.String())
+	assert.Equal(t, "v1", servertest.Do(h, en()).Body.String())
+	assert.Equal(t, "v1", servertest.Do(h, servertest.NewRequest("GET", "/").Header("Accept-Language", "en").Header("Accept-Encoding", "gzip,br")).Body.String())
+	assert.Equal(t, "v2", servertest.Do(h, servertest.NewRequest("GET", "/").Header("Accept-Language", "fr")).Body.String())
+	assert.Equal(t, "v3", servertest.Do(h, servertest.NewRequest("GET", "/")).Body.String())
+	assert.Equal(t, 3, c.Len())
+}
+
+func TestMiddleware_StaleWhileRevalidate(t *testing.T) {
+	c, clock := newTestCache(Options{})
+	o := newOrigin(map[string]string{"cache-control": "max-age=10, stale-while-revalidate=30"})
+	h := c.Middleware(o.handle)
+
+	servertest.Do(h, servertest.NewRequest("GET", "/"))
+	clock.Advance(20 * time.Second)
+
+	rec := servertest.Do(h, servertest.NewRequest("GET", "/"))
+	assert.Equal(t, "v1", rec.Body.String())
+	assert.Equal(t, "20", rec.Header("Age"))
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.inflight) == 0
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(2), o.calls.Load())
+	assert.Equal(t, "v2", servertest.Do(h, servertest.NewRequest("GET", "/")).Body.String())
+
+	// Test: past the window, the client waits for a fresh response
+	clock.Advance(time.Minute)
+	assert.Equal(t, "v3", servertest.Do(h, servertest.NewRequest("GET", "/")).Body.String())
+
+	// Test: must-revalidate turns it off
+	c, clock = newTestCache(Options{})
+	o = newOrigin(map[string]string{"cache-control": "max-age=10, stale-while-revalidate=30, must-revalidate"})
+	h = c.Middleware(o.handle)
+	servertest.Do(h, servertest.NewRequest("GET", "/"))
+	clock.Advance(20 * time.Second)
+	assert.Equal(t, "v2", servertest.Do(h, servertest.NewRequest("GET", "/")).Body.String())
+}
+
+func TestMiddleware_StaleIfError(t *testing.T) {
+	c, clock := newTestCache(Options{})
+	o := newOrigin(map[string]string{"cache-control": "max-age=10, stale-if-error=60"})
+	h := c.Middleware(o.handle)
+
+	servertest.Do(h, servertest.NewRequest("GET", "/"))
+	o.status.Store(int32(response.ServiceUnavailable))
+
+	clock.Advance(20 * time.Second)
+	rec := servertest.Do(h, servertest.NewRequest("GET", "/"))
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "v1", rec.Body.String())
+	assert.Equal(t, "20", rec.Header("Age"))
+
+	// Test: not found is an answer, not an error
+	o.status.Store(int32(response.NotFound))
+	rec = servertest.Do(h, servertest.NewRequest("GET", "/"))
+	assert.Equal(t, response.NotFound, rec.Code)
+
+	c.invalidate(cacheKey(servertest.NewRequest("GET", "/").Request()))
+	o.status.Store(int32(response.Ok))
+	servertest.Do(h, servertest.NewRequest("GET", "/"))
+	o.status.Store(int32(response.ServiceUnavailable))
+	clock.Advance(80 * time.Second)
+	rec = servertest.Do(h, servertest.NewRequest("GET", "/"))
+	assert.Equal(t, response.ServiceUnavailable, rec.Code)
+}
+
+func TestMiddleware_Coalescing(t *testing.T) {
+	c, _ := newTestCache(Options{})
+	release := make(chan struct{})
+	o := newOrigin(map[string]string{"cache-control": "max-age=60"})
+	h := c.Middleware(func(w response.Writer, r *request.Request) {
+		<-release
+		o.handle(w, r)
+	})
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 8)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies[i] = servertest.Do(h, servertest.NewRequest("GET", "/slow")).Body.String()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), o.calls.Load())
+	for _, b := range bodies {
+		assert.Equal(t, "v1", b)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	o := newOrigin(map[string]string{"cache-control": "max-age=60"})
+	// each entry is about 75 bytes of key and headers
+	c, _ := newTestCache(Options{MaxBytes: 250})
+	h := c.Middleware(o.handle)
+
+	for _, p := range []string{"/a", "/b", "/c"} {
+		servertest.Do(h, servertest.NewRequest("GET", p))
+	}
+	require.Equal(t, 3, c.Len())
+	servertest.Do(h, servertest.NewRequest("GET", "/a"))
+	servertest.Do(h, servertest.NewRequest("GET", "/d"))
+
+	assert.Equal(t, 3, c.Len())
+	assert.LessOrEqual(t, c.Size(), int64(250))
+	calls := o.calls.Load()
+	servertest.Do(h, servertest.NewRequest("GET", "/a"))
+	servertest.Do(h, servertest.NewRequest("GET", "/c"))
+	assert.Equal(t, calls, o.calls.Load())
+	assert.Equal(t, "v5", servertest.Do(h, servertest.NewRequest("GET", "/b")).Body.String())
+
+	// Test: chunked responses are stored with a length
+	c, _ = newTestCache(Options{})
+	h = c.Middleware(func(w response.Writer, r *request.Request) {
+		hd := headers.NewHeaders()
+		hd.Set("transfer-encoding", "chunked")
+		hd.Set("cache-control", "max-age=60")
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(hd)
+		w.WriteChunkedBody([]byte(strings.Repeat("x", 10)))
+		w.WriteChunkedBodyDone()
+	})
+	servertest.Do(h, servertest.NewRequest("GET", "/"))
+	rec := servertest.Do(h, servertest.NewRequest("GET", "/"))
+	assert.Equal(t, "10", rec.Header("Content-Length"))
+	assert.Empty(t, rec.Header("Transfer-Encoding"))
+	assert.False(t, rec.Chunked)
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/cachecontrol"
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+)
+
+// storableStatus are the statuses stored, given explicit freshness. Others,
+// such as 206 and 302, aren't worth the trouble.
+var storableStatus = []response.StatusCode{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// entry is a stored response and what's needed to reuse it.
+type entry struct {
+	key string
+	// vary lists the request fields the response varies on, lower case,
+	// and values the ones the request that fetched it had.
+	vary   []string
+	values []string
+
+	status response.StatusCode
+	header headers.Headers
+	body   []byte
+
+	// stored is when the response arrived, and initialAge the age it had
+	// then, from its Age header.
+	stored     time.Time
+	initialAge time.Duration
+	lifetime   time.Duration
+	// staleWhileRevalidate and staleIfError are how long past lifetime
+	// the entry may still be served, and then only in those cases.
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	size int64
+}
+
+// policy decides whether a response may be stored, and for how long it
+// stays fresh (RFC 9111, sections 3 and 4.2.1). Only responses with
+// explicit freshness are stored; heuristics are left to private caches.
+func policy(r *request.Request, status response.StatusCode, h headers.Headers, now time.Time) (*entry, bool) {
+
+	if !slices.Contains(storableStatus, status) {
+		return nil, false
+	}
+	cc := cachecontrol.Parse(value(h, "cache-control"))
+	if cc.Has("no-store") || cc.Has("private") || cc.Has("no-cache") {
+		return nil, false
+	}
+	if _, err := r.Headers.GetString("authorization"); err == nil && !cc.Has("public") && !cc.Has("s-maxage") {
+		return nil, false
+	}
+	if _, err := h.GetString("set-cookie"); err == nil {
+		// one client's cookie is no business of the next
+		return nil, false
+	}
+
+	vary := varyFields(value(h, "vary"))
+	if slices.Contains(vary, "*") {
+		return nil, false
+	}
+
+	e := &entry{status: status, stored: now, vary: vary, values: varyValues(r, vary)}
+	if age, err := strconv.ParseInt(value(h, "age"), 10, 64); err == nil && age > 0 {
+		e.initialAge = time.Duration(age) * time.Second
+	}
+
+	if d, ok := cc.Duration("s-maxage"); ok {
+		e.lifetime = d
+	} else if d, ok := cc.Duration("max-age"); ok {
+		e.lifetime = d
+	} else if expires, err := h.GetString("expires"); err == nil {
+		date, err := http.ParseTime(value(h, "date"))
+		if err != nil {
+			date = now
+		}
+		// an invalid Expires, such as "0", means already expired
+		if t, err := http.ParseTime(expires); err == nil {
+			e.lifetime = t.Sub(date)
+		}
+	} else {
+		return nil, false
+	}
+
+	if !cc.Has("must-revalidate") && !cc.Has("proxy-revalidate") {
+		e.staleWhileRevalidate, _ = cc.Duration("stale-while-revalidate")
+		e.staleIfError, _ = cc.Duration("stale-if-error")
+	}
+	if e.lifetime <= 0 && e.staleWhileRevalidate <= 0 && e.staleIfError <= 0 {
+		return nil, false
+	}
+	return e, true
+}
+
+func (e *entry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.stored)
+}
+
+// matches reports whether e was fetched for a request with the same values
+// for the fields e varies on as r.
+func (e *entry) matches(r *request.Request) bool {
+	return slices.Equal(e.values, varyValues(r, e.vary))
+}
+
+// varyFields lists the field names in a Vary value, lower case.
+func varyFields(vary string) []string {
+
+	var fields []string
+	for _, f := range strings.Split(vary, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f != "" && !slices.Contains(fields, f) {
+			fields = append(fields, f)
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// varyValues reads r's values for fields, with whitespace around list
+// elements normalised so trivially different requests share an entry.
+func varyValues(r *request.Request, fields []string) []string {
+
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		v, err := r.Headers.GetString(f)
+		if err != nil {
+			values[i] = "\x00" // absent, unlike empty
+			continue
+		}
+		parts := strings.Split(v, ",")
+		for j := range parts {
+			parts[j] = strings.TrimSpace(parts[j])
+		}
+		values[i] = strings.Join(parts, ",")
+	}
+	return values
+}
+
+func value(h headers.Headers, key string) string {
+	v, _ := h.GetString(key)
+	return v
+}
@@ -0,0 +1,159 @@
+// Package cachecontrol builds and parses Cache-Control field values
+// (RFC 9111, section 5.2, and RFC 5861 for the stale-* extensions).
+package cachecontrol
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+)
+
+// Directives maps lower case directive names to their arguments, "" for
+// directives that take none. The builder methods set a directive and
+// return d, so a value reads as a chain:
+//
+//	cachecontrol.Directives{}.Public().MaxAge(time.Hour).String()
+type Directives map[string]string
+
+// order is how String lists the directives it knows; others follow,
+// sorted.
+var order = []string{
+	"public", "private", "no-cache", "no-store", "no-transform",
+	"max-age", "s-maxage", "must-revalidate", "proxy-revalidate",
+	"must-understand", "immutable", "stale-while-revalidate", "stale-if-error",
+}
+
+// Parse reads a Cache-Control value. Quoted arguments are unquoted, and a
+// directive given twice keeps its first value. Unknown directives are kept
+// as they are.
+func Parse(value string) Directives {
+
+	d := Directives{}
+	for _, part := range headers.SplitQuoted(value, ',') {
+		name, arg, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		arg = strings.TrimSpace(arg)
+		if name == "" {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(arg); err == nil && strings.HasPrefix(arg, `"`) {
+			arg = unquoted
+		}
+		if _, ok := d[name]; !ok {
+			d[name] = arg
+		}
+	}
+	return d
+}
+
+// Has reports whether the directive is present.
+func (d Directives) Has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// Duration reads a delta-seconds argument, such as max-age's. It reports
+// false if the directive is missing or its argument isn't a number.
+func (d Directives) Duration(name string) (time.Duration, bool) {
+
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseUint(arg, 10, 63)
+	if err != nil {
+		return 0, false
+	}
+	// RFC 9111 caps delta-seconds at 2^31 rather than overflowing
+	return time.Duration(min(secs, 1<<31)) * time.Second, true
+}
+
+// String renders d as a Cache-Control value.
+func (d Directives) String() string {
+
+	var names []string
+	for _, name := range order {
+		if d.Has(name) {
+			names = append(names, name)
+		}
+	}
+	var rest []string
+	for name := range d {
+		if !slices.Contains(order, name) {
+			rest = append(rest, name)
+		}
+	}
+	slices.Sort(rest)
+	names = append(names, rest...)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		arg := d[name]
+		switch {
+		case arg == "":
+			parts[i] = name
+		case strings.ContainsAny(arg, " ,\"="):
+			parts[i] = name + "=" + strconv.Quote(arg)
+		default:
+			parts[i] = name + "=" + arg
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (d Directives) set(name, arg string) Directives {
+	d[name] = arg
+	return d
+}
+
+func seconds(t time.Duration) string {
+	return strconv.FormatInt(int64(max(t, 0)/time.Second), 10)
+}
+
+// Public lets shared caches store the response, even one that needs
+// authorization.
+func (d Directives) Public() Directives { return d.set("public", "") }
+
+// Private keeps the response out of shared caches.
+func (d Directives) Private() Directives { return d.set("private", "") }
+
+// NoCache makes caches revalidate the response before every use.
+func (d Directives) NoCache() Directives { return d.set("no-cache", "") }
+
+// NoStore keeps the response out of caches entirely.
+func (d Directives) NoStore() Directives { return d.set("no-store", "") }
+
+// NoTransform stops intermediaries changing the content.
+func (d Directives) NoTransform() Directives { return d.set("no-transform", "") }
+
+// MaxAge is how long the response stays fresh.
+func (d Directives) MaxAge(t time.Duration) Directives { return d.set("max-age", seconds(t)) }
+
+// SMaxAge is how long the response stays fresh in shared caches,
+// overriding MaxAge there.
+func (d Directives) SMaxAge(t time.Duration) Directives { return d.set("s-maxage", seconds(t)) }
+
+// MustRevalidate forbids serving the response stale.
+func (d Directives) MustRevalidate() Directives { return d.set("must-revalidate", "") }
+
+// ProxyRevalidate forbids shared caches serving the response stale.
+func (d Directives) ProxyRevalidate() Directives { return d.set("proxy-revalidate", "") }
+
+// Immutable says the response won't change while fresh, so clients needn't
+// revalidate it on reload.
+func (d Directives) Immutable() Directives { return d.set("immutable", "") }
+
+// StaleWhileRevalidate lets caches serve the response for up to t after
+// it goes stale, while they fetch a fresh one in the background.
+func (d Directives) StaleWhileRevalidate(t time.Duration) Directives {
+	return d.set("stale-while-revalidate", seconds(t))
+}
+
+// StaleIfError lets caches serve the response for up to t after it goes
+// stale, if fetching a fresh one fails.
+func (d Directives) StaleIfError(t time.Duration) Directives {
+	return d.set("stale-if-error", seconds(t))
+}
@@ -0,0 +1,48 @@
+package cachecontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild(t *testing.T) {
+	d := Directives{}.Public().MaxAge(time.Hour).StaleWhileRevalidate(30 * time.Second).StaleIfError(24 * time.Hour)
+	assert.Equal(t, "public, max-age=3600, stale-while-revalidate=30, stale-if-error=86400", d.String())
+
+	assert.Equal(t, "no-store", Directives{}.NoStore().String())
+	assert.Equal(t, "private, no-cache, max-age=0, must-revalidate", Directives{}.MustRevalidate().MaxAge(0).NoCache().Private().String())
+	assert.Equal(t, "max-age=31536000, immutable", Directives{}.Immutable().MaxAge(365*24*time.Hour).String())
+
+	// Test: extensions sort after the standard directives and get quoted if need be
+	d = Directives{"x-b": "1", "x-a": "two words"}.SMaxAge(time.Minute)
+	assert.Equal(t, `s-maxage=60, x-a="two words", x-b=1`, d.String())
+}
+
+func TestParse(t *testing.T) {
+	d := Parse(`Public, MAX-AGE=60, private="set-cookie, authorization", s-maxage="120", max-age=5, , no-transform`)
+	assert.Equal(t, Directives{
+		"public":       "",
+		"max-age":      "60",
+		"private":      "set-cookie, authorization",
+		"s-maxage":     "120",
+		"no-transform": "",
+	}, d)
+
+	age, ok := d.Duration("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, age)
+	age, ok = d.Duration("s-maxage")
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, age)
+	assert.True(t, d.Has("no-transform"))
+	assert.False(t, d.Has("no-store"))
+
+	_, ok = Parse("max-age=soon").Duration("max-age")
+	assert.False(t, ok)
+	_, ok = Parse("max-age=-1").Duration("max-age")
+	assert.False(t, ok)
+	age, _ = Parse("max-age=99999999999999").Duration("max-age")
+	assert.Equal(t, time.Duration(1<<31)*time.Second, age)
+}
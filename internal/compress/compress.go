@@ -0,0 +1,379 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+const (
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+// Options configures the compression middleware.
+type Options struct {
+	// MinSize is the smallest body, in bytes, worth compressing.
+	MinSize int
+	// MaxBufferSize is the largest body with a known length that is
+	// compressed whole and sent with a new content-length. Larger ones are
+	// compressed as a chunked stream instead of being held in memory. Zero
+	// means DefaultMaxBufferSize.
+	MaxBufferSize int
+	// Level is passed to the gzip and zlib writers.
+	Level int
+	// SkipContentTypes lists media types that are already compressed. An
+	// entry ending in "/" matches every subtype, e.g. "video/".
+	SkipContentTypes []string
+}
+
+// DefaultMaxBufferSize is the largest body buffered to compress whole.
+const DefaultMaxBufferSize = 1 << 20
+
+var DefaultOptions = Options{
+	MinSize:       1024,
+	MaxBufferSize: DefaultMaxBufferSize,
+	Level:         gzip.DefaultCompression,
+	SkipContentTypes: []string{
+		"video/",
+		"audio/",
+		"image/png",
+		"image/jpeg",
+		"image/gif",
+		"image/webp",
+		"image/avif",
+		"font/woff",
+		"font/woff2",
+		"application/zip",
+		"application/gzip",
+		"application/x-gzip",
+		"application/x-bzip2",
+		"application/x-7z-compressed",
+		"application/zstd",
+		"application/pdf",
+		"text/event-stream",
+	},
+}
+
+// Middleware compresses responses using DefaultOptions.
+func Middleware(next server.Handler) server.Handler {
+	return New(DefaultOptions)(next)
+}
+
+// New returns a middleware that compresses response bodies with whichever of
+// gzip or deflate the client prefers in its Accept-Encoding header.
+func New(opts Options) func(server.Handler) server.Handler {
+
+	if opts.MaxBufferSize <= 0 {
+		opts.MaxBufferSize = DefaultMaxBufferSize
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w response.Writer, r *request.Request) {
+			acceptEncoding, _ := r.Headers.GetString("accept-encoding")
+			encoding := Negotiate(acceptEncoding)
+			if r.RequestLine.Method == "HEAD" {
+				encoding = ""
+			}
+
+			c := &compressor{next: w, opts: opts, encoding: encoding}
+			c.bw = response.NewBufferedWriter(w, response.BufferHooks{
+				Headers:  c.headers,
+				Overflow: c.stream,
+				Complete: c.complete,
+			})
+			next(c.bw, r)
+
+			err := c.close()
+			if err != nil {
+				fmt.Println("Error:", err)
+			}
+		}
+	}
+}
+
+// Negotiate picks the content coding to use for an Accept-Encoding value. It
+// returns "" when the response should be sent uncompressed.
+func Negotiate(acceptEncoding string) string {
+
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q, ok := parseCoding(part)
+		if !ok {
+			continue
+		}
+		qualities[coding] = q
+	}
+
+	quality := func(coding string) float64 {
+		if q, ok := qualities[coding]; ok {
+			return q
+		}
+		if q, ok := qualities["*"]; ok {
+			return q
+		}
+		return 0
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, coding := range []string{Gzip, Deflate} {
+		q := quality(coding)
+		if q > bestQ {
+			best = coding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+func parseCoding(part string) (string, float64, bool) {
+
+	params := strings.Split(part, ";")
+	coding := strings.ToLower(strings.TrimSpace(params[0]))
+	if coding == "" {
+		return "", 0, false
+	}
+	if coding == "x-gzip" {
+		coding = Gzip
+	}
+
+	q := 1.0
+	for _, param := range params[1:] {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found || strings.ToLower(strings.TrimSpace(name)) != "q" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return "", 0, false
+		}
+		q = parsed
+	}
+
+	return coding, q, true
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressor decides, once the headers are known, whether a response gets
+// compressed. Bodies with a known length up to MaxBufferSize are buffered
+// whole and sent with a new content-length; anything else is buffered up
+// to MinSize and then streamed as chunks.
+type compressor struct {
+	next     response.Writer
+	opts     Options
+	encoding string
+
+	bw *response.BufferedWriter
+	ew *encodingWriter
+}
+
+func (c *compressor) headers(bw *response.BufferedWriter) (bool, error) {
+
+	if !bodyAllowed(bw.Status) || !c.compressible(bw.Header) {
+		return false, nil
+	}
+	bw.Header.AddVary("Accept-Encoding")
+
+	if c.encoding == "" {
+		return false, nil
+	}
+	if _, err := bw.Header.GetString("content-encoding"); err == nil {
+		return false, nil
+	}
+
+	if bw.ContentLength >= 0 {
+		if bw.ContentLength < c.opts.MinSize {
+			return false, nil
+		}
+		if bw.ContentLength > c.opts.MaxBufferSize {
+			return false, c.stream(bw)
+		}
+		bw.Limit = c.opts.MaxBufferSize
+		return true, nil
+	}
+	bw.Limit = c.opts.MinSize
+	return true, nil
+}
+
+// complete sends a body that has been buffered whole: compressed if it was
+// always going to be, as it is if it stayed under MinSize.
+func (c *compressor) complete(bw *response.BufferedWriter, trailers headers.Headers) error {
+
+	if bw.ContentLength < 0 {
+		if !bw.Chunked {
+			bw.Header.Set("content-length", strconv.Itoa(bw.Body.Len()))
+		}
+		return bw.Send(trailers)
+	}
+
+	var compressed bytes.Buffer
+	enc, err := c.newEncoder(&compressed)
+	if err != nil {
+		return err
+	}
+	_, err = enc.Write(bw.Body.Bytes())
+	if err != nil {
+		return err
+	}
+	err = enc.Close()
+	if err != nil {
+		return err
+	}
+
+	bw.Header.Set("content-encoding", c.encoding)
+	bw.Header.Set("content-length", strconv.Itoa(compressed.Len()))
+	bw.Body.Reset()
+	bw.Body.Write(compressed.Bytes())
+	return bw.Send(nil)
+}
+
+// stream starts compressing a body as chunks, once it has outgrown
+// MinSize, is too big to buffer or the handler flushes.
+func (c *compressor) stream(bw *response.BufferedWriter) error {
+
+	bw.Header.Del("content-length")
+	bw.Header.Set("content-encoding", c.encoding)
+	bw.Header.Set("transfer-encoding", "chunked")
+
+	enc, err := c.newEncoder(chunkWriter{c.next})
+	if err != nil {
+		return err
+	}
+	c.ew = &encodingWriter{next: c.next, enc: enc}
+	return bw.PassTo(c.ew)
+}
+
+// close ends the response the handler left unfinished, e.g. a body
+// shorter than its content-length or a stream it never ended.
+func (c *compressor) close() error {
+	err := c.bw.Close()
+	if err != nil || c.ew == nil {
+		return err
+	}
+	return c.ew.end(nil)
+}
+
+func bodyAllowed(status response.StatusCode) bool {
+	code := status.GetCode()
+	return code >= 200 && code != 204 && code != 304
+}
+
+func (c *compressor) compressible(h headers.Headers) bool {
+
+	contentType, _ := h.GetString("content-type")
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	for _, skip := range c.opts.SkipContentTypes {
+		if strings.HasSuffix(skip, "/") && strings.HasPrefix(mediaType, skip) {
+			return false
+		}
+		if mediaType == skip {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *compressor) newEncoder(w io.Writer) (encoder, error) {
+	switch c.encoding {
+	case Gzip:
+		return gzip.NewWriterLevel(w, c.opts.Level)
+	case Deflate:
+		// "deflate" in HTTP means the zlib format, not a raw deflate stream
+		return zlib.NewWriterLevel(w, c.opts.Level)
+	default:
+		return nil, fmt.Errorf("Error: unsupported encoding %q", c.encoding)
+	}
+}
+
+// encodingWriter compresses the body of a streamed response, whichever
+// way the handler frames it, and ends the chunks when the handler does.
+type encodingWriter struct {
+	next response.Writer
+	enc  encoder
+	done bool
+}
+
+func (ew *encodingWriter) WriteStatusLine(statusCode response.StatusCode) error {
+	return ew.next.WriteStatusLine(statusCode)
+}
+
+func (ew *encodingWriter) WriteHeaders(h headers.Headers) error {
+	return ew.next.WriteHeaders(h)
+}
+
+func (ew *encodingWriter) WriteBody(p []byte) (int, error) {
+	if ew.done {
+		return 0, fmt.Errorf("Error: body written after the end of the response")
+	}
+	_, err := ew.enc.Write(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), ew.enc.Flush()
+}
+
+func (ew *encodingWriter) WriteChunkedBody(p []byte) (int, error) {
+	return ew.WriteBody(p)
+}
+
+func (ew *encodingWriter) WriteChunkedBodyDone() (int, error) {
+	return 0, ew.end(nil)
+}
+
+func (ew *encodingWriter) WriteTrailers(h headers.Headers) error {
+	return ew.end(h)
+}
+
+// Flush pushes out anything the encoder is holding.
+func (ew *encodingWriter) Flush() error {
+	if !ew.done {
+		err := ew.enc.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return response.Flush(ew.next)
+}
+
+func (ew *encodingWriter) end(trailers headers.Headers) error {
+	if ew.done {
+		return nil
+	}
+	ew.done = true
+
+	err := ew.enc.Close()
+	if err != nil {
+		return err
+	}
+	if trailers != nil {
+		return ew.next.WriteTrailers(trailers)
+	}
+	_, err = ew.next.WriteChunkedBodyDone()
+	return err
+}
+
+// chunkWriter turns each write from the encoder into a chunk on the wire.
+type chunkWriter struct {
+	w response.Writer
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	return c.w.WriteChunkedBody(p)
+}
@@ -0,0 +1,191 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, handler func(w response.Writer, r *request.Request), acceptEncoding string) *http.Response {
+	t.Helper()
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	if acceptEncoding != "" {
+		req.Headers.Set("accept-encoding", acceptEncoding)
+	}
+
+	buf := new(bytes.Buffer)
+	Middleware(handler)(response.NewWriter(buf), req)
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func fixedBody(body []byte, contentType string) func(w response.Writer, r *request.Request) {
+	return func(w response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body), contentType))
+		w.WriteBody(body)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, "", Negotiate(""))
+	assert.Equal(t, Gzip, Negotiate("gzip"))
+	assert.Equal(t, Gzip, Negotiate("gzip, deflate, br"))
+	assert.Equal(t, Deflate, Negotiate("gzip;q=0.5, deflate"))
+	assert.Equal(t, Deflate, Negotiate("gzip;q=0, *"))
+	assert.Equal(t, Gzip, Negotiate("*;q=0.1"))
+	assert.Equal(t, "", Negotiate("br, identity"))
+	assert.Equal(t, "", Negotiate("gzip;q=0, deflate;q=0"))
+	assert.Equal(t, Gzip, Negotiate("x-gzip"))
+	assert.Equal(t, Deflate, Negotiate("gzip;q=nope, deflate;q=0.2"))
+}
+
+func TestMiddleware_GzipKnownLength(t *testing.T) {
+	body := []byte(strings.Repeat("hello world ", 200))
+	resp := serve(t, fixedBody(body, "text/html"), "gzip, deflate")
+
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Less(t, resp.ContentLength, int64(len(body)))
+	assert.Empty(t, resp.TransferEncoding)
+
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	got, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+
+	// Test: bodies over MaxBufferSize stream instead of being held whole
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.Headers.Set("accept-encoding", "gzip")
+	buf := new(bytes.Buffer)
+	opts := DefaultOptions
+	opts.MaxBufferSize = 1000
+	New(opts)(fixedBody(body, "text/html"))(response.NewWriter(buf), req)
+	resp, err = http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	gz, err = gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	got, err = io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+}
+
+func TestMiddleware_DeflateUsesZlib(t *testing.T) {
+	body := []byte(strings.Repeat("abc", 1000))
+	resp := serve(t, fixedBody(body, "text/plain"), "deflate")
+
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	zr, err := zlib.NewReader(resp.Body)
+	require.NoError(t, err)
+	got, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+}
+
+func TestMiddleware_ChunkedStreaming(t *testing.T) {
+	handler := func(w response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.Ok)
+		h := response.GetDefaultHeaders(0, "text/plain")
+		h.Del("content-length")
+		h.Set("transfer-encoding", "chunked")
+		w.WriteHeaders(h)
+		for range 10 {
+			w.WriteChunkedBody([]byte(strings.Repeat("x", 300)))
+		}
+		w.WriteChunkedBodyDone()
+	}
+	resp := serve(t, handler, "gzip")
+
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	got, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", 3000), string(got))
+}
+
+func TestMiddleware_Skipped(t *testing.T) {
+	// Test: client does not accept any encoding
+	body := []byte(strings.Repeat("a", 4096))
+	resp := serve(t, fixedBody(body, "text/html"), "")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	got, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, body, got)
+
+	// Test: already compressed content type
+	resp = serve(t, fixedBody(body, "video/mp4"), "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, resp.Header.Get("Vary"))
+	got, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, body, got)
+
+	// Test: below the minimum size
+	resp = serve(t, fixedBody([]byte("tiny"), "text/html"), "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(4), resp.ContentLength)
+}
+
+func TestDecodeRequest(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(strings.Repeat("z", 5000)))
+	zw.Close()
+
+	var got []byte
+	handler := DecodeRequest(10000)(func(w response.Writer, r *request.Request) {
+		got = r.Body
+		fixedBody([]byte("ok"), "text/plain")(w, r)
+	})
+	run := func(encoding string, body []byte) *http.Response {
+		req := &request.Request{Headers: headers.NewHeaders(), Body: body}
+		req.Headers.Set("content-encoding", encoding)
+		buf := new(bytes.Buffer)
+		handler(response.NewWriter(buf), req)
+		resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := run("gzip", gz.Bytes())
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 5000, len(got))
+
+	resp = run("br", []byte("x"))
+	assert.Equal(t, 415, resp.StatusCode)
+	assert.Equal(t, "gzip, deflate", resp.Header.Get("Accept-Encoding"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "Unsupported Media Type\n", string(body))
+
+	// Test: decoder errors are logged, not sent
+	resp = run("gzip", []byte("garbage"))
+	assert.Equal(t, 400, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "Bad Request\n", string(body))
+
+	handler = DecodeRequest(100)(handler)
+	resp = run("gzip", gz.Bytes())
+	assert.Equal(t, 413, resp.StatusCode)
+}
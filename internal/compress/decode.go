@@ -0,0 +1,41 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// DecodeRequest returns a middleware that decodes gzip and deflate request
+// bodies before they reach the handler. Bodies that decode to more than
+// maxSize bytes get a 413, unknown codings a 415 and corrupt bodies a 400.
+// The client only sees the status; why the body was refused is logged.
+func DecodeRequest(maxSize int) func(server.Handler) server.Handler {
+	return func(next server.Handler) server.Handler {
+		return func(w response.Writer, r *request.Request) {
+
+			err := r.DecodeBody(maxSize)
+			if err == nil {
+				next(w, r)
+				return
+			}
+			fmt.Println("Error: decoding request body:", err)
+
+			he := server.HandlerError{StatusCode: response.BadRequest}
+			switch {
+			case errors.Is(err, request.ErrUnsupportedEncoding):
+				he.StatusCode = response.UnsupportedMediaType
+				he.Headers = headers.NewHeaders()
+				he.Headers.Set("accept-encoding", "gzip, deflate")
+			case errors.Is(err, request.ErrDecodedBodyTooLarge):
+				he.StatusCode = response.ContentTooLarge
+			}
+			he.Message = he.StatusCode.GetMessage()
+			he.Write(w)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package conditional answers conditional requests (RFC 9110, section
+// 13): it gives responses an ETag and turns them into a 304 Not Modified
+// or 412 Precondition Failed when the request's preconditions say so.
+package conditional
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// DefaultMaxSize is the largest body buffered to compute an ETag.
+const DefaultMaxSize = 1 << 20
+
+// Options configures the middleware.
+type Options struct {
+	// Weak makes computed ETags weak, for handlers whose output can
+	// change byte for byte without changing in meaning.
+	Weak bool
+	// MaxSize is the largest body buffered to compute an ETag. Larger
+	// bodies are streamed through, and only a Last-Modified or an ETag
+	// the handler set itself is checked against.
+	MaxSize int
+}
+
+var DefaultOptions = Options{MaxSize: DefaultMaxSize}
+
+// Middleware handles conditional requests using DefaultOptions.
+func Middleware(next server.Handler) server.Handler {
+	return New(DefaultOptions)(next)
+}
+
+// New returns a middleware that evaluates the preconditions of GET and
+// HEAD requests against the 200 responses of the handlers it wraps. An
+// ETag the handler sets is used as it is; otherwise one is computed over
+// the body. Put it outside compress.Middleware so each encoding gets its
+// own tag.
+//
+// Handlers for other methods have to check preconditions themselves,
+// before they change anything, with Evaluate.
+func New(opts Options) func(server.Handler) server.Handler {
+
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w response.Writer, r *request.Request) {
+
+			method := r.RequestLine.Method
+			if method != "GET" && method != "HEAD" {
+				next(w, r)
+				return
+			}
+
+			c := &check{next: w, r: r, opts: opts}
+			bw := response.NewBufferedWriter(w, response.BufferHooks{
+				Headers:  c.headers,
+				Overflow: c.decide,
+				Complete: c.finish,
+			})
+			bw.Limit = opts.MaxSize
+			next(bw, r)
+
+			err := bw.Close()
+			if err != nil {
+				fmt.Println("Error:", err)
+			}
+		}
+	}
+}
+
+// ETag computes a strong entity tag for body, or a weak one if weak is
+// set.
+func ETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	tag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// Evaluate applies r's preconditions to the current representation of the
+// resource, in the order RFC 9110, section 13.2.2 gives. etag and
+// lastModified are its validators, empty or zero if it has none. It
+// returns response.Ok if the request should go ahead, or the status to
+// answer with instead: NotModified or PreconditionFailed.
+//
+// The resource is assumed to exist, so "*" always matches.
+func Evaluate(r *request.Request, etag string, lastModified time.Time) response.StatusCode {
+
+	method := r.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+	lastModified = lastModified.Truncate(time.Second)
+
+	if v, err := r.Headers.GetString("if-match"); err == nil {
+		if !matches(v, etag, true) {
+			return response.PreconditionFailed
+		}
+	} else if v, err := r.Headers.GetString("if-unmodified-since"); err == nil {
+		t, err := http.ParseTime(v)
+		if err == nil && !lastModified.IsZero() && lastModified.After(t) {
+			return response.PreconditionFailed
+		}
+	}
+
+	if v, err := r.Headers.GetString("if-none-match"); err == nil {
+		if matches(v, etag, false) {
+			if safe {
+				return response.NotModified
+			}
+			return response.PreconditionFailed
+		}
+	} else if v, err := r.Headers.GetString("if-modified-since"); err == nil && safe {
+		t, err := http.ParseTime(v)
+		if err == nil && !lastModified.IsZero() && !lastModified.After(t) {
+			return response.NotModified
+		}
+	}
+
+	return response.Ok
+}
+
+// matches reports whether etag is in list, an If-Match or If-None-Match
+// value, comparing strongly or weakly (RFC 9110, section 8.8.3.2).
+func matches(list, etag string, strong bool) bool {
+
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	weak, opaque := splitETag(etag)
+	if strong && weak {
+		return false
+	}
+
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		w, rest := false, list
+		if strings.HasPrefix(rest, "W/") {
+			w, rest = true, rest[2:]
+		}
+		if !strings.HasPrefix(rest, `"`) {
+			return false
+		}
+		end := strings.IndexByte(rest[1:], '"')
+		if end == -1 {
+			return false
+		}
+		if rest[1:end+1] == opaque && !(strong && w) {
+			return true
+		}
+		list = rest[end+2:]
+	}
+	return false
+}
+
+func splitETag(etag string) (weak bool, opaque string) {
+	weak = strings.HasPrefix(etag, "W/")
+	return weak, strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+}
+
+// notModifiedHeaders are the fields a 304 keeps from the 200 it stands
+// for (RFC 9110, section 15.4.5).
+var notModifiedHeaders = []string{
+	"etag", "last-modified", "cache-control", "content-location", "date", "expires", "vary", "connection",
+}
+
+// check holds back a 200 until its validators are known. With an ETag
+// from the handler, or for HEAD, that's as soon as the headers are
+// written; otherwise the body is buffered to compute one.
+type check struct {
+	next response.Writer
+	r    *request.Request
+	opts Options
+}
+
+func (c *check) headers(bw *response.BufferedWriter) (bool, error) {
+
+	if bw.Status != response.Ok {
+		return false, nil
+	}
+	_, err := bw.Header.GetString("etag")
+	if err == nil || c.r.RequestLine.Method == "HEAD" || bw.ContentLength > c.opts.MaxSize {
+		return false, c.decide(bw)
+	}
+	return true, nil
+}
+
+// decide evaluates the preconditions against the validators in the
+// headers, and either answers early or lets the response through.
+func (c *check) decide(bw *response.BufferedWriter) error {
+
+	etag, _ := bw.Header.GetString("etag")
+	status := Evaluate(c.r, etag, lastModified(bw.Header))
+	if status != response.Ok {
+		bw.Discard()
+		return c.answer(status, bw.Header)
+	}
+	return bw.Pass()
+}
+
+// finish tags the buffered body and sends the response it calls for.
+func (c *check) finish(bw *response.BufferedWriter, trailers headers.Headers) error {
+
+	etag := ETag(bw.Body.Bytes(), c.opts.Weak)
+	bw.Header.Set("etag", etag)
+	status := Evaluate(c.r, etag, lastModified(bw.Header))
+	if status != response.Ok {
+		return c.answer(status, bw.Header)
+	}
+	return bw.Send(trailers)
+}
+
+// answer sends a 304 or 412 in place of the handler's response.
+func (c *check) answer(status response.StatusCode, header headers.Headers) error {
+
+	if status == response.PreconditionFailed {
+		he := server.HandlerError{StatusCode: status, Message: "Precondition Failed"}
+		he.Write(c.next)
+		return nil
+	}
+
+	h := headers.NewHeaders()
+	for _, name := range notModifiedHeaders {
+		if v, err := header.GetString(name); err == nil {
+			h.Set(name, v)
+		}
+	}
+	err := c.next.WriteStatusLine(status)
+	if err != nil {
+		return err
+	}
+	return c.next.WriteHeaders(h)
+}
+
+func lastModified(h headers.Headers) time.Time {
+	v, err := h.GetString("last-modified")
+	if err != nil {
+		return time.Time{}
+	}
+	t, _ := http.ParseTime(v)
+	return t
+}
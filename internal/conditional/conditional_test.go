@@ -0,0 +1,167 @@
+package conditional
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var modified = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func page(w response.Writer, r *request.Request) {
+	body := []byte("<h1>hello</h1>")
+	h := response.GetDefaultHeaders(len(body), "text/html")
+	h.Set("last-modified", modified.Format(headers.TimeFormat))
+	h.Set("cache-control", "max-age=60")
+	h.Set("vary", "Accept-Encoding")
+	w.WriteStatusLine(response.Ok)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func TestMiddleware(t *testing.T) {
+	rec := servertest.Do(Middleware(page), servertest.NewRequest("GET", "/"))
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "<h1>hello</h1>", rec.Body.String())
+	etag := rec.Header("ETag")
+	assert.Equal(t, ETag([]byte("<h1>hello</h1>"), false), etag)
+
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("GET", "/").Header("If-None-Match", `"other", `+etag))
+	assert.Equal(t, response.NotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	assert.Equal(t, etag, rec.Header("ETag"))
+	assert.Equal(t, "max-age=60", rec.Header("Cache-Control"))
+	assert.Equal(t, "Accept-Encoding", rec.Header("Vary"))
+	assert.Empty(t, rec.Header("Content-Type"))
+
+	// Test: weak comparison for If-None-Match
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("GET", "/").Header("If-None-Match", "W/"+etag))
+	assert.Equal(t, response.NotModified, rec.Code)
+
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("GET", "/").Header("If-None-Match", `"other"`))
+	assert.Equal(t, response.Ok, rec.Code)
+
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("GET", "/").Header("If-Match", `"other"`))
+	assert.Equal(t, response.PreconditionFailed, rec.Code)
+
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("GET", "/").Header("If-Match", etag))
+	assert.Equal(t, response.Ok, rec.Code)
+
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("GET", "/").Header("If-Modified-Since", modified.Format(headers.TimeFormat)))
+	assert.Equal(t, response.NotModified, rec.Code)
+
+	// Test: If-None-Match takes precedence over If-Modified-Since
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("GET", "/").Header("If-None-Match", `"other"`).Header("If-Modified-Since", modified.Format(headers.TimeFormat)))
+	assert.Equal(t, response.Ok, rec.Code)
+
+	// Test: HEAD decides on the headers alone
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("HEAD", "/").Header("If-Modified-Since", modified.Add(time.Hour).Format(headers.TimeFormat)))
+	assert.Equal(t, response.NotModified, rec.Code)
+
+	// Test: other methods and statuses pass through
+	rec = servertest.Do(Middleware(page), servertest.NewRequest("POST", "/").Header("If-None-Match", "*"))
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Empty(t, rec.Header("ETag"))
+	notFound := func(w response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.NotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(0, "text/plain"))
+	}
+	rec = servertest.Do(Middleware(notFound), servertest.NewRequest("GET", "/").Header("If-None-Match", "*"))
+	assert.Equal(t, response.NotFound, rec.Code)
+}
+
+func TestMiddleware_HandlerETag(t *testing.T) {
+	calls := 0
+	h := func(w response.Writer, r *request.Request) {
+		calls++
+		hd := response.GetDefaultHeaders(0, "text/plain")
+		hd.Del("content-length")
+		hd.Set("transfer-encoding", "chunked")
+		hd.Set("etag", `W/"v1"`)
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(hd)
+		w.WriteChunkedBody([]byte("streamed"))
+		w.WriteChunkedBodyDone()
+	}
+
+	rec := servertest.Do(Middleware(h), servertest.NewRequest("GET", "/"))
+	assert.Equal(t, "streamed", rec.Body.String())
+	assert.Equal(t, `W/"v1"`, rec.Header("ETag"))
+
+	rec = servertest.Do(Middleware(h), servertest.NewRequest("GET", "/").Header("If-None-Match", `"v1"`))
+	assert.Equal(t, response.NotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	// Test: weak tags never match If-Match
+	rec = servertest.Do(Middleware(h), servertest.NewRequest("GET", "/").Header("If-Match", `W/"v1"`))
+	assert.Equal(t, response.PreconditionFailed, rec.Code)
+}
+
+func TestMiddleware_Chunked(t *testing.T) {
+	chunks := func(w response.Writer, r *request.Request) {
+		hd := headers.NewHeaders()
+		hd.Set("transfer-encoding", "chunked")
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(hd)
+		w.WriteChunkedBody([]byte("a"))
+		w.WriteChunkedBody([]byte("b"))
+		trailers := headers.NewHeaders()
+		trailers.Set("x-sum", "ab")
+		w.WriteTrailers(trailers)
+	}
+
+	rec := servertest.Do(Middleware(chunks), servertest.NewRequest("GET", "/"))
+	assert.Equal(t, "ab", rec.Body.String())
+	assert.Equal(t, ETag([]byte("ab"), false), rec.Header("ETag"))
+	assert.Equal(t, "ab", rec.Trailers["x-sum"])
+
+	// Test: bodies over MaxSize stream through untagged
+	rec = servertest.Do(New(Options{MaxSize: 1, Weak: true})(chunks), servertest.NewRequest("GET", "/"))
+	assert.Equal(t, "ab", rec.Body.String())
+	assert.Empty(t, rec.Header("ETag"))
+	assert.Equal(t, "ab", rec.Trailers["x-sum"])
+
+	rec = servertest.Do(New(Options{Weak: true})(chunks), servertest.NewRequest("GET", "/"))
+	assert.True(t, strings.HasPrefix(rec.Header("ETag"), `W/"`))
+}
+
+func TestEvaluate(t *testing.T) {
+	etag := `"abc"`
+	date := func(t time.Time) string { return t.Format(headers.TimeFormat) }
+	cases := []struct {
+		method string
+		header [2]string
+		want   response.StatusCode
+	}{
+		{"PUT", [2]string{"If-Match", `"abc"`}, response.Ok},
+		{"PUT", [2]string{"If-Match", `"a", "b"`}, response.PreconditionFailed},
+		{"PUT", [2]string{"If-Match", "*"}, response.Ok},
+		{"PUT", [2]string{"If-None-Match", "*"}, response.PreconditionFailed},
+		{"PUT", [2]string{"If-None-Match", `W/"abc"`}, response.PreconditionFailed},
+		{"PUT", [2]string{"If-Unmodified-Since", date(modified)}, response.Ok},
+		{"PUT", [2]string{"If-Unmodified-Since", date(modified.Add(-time.Second))}, response.PreconditionFailed},
+		{"PUT", [2]string{"If-Unmodified-Since", "not a date"}, response.Ok},
+		{"GET", [2]string{"If-Modified-Since", date(modified.Add(-time.Second))}, response.Ok},
+		{"GET", [2]string{"If-Modified-Since", "Friday, 01-Mar-24 12:00:00 GMT"}, response.NotModified},
+		{"POST", [2]string{"If-Modified-Since", date(modified)}, response.Ok},
+	}
+	for _, c := range cases {
+		r := servertest.NewRequest(c.method, "/").Header(c.header[0], c.header[1]).Request()
+		assert.Equal(t, c.want, Evaluate(r, etag, modified.Add(500*time.Millisecond)), "%s %s: %s", c.method, c.header[0], c.header[1])
+	}
+
+	// Test: If-Match wins over If-Unmodified-Since
+	r := servertest.NewRequest("PUT", "/").Header("If-Match", etag).Header("If-Unmodified-Since", date(modified.Add(-time.Hour))).Request()
+	require.Equal(t, response.Ok, Evaluate(r, etag, modified))
+
+	// Test: no validators, no match
+	r = servertest.NewRequest("PUT", "/").Header("If-Match", `"abc"`).Request()
+	assert.Equal(t, response.PreconditionFailed, Evaluate(r, "", time.Time{}))
+}
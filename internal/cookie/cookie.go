@@ -0,0 +1,187 @@
+package cookie
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+)
+
+var ErrNoCookie = fmt.Errorf("Error: cookie not present")
+var ErrInvalidName = fmt.Errorf("Error: invalid cookie name")
+var ErrInvalidValue = fmt.Errorf("Error: invalid cookie value")
+var ErrInvalidAttribute = fmt.Errorf("Error: invalid cookie attribute")
+
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is a single cookie, as read from a Cookie header or written in a
+// Set-Cookie header. Only Name and Value are set on parsed request cookies.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time
+	// MaxAge of 0 leaves the attribute out, a negative value sends
+	// Max-Age=0 so the client deletes the cookie straight away.
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// Parse splits a Cookie request header value into its cookies, skipping any
+// pair that isn't valid.
+func Parse(header string) []*Cookie {
+
+	var cookies []*Cookie
+	for _, pair := range strings.Split(header, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !validName(name) {
+			continue
+		}
+		value, ok := parseValue(value)
+		if !ok {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: value})
+	}
+
+	return cookies
+}
+
+// FromHeaders returns every cookie in the cookie field of h.
+func FromHeaders(h headers.Headers) []*Cookie {
+	val, err := h.GetString("cookie")
+	if err != nil {
+		return nil
+	}
+	return Parse(val)
+}
+
+// Get returns the first cookie called name in the cookie field of h.
+func Get(h headers.Headers, name string) (*Cookie, error) {
+	for _, c := range FromHeaders(h) {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCookie
+}
+
+// Set adds c to h as its own set-cookie line.
+func Set(h headers.Headers, c *Cookie) error {
+	val, err := c.Format()
+	if err != nil {
+		return err
+	}
+	h.Add("set-cookie", val)
+	return nil
+}
+
+// Format serialises the cookie as a Set-Cookie value.
+func (c *Cookie) Format() (string, error) {
+
+	if !validName(c.Name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidName, c.Name)
+	}
+	if !validValue(c.Value) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidValue, c.Value)
+	}
+	if !validAttribute(c.Path) || !validAttribute(c.Domain) {
+		return "", ErrInvalidAttribute
+	}
+	if (c.SameSite == SameSiteNone || c.Partitioned) && !c.Secure {
+		return "", fmt.Errorf("%w: SameSite=None and Partitioned require Secure", ErrInvalidAttribute)
+	}
+
+	value := c.Value
+	if strings.ContainsAny(value, " ,") {
+		value = `"` + value + `"`
+	}
+
+	var b strings.Builder
+	b.WriteString(c.Name + "=" + value)
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(headers.TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+
+	return b.String(), nil
+}
+
+func validName(name string) bool {
+	return name != "" && headers.ValidateCharacters([]byte(name))
+}
+
+func parseValue(raw string) (string, bool) {
+	if len(raw) > 1 && raw[0] == '"' && raw[len(raw)-1] == '"' {
+		raw = raw[1 : len(raw)-1]
+	}
+	if !validValue(raw) {
+		return "", false
+	}
+	return raw, true
+}
+
+// validValue allows cookie-octets from RFC 6265, plus space and comma which
+// Format quotes, as browsers accept them.
+func validValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if b == ' ' || b == ',' {
+			continue
+		}
+		if b < 0x21 || b > 0x7e || b == '"' || b == ';' || b == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func validAttribute(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if b := value[i]; b < 0x20 || b == 0x7f || b == ';' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package cookie
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	cookies := Parse(`session=abc123; theme="dark"; bad name=x; empty=; =nope`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, "abc123", cookies[0].Value)
+	assert.Equal(t, "dark", cookies[1].Value)
+	assert.Equal(t, "empty", cookies[2].Name)
+	assert.Equal(t, "", cookies[2].Value)
+
+	// Test: duplicate cookie fields are joined with "; " by the parser
+	h := headers.NewHeaders()
+	_, _, err := h.Parse([]byte("Cookie: a=1\r\n"))
+	require.NoError(t, err)
+	_, _, err = h.Parse([]byte("Cookie: b=2\r\n"))
+	require.NoError(t, err)
+	c, err := Get(h, "b")
+	require.NoError(t, err)
+	assert.Equal(t, "2", c.Value)
+	_, err = Get(h, "c")
+	require.ErrorIs(t, err, ErrNoCookie)
+}
+
+func TestFormat(t *testing.T) {
+	c := &Cookie{
+		Name:        "id",
+		Value:       "a3fWa",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	val, err := c.Format()
+	require.NoError(t, err)
+	assert.Equal(t, "id=a3fWa; Path=/; Domain=example.com; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; HttpOnly; Secure; SameSite=None; Partitioned", val)
+
+	val, err = (&Cookie{Name: "gone", MaxAge: -1}).Format()
+	require.NoError(t, err)
+	assert.Equal(t, "gone=; Max-Age=0", val)
+
+	_, err = (&Cookie{Name: "x", Value: "y", SameSite: SameSiteNone}).Format()
+	require.ErrorIs(t, err, ErrInvalidAttribute)
+	_, err = (&Cookie{Name: "x y", Value: "z"}).Format()
+	require.ErrorIs(t, err, ErrInvalidName)
+	_, err = (&Cookie{Name: "x", Value: "a;b"}).Format()
+	require.ErrorIs(t, err, ErrInvalidValue)
+}
+
+func TestSet_SeparateLines(t *testing.T) {
+	h := response.GetDefaultHeaders(0, "text/plain")
+	require.NoError(t, Set(h, &Cookie{Name: "a", Value: "1"}))
+	require.NoError(t, Set(h, &Cookie{Name: "b", Value: "2", HttpOnly: true}))
+
+	buf := new(bytes.Buffer)
+	w := response.NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(response.Ok))
+	require.NoError(t, w.WriteHeaders(h))
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1", "b=2; HttpOnly"}, resp.Header.Values("Set-Cookie"))
+	require.Len(t, resp.Cookies(), 2)
+}
@@ -0,0 +1,257 @@
+// Package cors lets browsers call handlers from other origins, following
+// the Fetch standard's CORS protocol: preflight requests are answered
+// here, and actual requests get the headers that let the page read the
+// response.
+//
+// See https://fetch.spec.whatwg.org/#http-cors-protocol
+package cors
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+type Options struct {
+	// AllowedOrigins lists the origins allowed, e.g.
+	// "https://app.example.com". One "*" in an entry matches a run of
+	// host name characters, so "https://*.example.com" allows every
+	// subdomain. A lone "*" allows every origin.
+	AllowedOrigins []string
+	// AllowOriginFunc, if set, is asked about origins AllowedOrigins
+	// doesn't list.
+	AllowOriginFunc func(origin string) bool
+	// AllowedMethods are the methods preflights may ask for. Nil means
+	// GET, HEAD and POST.
+	AllowedMethods []string
+	// AllowedHeaders are the request headers preflights may ask for. "*"
+	// allows any.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers the page may read, beyond
+	// the CORS-safelisted ones.
+	ExposedHeaders []string
+	// AllowCredentials lets requests carry cookies and HTTP
+	// authentication. It can't be combined with a lone "*" in
+	// AllowedOrigins, which would let every site read every user's
+	// responses.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight result. Zero
+	// leaves it to the browser.
+	MaxAge time.Duration
+	// AllowPrivateNetwork answers preflights from public sites asking to
+	// reach this server on a private network.
+	//
+	// See https://wicg.github.io/private-network-access/
+	AllowPrivateNetwork bool
+}
+
+var defaultMethods = []string{"GET", "HEAD", "POST"}
+
+var ErrCredentialsAnyOrigin = fmt.Errorf("Error: cors: AllowCredentials with \"*\" in AllowedOrigins")
+
+// New returns a middleware that handles CORS for the handlers it wraps.
+// Preflight requests never reach them. New panics if opts allows
+// credentials from any origin.
+func New(opts Options) func(server.Handler) server.Handler {
+
+	c := newCors(opts)
+	return func(next server.Handler) server.Handler {
+		return func(w response.Writer, r *request.Request) {
+			origin, err := r.Headers.GetString("origin")
+			hasOrigin := err == nil
+
+			if hasOrigin && isPreflight(r) {
+				c.preflight(w, r, origin)
+				return
+			}
+
+			next(response.BeforeHeaders(w, func(h headers.Headers) {
+				if c.varies() {
+					h.AddVary("Origin")
+				}
+				if hasOrigin {
+					c.actual(h, origin)
+				}
+			}), r)
+		}
+	}
+}
+
+type cors struct {
+	opts      Options
+	anyOrigin bool
+	origins   map[string]bool
+	patterns  [][2]string
+	methods   []string
+	anyHeader bool
+	headers   []string
+}
+
+func newCors(opts Options) *cors {
+
+	c := &cors{opts: opts, origins: make(map[string]bool), methods: opts.AllowedMethods}
+	for _, o := range opts.AllowedOrigins {
+		o = strings.ToLower(o)
+		if o == "*" {
+			if opts.AllowCredentials {
+				panic(ErrCredentialsAnyOrigin)
+			}
+			c.anyOrigin = true
+			continue
+		}
+		prefix, suffix, ok := strings.Cut(o, "*")
+		if ok {
+			c.patterns = append(c.patterns, [2]string{prefix, suffix})
+		} else {
+			c.origins[o] = true
+		}
+	}
+	if c.methods == nil {
+		c.methods = defaultMethods
+	}
+	for _, h := range opts.AllowedHeaders {
+		if h == "*" {
+			c.anyHeader = true
+		}
+		c.headers = append(c.headers, strings.ToLower(h))
+	}
+	return c
+}
+
+// isPreflight reports whether r is a CORS preflight rather than an
+// ordinary OPTIONS request.
+func isPreflight(r *request.Request) bool {
+	_, err := r.Headers.GetString("access-control-request-method")
+	return r.RequestLine.Method == "OPTIONS" && err == nil
+}
+
+// varies reports whether responses depend on the Origin header. They
+// don't when every origin gets the same "*".
+func (c *cors) varies() bool {
+	return !c.anyOrigin
+}
+
+func (c *cors) allowed(origin string) bool {
+
+	if c.anyOrigin {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	if c.origins[lower] {
+		return true
+	}
+	for _, p := range c.patterns {
+		prefix, suffix := p[0], p[1]
+		if len(lower) > len(prefix)+len(suffix) && strings.HasPrefix(lower, prefix) && strings.HasSuffix(lower, suffix) &&
+			isHostRun(lower[len(prefix):len(lower)-len(suffix)]) {
+			return true
+		}
+	}
+	return c.opts.AllowOriginFunc != nil && c.opts.AllowOriginFunc(origin)
+}
+
+// allowOrigin sets the headers every allowed CORS response carries.
+func (c *cors) allowOrigin(h headers.Headers, origin string) {
+	if c.anyOrigin {
+		h.Set("access-control-allow-origin", "*")
+	} else {
+		h.Set("access-control-allow-origin", origin)
+	}
+	if c.opts.AllowCredentials {
+		h.Set("access-control-allow-credentials", "true")
+	}
+}
+
+func (c *cors) actual(h headers.Headers, origin string) {
+	if !c.allowed(origin) {
+		return
+	}
+	c.allowOrigin(h, origin)
+	if len(c.opts.ExposedHeaders) > 0 {
+		h.Set("access-control-expose-headers", strings.Join(c.opts.ExposedHeaders, ", "))
+	}
+}
+
+// preflight answers a preflight with a 204. Anything not allowed leaves
+// the CORS headers out, which the browser takes as a refusal.
+func (c *cors) preflight(w response.Writer, r *request.Request, origin string) {
+
+	h := headers.NewHeaders()
+	if c.varies() {
+		h.AddVary("Origin")
+	}
+	h.AddVary("Access-Control-Request-Method")
+	h.AddVary("Access-Control-Request-Headers")
+	if c.opts.AllowPrivateNetwork {
+		h.AddVary("Access-Control-Request-Private-Network")
+	}
+
+	grant := headers.NewHeaders()
+	if c.allowed(origin) && c.preflightAllowed(grant, r) {
+		for k, v := range grant {
+			h.Set(k, v)
+		}
+		c.allowOrigin(h, origin)
+		if c.opts.MaxAge > 0 {
+			h.Set("access-control-max-age", strconv.Itoa(int(c.opts.MaxAge.Seconds())))
+		}
+	}
+
+	w.WriteStatusLine(response.NoContent)
+	w.WriteHeaders(h)
+}
+
+// preflightAllowed checks the method, headers and network access the
+// preflight asks for, and sets the headers that grant them on h.
+func (c *cors) preflightAllowed(h headers.Headers, r *request.Request) bool {
+
+	method, _ := r.Headers.GetString("access-control-request-method")
+	if !slices.Contains(c.methods, method) {
+		return false
+	}
+	h.Set("access-control-allow-methods", method)
+
+	requested, _ := r.Headers.GetString("access-control-request-headers")
+	var names []string
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !c.anyHeader && !slices.Contains(c.headers, name) {
+			return false
+		}
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		h.Set("access-control-allow-headers", strings.Join(names, ", "))
+	}
+
+	if pna, _ := r.Headers.GetString("access-control-request-private-network"); pna == "true" {
+		if !c.opts.AllowPrivateNetwork {
+			return false
+		}
+		h.Set("access-control-allow-private-network", "true")
+	}
+	return true
+}
+
+// isHostRun reports whether s could stand in for the "*" of an origin
+// pattern: host name labels, not a port, path or anything to fool a naive
+// match such as "evil.com/".
+func isHostRun(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package cors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func ok(w response.Writer, r *request.Request) {
+	h := response.GetDefaultHeaders(2, "text/plain")
+	h.Set("vary", "Accept-Encoding")
+	w.WriteStatusLine(response.Ok)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("ok"))
+}
+
+func preflight(origin, method, headers string) *servertest.RequestBuilder {
+	b := servertest.NewRequest("OPTIONS", "/api").Header("Origin", origin).Header("Access-Control-Request-Method", method)
+	if headers != "" {
+		b.Header("Access-Control-Request-Headers", headers)
+	}
+	return b
+}
+
+func TestActualRequests(t *testing.T) {
+	opts := Options{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"},
+		ExposedHeaders: []string{"X-Request-Id"},
+	}
+
+	rec := servertest.Do(New(opts)(ok), servertest.NewRequest("GET", "/").Header("Origin", "https://app.example.com"))
+	assert.Equal(t, "ok", rec.Body.String())
+	assert.Equal(t, "https://app.example.com", rec.Header("Access-Control-Allow-Origin"))
+	assert.Equal(t, "X-Request-Id", rec.Header("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Accept-Encoding, Origin", rec.Header("Vary"))
+	assert.Empty(t, rec.Header("Access-Control-Allow-Credentials"))
+
+	// Test: patterns
+	rec = servertest.Do(New(opts)(ok), servertest.NewRequest("GET", "/").Header("Origin", "https://a.b.EXAMPLE.org"))
+	assert.Equal(t, "https://a.b.EXAMPLE.org", rec.Header("Access-Control-Allow-Origin"))
+	for _, origin := range []string{"https://example.org", "https://evil.com/.example.org", "http://a.example.org", "https://a.example.org.evil.com", "null"} {
+		rec = servertest.Do(New(opts)(ok), servertest.NewRequest("GET", "/").Header("Origin", origin))
+		assert.Empty(t, rec.Header("Access-Control-Allow-Origin"), origin)
+		assert.Equal(t, "ok", rec.Body.String())
+	}
+
+	// Test: same-origin requests still vary on Origin, for caches
+	rec = servertest.Do(New(opts)(ok), servertest.NewRequest("GET", "/"))
+	assert.Empty(t, rec.Header("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Accept-Encoding, Origin", rec.Header("Vary"))
+
+	// Test: a wildcard without credentials is the same for everyone
+	rec = servertest.Do(New(Options{AllowedOrigins: []string{"*"}})(ok), servertest.NewRequest("GET", "/").Header("Origin", "https://any.site"))
+	assert.Equal(t, "*", rec.Header("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Accept-Encoding", rec.Header("Vary"))
+
+	// Test: credentials from any origin are refused outright
+	assert.PanicsWithValue(t, ErrCredentialsAnyOrigin, func() {
+		New(Options{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	})
+
+	// Test: AllowOriginFunc
+	opts.AllowOriginFunc = func(origin string) bool { return origin == "https://partner.net" }
+	rec = servertest.Do(New(opts)(ok), servertest.NewRequest("GET", "/").Header("Origin", "https://partner.net"))
+	assert.Equal(t, "https://partner.net", rec.Header("Access-Control-Allow-Origin"))
+}
+
+func TestPreflight(t *testing.T) {
+	opts := Options{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowedMethods:   []string{"GET", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	rec := servertest.Do(New(opts)(ok), preflight("https://app.example.com", "PUT", "content-type, Authorization"))
+	assert.Equal(t, response.NoContent, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	// RFC 9110, section 8.6: no Content-Length on a 204
+	assert.Empty(t, rec.Header("Content-Length"))
+	assert.Equal(t, "https://app.example.com", rec.Header("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "PUT", rec.Header("Access-Control-Allow-Methods"))
+	assert.Equal(t, "content-type, authorization", rec.Header("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", rec.Header("Access-Control-Max-Age"))
+	assert.Equal(t, "Origin, Access-Control-Request-Method, Access-Control-Request-Headers", rec.Header("Vary"))
+
+	refused := []*servertest.RequestBuilder{
+		preflight("https://evil.com", "PUT", ""),
+		preflight("https://app.example.com", "PATCH", ""),
+		preflight("https://app.example.com", "PUT", "x-custom"),
+		preflight("https://app.example.com", "GET", "").Header("Access-Control-Request-Private-Network", "true"),
+	}
+	for _, b := range refused {
+		rec = servertest.Do(New(opts)(ok), b)
+		assert.Equal(t, response.NoContent, rec.Code)
+		assert.Empty(t, rec.Header("Access-Control-Allow-Origin"))
+		assert.Empty(t, rec.Header("Access-Control-Allow-Methods"))
+	}
+
+	// Test: plain OPTIONS requests reach the handler
+	rec = servertest.Do(New(opts)(ok), servertest.NewRequest("OPTIONS", "/").Header("Origin", "https://app.example.com"))
+	assert.Equal(t, "ok", rec.Body.String())
+
+	// Test: any header
+	opts.AllowedHeaders = []string{"*"}
+	rec = servertest.Do(New(opts)(ok), preflight("https://app.example.com", "PUT", "x-custom"))
+	assert.Equal(t, "x-custom", rec.Header("Access-Control-Allow-Headers"))
+
+	// Test: private network access
+	opts.AllowPrivateNetwork = true
+	rec = servertest.Do(New(opts)(ok), preflight("https://app.example.com", "GET", "").Header("Access-Control-Request-Private-Network", "true"))
+	assert.Equal(t, "true", rec.Header("Access-Control-Allow-Private-Network"))
+	assert.Contains(t, rec.Header("Vary"), "Access-Control-Request-Private-Network")
+}
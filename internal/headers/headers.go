@@ -11,10 +11,25 @@ import (
 
 const crlf = "\r\n"
 
+// lineSeparator splits values that must go out as separate field lines. A
+// field value can never contain a bare LF, so it can't clash with real data.
+const lineSeparator = "\n"
+
+// TimeFormat is the IMF-fixdate layout used by Date, Expires and friends.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
 var SpecialCharacters = []string{"!", "#", "$", "%", "&", "'", "*", "+", "-", ".", "^", "_", "`", "|", "~"}
 var ErrKeyNotFound = fmt.Errorf("Error: key not found in header")
 var ErrConversionFailed = fmt.Errorf("Error: converting failed")
 
+// Errors for field lines that other parsers could read differently, kept
+// distinct so rejected requests can be told apart in the logs.
+var ErrBareLF = fmt.Errorf("Error: line ends in a bare LF")
+var ErrBareCR = fmt.Errorf("Error: bare CR outside a line ending")
+var ErrObsFold = fmt.Errorf("Error: obsolete line folding is not allowed")
+var ErrSpaceBeforeColon = fmt.Errorf("Error: whitespace between field name and colon")
+var ErrInvalidFieldValue = fmt.Errorf("Error: header value contains a control character")
+
 type Headers map[string]string
 
 func NewHeaders() Headers {
@@ -44,46 +59,181 @@ func (h Headers) Get(key string) (int, error) {
 	return intVal, nil
 }
 
+// Add appends val to any existing value for key. Repeated fields are joined
+// with ", ", except cookie which uses "; ", and set-cookie, which can't be
+// combined at all and keeps one value per line (see Values).
+func (h Headers) Add(key, val string) {
+
+	key = strings.ToLower(key)
+	v, ok := h[key]
+	if !ok {
+		h[key] = val
+		return
+	}
+	h[key] = v + separator(key) + val
+}
+
+// AddAll adds vals to key as if by Add one at a time, but joins them in one
+// go, for callers adding many lines of the same field.
+func (h Headers) AddAll(key string, vals []string) {
+
+	key = strings.ToLower(key)
+	if v, ok := h[key]; ok {
+		vals = append([]string{v}, vals...)
+	}
+	h[key] = strings.Join(vals, separator(key))
+}
+
+// separator is what joins the lines of field key into one value.
+func separator(key string) string {
+	switch key {
+	case "set-cookie":
+		return lineSeparator
+	case "cookie":
+		return "; "
+	default:
+		return ", "
+	}
+}
+
+// Values returns the separate lines stored for key, which is only ever more
+// than one for set-cookie.
+func (h Headers) Values(key string) []string {
+
+	val, ok := h[strings.ToLower(key)]
+	if !ok {
+		return nil
+	}
+
+	return strings.Split(val, lineSeparator)
+}
+
+// GetString returns the raw value stored for key, looked up case-insensitively.
+func (h Headers) GetString(key string) (string, error) {
+
+	val, ok := h[strings.ToLower(key)]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+
+	return val, nil
+}
+
+// HasToken reports whether the comma-separated list in key, such as
+// Connection or Transfer-Encoding, contains token, ignoring case.
+func (h Headers) HasToken(key, token string) bool {
+
+	val, err := h.GetString(key)
+	if err != nil {
+		return false
+	}
+	for _, v := range strings.Split(val, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddVary adds field to the vary header, unless it is listed already or
+// the response varies on everything ("*").
+func (h Headers) AddVary(field string) {
+
+	vary, err := h.GetString("vary")
+	if err != nil || strings.TrimSpace(vary) == "" {
+		h.Set("vary", field)
+		return
+	}
+
+	for _, v := range strings.Split(vary, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.EqualFold(v, field) {
+			return
+		}
+	}
+	h.Set("vary", vary+", "+field)
+}
+
+// SplitQuoted cuts s at sep, except inside quoted strings, as in the
+// list element private="set-cookie, authorization".
+func SplitQuoted(s string, sep byte) []string {
+
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Parse reads one field line from data. Anything RFC 9112 leaves open to
+// interpretation, where two parsers could disagree on where a field or the
+// message ends, is rejected rather than guessed at: bare CR or LF, obs-fold
+// continuation lines, whitespace before the colon and control characters in
+// the value.
 func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 
-	idx := bytes.Index(data, []byte(crlf))
+	idx := bytes.IndexByte(data, '\n')
 	if idx == -1 {
 		return 0, false, nil
 	}
+	if idx == 0 || data[idx-1] != '\r' {
+		return 0, false, ErrBareLF
+	}
 
-	if idx == 0 {
+	line := data[:idx-1]
+	if len(line) == 0 {
 		return len(crlf), true, nil
 	}
-
-	cleanedHeader := bytes.Trim(data[:idx], " ")
-	splitHeader := bytes.Split(cleanedHeader, []byte(": "))
-	if len(splitHeader) != 2 {
-		return 0, false, fmt.Errorf("Length of split header is not 2")
+	if bytes.IndexByte(line, '\r') != -1 {
+		return 0, false, ErrBareCR
 	}
 
-	if ok := bytes.ContainsRune(splitHeader[0], ' '); ok {
-		return 0, false, fmt.Errorf("First part contains spaces")
+	// a line starting with whitespace after another field is an obs-fold
+	// continuation of that field
+	if len(h) > 0 && (line[0] == ' ' || line[0] == '\t') {
+		return 0, false, ErrObsFold
 	}
 
-	cleanSplitValue := bytes.Trim(splitHeader[1], " ")
+	cleanedHeader := bytes.Trim(line, " \t")
+	colon := bytes.IndexByte(cleanedHeader, ':')
+	if colon == -1 {
+		return 0, false, fmt.Errorf("Header line has no colon")
+	}
+	name := cleanedHeader[:colon]
 
-	if ok := ValidateCharacters(splitHeader[0]); !ok {
-		return 0, false, fmt.Errorf("Contains invalid character")
+	if len(name) > 0 && (name[len(name)-1] == ' ' || name[len(name)-1] == '\t') {
+		return 0, false, ErrSpaceBeforeColon
+	}
+	if ok := bytes.ContainsAny(name, " \t"); ok {
+		return 0, false, fmt.Errorf("First part contains spaces")
 	}
 
-	if len(splitHeader[0]) <= 0 {
+	if len(name) <= 0 {
 		return 0, false, fmt.Errorf("length is not at least one")
 	}
 
-	key := bytes.ToLower(splitHeader[0])
+	if ok := ValidateCharacters(name); !ok {
+		return 0, false, fmt.Errorf("Contains invalid character")
+	}
 
-	if v, ok := h[string(key)]; ok {
-		h[string(key)] = fmt.Sprintf("%s, %s", v, string(cleanSplitValue))
-	} else {
-		h[string(key)] = string(cleanSplitValue)
+	value := bytes.Trim(cleanedHeader[colon+1:], " \t")
+	if ok := ValidateValue(value); !ok {
+		return 0, false, ErrInvalidFieldValue
 	}
 
-	return idx + len(crlf), false, nil
+	key := bytes.ToLower(name)
+	h.Add(string(key), string(value))
+
+	return idx + 1, false, nil
 }
 
 func ValidateCharacters(data []byte) bool {
@@ -100,5 +250,19 @@ func isSpecial(b byte) bool {
 }
 
 func ValidateChar(b byte) bool {
+	if b >= 0x80 {
+		return false
+	}
 	return unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b)) || isSpecial(b)
 }
+
+// ValidateValue allows visible characters, spaces and tabs, and obs-text:
+// no CR, LF, NUL or other control characters.
+func ValidateValue(data []byte) bool {
+	for _, b := range data {
+		if (b < 0x20 && b != '\t') || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
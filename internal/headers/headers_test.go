@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -86,9 +87,10 @@ func TestParse_ValidSingleHeaderExtraWhitespace(t *testing.T) {
 func TestParse_ValidHeader_NoSpaceAfterColon(t *testing.T) {
 	h := NewHeaders()
 	n, done, err := h.Parse([]byte("Host:localhost\r\n"))
-	require.Error(t, err)
+	require.NoError(t, err)
 	assert.False(t, done)
-	assert.Equal(t, 0, n)
+	assert.Equal(t, "localhost", h["host"])
+	assert.Equal(t, 16, n)
 }
 
 func TestParse_InvalidSpaceBeforeColon(t *testing.T) {
@@ -163,9 +165,10 @@ func TestParse_TrimValueManySpaces(t *testing.T) {
 func TestParse_EmptyValueAllowed(t *testing.T) {
 	h := NewHeaders()
 	n, done, err := h.Parse([]byte("X-Flag:\r\n"))
-	require.Error(t, err)
+	require.NoError(t, err)
 	assert.False(t, done)
-	assert.Equal(t, 0, n)
+	assert.Equal(t, "", h["x-flag"])
+	assert.Equal(t, 9, n)
 }
 
 func TestParse_FieldNameTrimOuterButNoInnerSpaces(t *testing.T) {
@@ -184,3 +187,98 @@ func TestParse_InvalidCharacter(t *testing.T) {
 	assert.False(t, done)
 	assert.Equal(t, 0, n)
 }
+
+func TestAdd_SetCookieKeepsLines(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Set-Cookie", "b=2, with comma")
+	assert.Equal(t, []string{"a=1", "b=2, with comma"}, h.Values("set-cookie"))
+
+	h.Add("Accept", "a")
+	h.Add("Accept", "b")
+	assert.Equal(t, "a, b", h["accept"])
+	assert.Equal(t, []string{"a, b"}, h.Values("accept"))
+
+	// Test: AddAll joins like repeated Adds
+	h.AddAll("Accept", []string{"c", "d"})
+	assert.Equal(t, "a, b, c, d", h["accept"])
+	h.AddAll("cookie", []string{"x=1", "y=2"})
+	assert.Equal(t, "x=1; y=2", h["cookie"])
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("Host: localhost:42069\r\n"))
+	f.Add([]byte("\r\n"))
+	f.Add([]byte("Host:localhost\r\n\r\n"))
+	f.Add([]byte("X: a\r\n b\r\n"))
+	f.Add([]byte("X: a\rb\r\n"))
+	f.Add([]byte("Host : x\r\n"))
+	f.Add([]byte("X\x00: y\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := NewHeaders()
+		n, done, err := h.Parse(data)
+		if err != nil {
+			assert.Equal(t, 0, n)
+			assert.False(t, done)
+			return
+		}
+		if n == 0 {
+			// waiting for the rest of the line
+			assert.NotContains(t, string(data), "\n")
+			return
+		}
+
+		require.LessOrEqual(t, n, len(data))
+		assert.Equal(t, "\r\n", string(data[n-2:n]))
+		if done {
+			assert.Equal(t, 2, n)
+			assert.Empty(t, h)
+			return
+		}
+
+		require.Len(t, h, 1)
+		for k, v := range h {
+			assert.NotEmpty(t, k)
+			assert.Equal(t, strings.ToLower(k), k)
+			assert.True(t, ValidateCharacters([]byte(k)))
+			assert.True(t, ValidateValue([]byte(v)), "value %q", v)
+			assert.Equal(t, strings.Trim(v, " \t"), v)
+		}
+	})
+}
+
+func TestAddVary(t *testing.T) {
+	h := NewHeaders()
+	h.AddVary("Origin")
+	h.AddVary("Accept-Encoding")
+	h.AddVary("origin")
+	assert.Equal(t, "Origin, Accept-Encoding", h["vary"])
+
+	// Test: "*" already covers everything
+	h.Set("vary", "*")
+	h.AddVary("Origin")
+	assert.Equal(t, "*", h["vary"])
+}
+
+func TestHasToken(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Connection", "keep-alive, Upgrade")
+	assert.True(t, h.HasToken("connection", "upgrade"))
+	assert.True(t, h.HasToken("Connection", "KEEP-ALIVE"))
+	assert.False(t, h.HasToken("connection", "close"))
+	assert.False(t, h.HasToken("upgrade", "websocket"))
+
+	// Test: tokens are whole list elements
+	h.Add("Transfer-Encoding", "gzip-chunked")
+	assert.False(t, h.HasToken("transfer-encoding", "chunked"))
+}
+
+func TestSplitQuoted(t *testing.T) {
+	assert.Equal(t, []string{"no-cache", ` private="set-cookie, authorization"`}, SplitQuoted(`no-cache, private="set-cookie, authorization"`, ','))
+	assert.Equal(t, []string{"text/html", ` q="0;5"`}, SplitQuoted(`text/html; q="0;5"`, ';'))
+
+	// Test: escaped quotes don't end the string
+	assert.Equal(t, []string{`a="x\",y"`, "b"}, SplitQuoted(`a="x\",y",b`, ','))
+	assert.Equal(t, []string{""}, SplitQuoted("", ','))
+}
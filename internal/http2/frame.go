@@ -0,0 +1,214 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeHTTP11Required     ErrCode = 0xd
+	ErrCodeInadequateSecurity ErrCode = 0xc
+)
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+const frameHeaderLen = 9
+
+// Preface is what a client sends first on an HTTP/2 connection.
+const Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	defaultMaxFrameSize   = 16384
+	maxAllowedFrameSize   = 1<<24 - 1
+	defaultWindowSize     = 65535
+	maxWindowSize         = 1<<31 - 1
+	defaultHeaderTableLen = 4096
+)
+
+// ConnectionError ends the whole connection with a GOAWAY.
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("http2 connection error %#x: %s", uint32(e.Code), e.Reason)
+}
+
+// StreamError resets a single stream with RST_STREAM.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2 stream %d error %#x: %s", e.StreamID, uint32(e.Code), e.Reason)
+}
+
+// Frame is a raw frame: the fixed header plus its payload.
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+func (f *Frame) Has(flag Flags) bool {
+	return f.Flags&flag != 0
+}
+
+// ReadFrame reads one frame, refusing payloads bigger than maxFrameSize.
+func ReadFrame(r io.Reader, maxFrameSize uint32) (*Frame, error) {
+
+	var head [frameHeaderLen]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := &Frame{
+		Type:     FrameType(head[3]),
+		Flags:    Flags(head[4]),
+		StreamID: binary.BigEndian.Uint32(head[5:]) & 0x7fffffff,
+	}
+	if length > maxFrameSize {
+		return nil, ConnectionError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes over the limit", length)}
+	}
+
+	f.Payload = make([]byte, length)
+	_, err = io.ReadFull(r, f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFrame writes a frame header and payload in one call.
+func WriteFrame(w io.Writer, f *Frame) error {
+
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(f.Payload))
+	length := len(f.Payload)
+	buf[0] = byte(length >> 16)
+	buf[1] = byte(length >> 8)
+	buf[2] = byte(length)
+	buf[3] = byte(f.Type)
+	buf[4] = byte(f.Flags)
+	binary.BigEndian.PutUint32(buf[5:], f.StreamID&0x7fffffff)
+	buf = append(buf, f.Payload...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// stripPadding removes the pad length byte and trailing padding from DATA
+// and HEADERS payloads.
+func stripPadding(f *Frame) ([]byte, error) {
+
+	if !f.Has(FlagPadded) {
+		return f.Payload, nil
+	}
+	if len(f.Payload) == 0 {
+		return nil, ConnectionError{ErrCodeProtocol, "padded frame without pad length"}
+	}
+	padLen := int(f.Payload[0])
+	if padLen >= len(f.Payload) {
+		return nil, ConnectionError{ErrCodeProtocol, "padding longer than payload"}
+	}
+	return f.Payload[1 : len(f.Payload)-padLen], nil
+}
+
+type setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+func parseSettings(payload []byte) ([]setting, error) {
+
+	if len(payload)%6 != 0 {
+		return nil, ConnectionError{ErrCodeFrameSize, "settings payload is not a multiple of 6"}
+	}
+
+	settings := make([]setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		s := setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		}
+		switch s.ID {
+		case SettingEnablePush:
+			if s.Value > 1 {
+				return nil, ConnectionError{ErrCodeProtocol, "ENABLE_PUSH must be 0 or 1"}
+			}
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return nil, ConnectionError{ErrCodeFlowControl, "INITIAL_WINDOW_SIZE too large"}
+			}
+		case SettingMaxFrameSize:
+			if s.Value < defaultMaxFrameSize || s.Value > maxAllowedFrameSize {
+				return nil, ConnectionError{ErrCodeProtocol, "MAX_FRAME_SIZE out of range"}
+			}
+		}
+		settings = append(settings, s)
+	}
+
+	return settings, nil
+}
+
+func settingsPayload(settings []setting) []byte {
+	payload := make([]byte, 0, len(settings)*6)
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+	return payload
+}
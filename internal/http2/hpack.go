@@ -0,0 +1,431 @@
+package http2
+
+import (
+	"fmt"
+)
+
+var ErrCompression = fmt.Errorf("Error: hpack decoding failed")
+
+// ErrHeaderListTooLarge is returned by Decode for a block whose fields go
+// over the limits set with SetMaxHeaderList. The block decodes fine; the
+// peer is just sending more than it was told it may.
+var ErrHeaderListTooLarge = fmt.Errorf("Error: header list too large")
+
+// HeaderField is a single decoded header, in the order it arrived.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// entryOverhead is the per-entry size overhead from RFC 7541 section 4.1.
+const entryOverhead = 32
+
+// staticTable is RFC 7541 Appendix A. Index 1 is staticTable[0].
+var staticTable = []HeaderField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// Decoder turns header blocks back into fields. It keeps the dynamic table
+// between blocks, so one Decoder belongs to one connection.
+type Decoder struct {
+	dynamic []HeaderField // newest first
+	size    int
+	maxSize int
+	// allowedMaxSize is the limit we advertised in SETTINGS; the peer may
+	// only shrink the table below it.
+	allowedMaxSize int
+	// maxStringLength bounds any single name or value.
+	maxStringLength int
+	// maxListSize and maxFields bound a whole block, zero meaning no
+	// limit.
+	maxListSize int
+	maxFields   int
+}
+
+func NewDecoder(maxTableSize, maxStringLength int) *Decoder {
+	return &Decoder{
+		maxSize:         maxTableSize,
+		allowedMaxSize:  maxTableSize,
+		maxStringLength: maxStringLength,
+	}
+}
+
+// SetMaxHeaderList bounds the blocks Decode accepts: size is the largest
+// header list size (RFC 9113, section 6.5.2), the lengths of every name and
+// value plus 32 per field, and fields the most fields. Zero means no limit.
+func (d *Decoder) SetMaxHeaderList(size, fields int) {
+	d.maxListSize = size
+	d.maxFields = fields
+}
+
+// Decode decodes a complete header block.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+
+	var fields []HeaderField
+	listSize := 0
+	first := true
+	for len(block) > 0 {
+		b := block[0]
+		var f HeaderField
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// indexed field
+			var idx uint64
+			idx, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err = d.at(idx)
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			f, block, err = d.readLiteral(block, 6)
+			if err == nil {
+				d.add(f)
+			}
+		case b&0xe0 == 0x20:
+			// dynamic table size update, only allowed at the start of a block
+			if !first {
+				return nil, fmt.Errorf("%w: table size update after a field", ErrCompression)
+			}
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("%w: table size %d over the limit", ErrCompression, size)
+			}
+			d.maxSize = int(size)
+			d.evict()
+			continue
+		default:
+			// literal without indexing (0000) or never indexed (0001)
+			f, block, err = d.readLiteral(block, 4)
+		}
+		if err != nil {
+			return nil, err
+		}
+		first = false
+		fields = append(fields, f)
+
+		listSize += len(f.Name) + len(f.Value) + 32
+		if d.maxListSize > 0 && listSize > d.maxListSize {
+			return nil, fmt.Errorf("%w: over %d bytes", ErrHeaderListTooLarge, d.maxListSize)
+		}
+		if d.maxFields > 0 && len(fields) > d.maxFields {
+			return nil, fmt.Errorf("%w: over %d fields", ErrHeaderListTooLarge, d.maxFields)
+		}
+	}
+
+	return fields, nil
+}
+
+func (d *Decoder) at(idx uint64) (HeaderField, error) {
+	switch {
+	case idx == 0:
+		return HeaderField{}, fmt.Errorf("%w: index 0", ErrCompression)
+	case idx <= uint64(len(staticTable)):
+		return staticTable[idx-1], nil
+	case idx-uint64(len(staticTable)) <= uint64(len(d.dynamic)):
+		return d.dynamic[idx-uint64(len(staticTable))-1], nil
+	default:
+		return HeaderField{}, fmt.Errorf("%w: index %d out of range", ErrCompression, idx)
+	}
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+
+	idx, rest, err := readInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+
+	var f HeaderField
+	if idx > 0 {
+		named, err := d.at(idx)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		f.Name = named.Name
+	} else {
+		f.Name, rest, err = d.readString(rest)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	}
+
+	f.Value, rest, err = d.readString(rest)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return f, rest, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+
+	if len(block) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrCompression)
+	}
+	huffman := block[0]&0x80 != 0
+	length, rest, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(rest)) {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrCompression)
+	}
+	raw := rest[:length]
+	rest = rest[length:]
+
+	if !huffman {
+		if len(raw) > d.maxStringLength {
+			return "", nil, fmt.Errorf("%w: string too long", ErrCompression)
+		}
+		return string(raw), rest, nil
+	}
+
+	s, err := huffmanDecode(raw, d.maxStringLength)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, rest, nil
+}
+
+func (d *Decoder) add(f HeaderField) {
+	d.dynamic = append([]HeaderField{f}, d.dynamic...)
+	d.size += len(f.Name) + len(f.Value) + entryOverhead
+	d.evict()
+}
+
+func (d *Decoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.size -= len(last.Name) + len(last.Value) + entryOverhead
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+	}
+}
+
+// Encoder writes header blocks. It never adds to the dynamic table, so the
+// peer's table never needs anything from us; names found in the static
+// table are sent by index and values as plain literals.
+type Encoder struct{}
+
+// Encode appends the encoded fields to dst.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+
+	for _, f := range fields {
+		if idx, ok := staticIndex(f); ok {
+			dst = appendInt(dst, 7, 0x80, uint64(idx))
+			continue
+		}
+
+		nameIdx, _ := staticNameIndex(f.Name)
+		// literal without indexing, or never indexed for credentials
+		first := byte(0x00)
+		if f.Name == "authorization" || f.Name == "set-cookie" {
+			first = 0x10
+		}
+		dst = appendInt(dst, 4, first, uint64(nameIdx))
+		if nameIdx == 0 {
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendString(dst, f.Value)
+	}
+
+	return dst
+}
+
+func staticIndex(f HeaderField) (int, bool) {
+	for i, s := range staticTable {
+		if s == f {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+func staticNameIndex(name string) (int, bool) {
+	for i, s := range staticTable {
+		if s.Name == name {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendInt(dst, 7, 0x00, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// appendInt encodes i with an n-bit prefix, RFC 7541 section 5.1. first
+// carries the flag bits above the prefix.
+func appendInt(dst []byte, n uint8, first byte, i uint64) []byte {
+
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, first|byte(i))
+	}
+
+	dst = append(dst, first|byte(max))
+	i -= max
+	for i >= 128 {
+		dst = append(dst, byte(i&0x7f)|0x80)
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
+
+func readInt(block []byte, n uint8) (uint64, []byte, error) {
+
+	if len(block) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrCompression)
+	}
+	max := uint64(1)<<n - 1
+	i := uint64(block[0]) & max
+	block = block[1:]
+	if i < max {
+		return i, block, nil
+	}
+
+	var shift uint
+	for len(block) > 0 {
+		b := block[0]
+		block = block[1:]
+		i += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return i, block, nil
+		}
+		shift += 7
+		if shift > 56 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrCompression)
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: truncated integer", ErrCompression)
+}
+
+type huffmanNode struct {
+	children *[2]*huffmanNode
+	sym      int
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{sym: -1}
+	for sym, entry := range huffmanTable {
+		node := root
+		for bit := int(entry.bits) - 1; bit >= 0; bit-- {
+			if node.children == nil {
+				node.children = &[2]*huffmanNode{}
+			}
+			b := (entry.code >> uint(bit)) & 1
+			if node.children[b] == nil {
+				node.children[b] = &huffmanNode{sym: -1}
+			}
+			node = node.children[b]
+		}
+		node.sym = sym
+	}
+	return root
+}
+
+func huffmanDecode(raw []byte, maxLength int) (string, error) {
+
+	out := make([]byte, 0, len(raw)*8/5)
+	node := huffmanRoot
+	// padding must be the most significant bits of EOS, all ones, and
+	// shorter than 8 bits
+	padBits := 0
+	allOnes := true
+	for _, b := range raw {
+		for bit := 7; bit >= 0; bit-- {
+			v := (b >> uint(bit)) & 1
+			node = node.children[v]
+			if node == nil {
+				return "", fmt.Errorf("%w: invalid huffman code", ErrCompression)
+			}
+			padBits++
+			allOnes = allOnes && v == 1
+			if node.sym < 0 {
+				continue
+			}
+			if node.sym == 256 {
+				return "", fmt.Errorf("%w: EOS in huffman string", ErrCompression)
+			}
+			out = append(out, byte(node.sym))
+			if len(out) > maxLength {
+				return "", fmt.Errorf("%w: string too long", ErrCompression)
+			}
+			node = huffmanRoot
+			padBits = 0
+			allOnes = true
+		}
+	}
+	if padBits > 7 || !allOnes {
+		return "", fmt.Errorf("%w: invalid huffman padding", ErrCompression)
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,479 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecoder_RFCExamples(t *testing.T) {
+	// RFC 7541 C.4: requests with Huffman coding sharing one dynamic table
+	d := NewDecoder(4096, 1024)
+	blocks := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	want := [][]HeaderField{
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}},
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}, {"cache-control", "no-cache"}},
+		{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"}, {"custom-key", "custom-value"}},
+	}
+	for i, block := range blocks {
+		raw := make([]byte, len(block)/2)
+		_, err := fmt.Sscanf(block, "%x", &raw)
+		require.NoError(t, err)
+		fields, err := d.Decode(raw)
+		require.NoError(t, err)
+		assert.Equal(t, want[i], fields)
+	}
+	assert.Equal(t, 164, d.size)
+
+	// Test: index past the end of both tables
+	_, err := d.Decode([]byte{0xff, 0x00})
+	require.ErrorIs(t, err, ErrCompression)
+}
+
+func TestDecoder_HeaderListLimits(t *testing.T) {
+	fields := []HeaderField{{"a", "1"}, {"b", "2"}, {"c", "3"}}
+	block := (&Encoder{}).Encode(nil, fields)
+
+	d := NewDecoder(4096, 1024)
+	d.SetMaxHeaderList(3*34, 0)
+	got, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, got)
+
+	// Test: one byte over the list size
+	d.SetMaxHeaderList(3*34-1, 0)
+	_, err = d.Decode(block)
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+
+	// Test: too many fields
+	d.SetMaxHeaderList(0, 2)
+	_, err = d.Decode(block)
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+}
+
+func TestEncoder_RoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{":status", "200"},
+		{"content-type", "text/plain"},
+		{"x-custom", strings.Repeat("v", 300)},
+		{"set-cookie", "a=1"},
+	}
+	block := (&Encoder{}).Encode(nil, fields)
+	got, err := NewDecoder(4096, 1024).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, got)
+}
+
+func h2Handler(w response.Writer, r *request.Request) {
+	body := []byte(fmt.Sprintf("%s %s %s %d", r.RequestLine.HttpVersion, r.RequestLine.Method, r.RequestLine.RequestTarget, len(r.Body)))
+	if r.RequestLine.RequestTarget == "/big" {
+		body = []byte(strings.Repeat("b", 200000))
+	}
+	w.WriteStatusLine(response.Ok)
+	h := response.GetDefaultHeaders(len(body), "text/plain")
+	h.Add("set-cookie", "a=1")
+	h.Add("set-cookie", "b=2")
+	w.WriteHeaders(h)
+	if r.RequestLine.RequestTarget == "/abort" {
+		w.WriteBody(body[:3])
+		panic(response.ErrAbortHandler)
+	}
+	if r.RequestLine.RequestTarget == "/panic" {
+		panic("boom")
+	}
+	w.WriteBody(body)
+}
+
+func TestRequestFromFields_Validation(t *testing.T) {
+	pseudo := []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}}
+
+	req, err := requestFromFields(1, append(pseudo, HeaderField{"accept", "a"}, HeaderField{"accept", "b"}))
+	require.NoError(t, err)
+	assert.Equal(t, "a, b", req.Headers["accept"])
+
+	for _, f := range []HeaderField{
+		{"x-a", "one\r\ntwo"},
+		{"x-a", "one\ntwo"},
+		{"x-a", "nul\x00"},
+		{"x-a", " padded"},
+		{"X-Upper", "v"},
+		{"x a", "v"},
+		{"", "v"},
+	} {
+		_, err := requestFromFields(1, append(pseudo, f))
+		var se StreamError
+		require.ErrorAs(t, err, &se, "field %q: %q", f.Name, f.Value)
+		assert.Equal(t, ErrCodeProtocol, se.Code)
+	}
+}
+
+// startServer accepts connections the way server.Server does for HTTP/2,
+// which can't be imported here without a cycle.
+func startServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				br := bufio.NewReaderSize(conn, request.MaxLineSize)
+				if HasPreface(br) {
+					ServeConn(conn, br, h2Handler, Timeouts{})
+					return
+				}
+				req, err := request.RequestFromReader(br)
+				if err == nil && IsUpgrade(req) {
+					ServeUpgrade(conn, br, h2Handler, req, Timeouts{})
+				}
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestPriorKnowledge_GoClient(t *testing.T) {
+	addr := startServer(t)
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	defer client.CloseIdleConnections()
+
+	// Test: several concurrent streams on one connection
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(fmt.Sprintf("http://%s/item/%d", addr, i), "text/plain", strings.NewReader("payload"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, 2, resp.ProtoMajor)
+			assert.Equal(t, fmt.Sprintf("2 POST /item/%d 7", i), string(body))
+			assert.Equal(t, []string{"a=1", "b=2"}, resp.Header.Values("Set-Cookie"))
+		}()
+	}
+	wg.Wait()
+
+	// Test: a body bigger than the initial flow control window
+	resp, err := client.Get("http://" + addr + "/big")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, 200000, len(body))
+
+	// Test: an aborted handler resets its stream, and only its stream
+	resp, err = client.Get("http://" + addr + "/abort")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.ErrorContains(t, err, "INTERNAL_ERROR")
+
+	// Test: so does any other panic, without taking the process down
+	resp, err = client.Get("http://" + addr + "/panic")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.ErrorContains(t, err, "INTERNAL_ERROR")
+	resp, err = client.Get("http://" + addr + "/after")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestUpgrade_H2C(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	settings := base64.RawURLEncoding.EncodeToString(settingsPayload([]setting{{SettingInitialWindowSize, 1 << 20}}))
+	_, err = conn.Write([]byte("GET /upgraded HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\n" +
+		"HTTP2-Settings: " + settings + "\r\n\r\n"))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	_, err = conn.Write([]byte(Preface))
+	require.NoError(t, err)
+	require.NoError(t, WriteFrame(conn, &Frame{Type: FrameSettings}))
+
+	dec := NewDecoder(4096, 1<<20)
+	var status string
+	var body []byte
+	for {
+		f, err := ReadFrame(br, 1<<20)
+		require.NoError(t, err)
+		if f.Type == FrameHeaders && f.StreamID == 1 {
+			fields, err := dec.Decode(f.Payload)
+			require.NoError(t, err)
+			status = fields[0].Value
+		}
+		if f.Type == FrameData && f.StreamID == 1 {
+			body = append(body, f.Payload...)
+			if f.Has(FlagEndStream) {
+				break
+			}
+		}
+	}
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "2 GET /upgraded 0", string(body))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	addr := startServer(t)
+
+	goAwayCode := func(frames ...*Frame) ErrCode {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(Preface))
+		require.NoError(t, err)
+		for _, f := range frames {
+			require.NoError(t, WriteFrame(conn, f))
+		}
+		br := bufio.NewReader(conn)
+		for {
+			f, err := ReadFrame(br, 1<<20)
+			require.NoError(t, err)
+			if f.Type == FrameGoAway {
+				return ErrCode(binary.BigEndian.Uint32(f.Payload[4:]))
+			}
+		}
+	}
+
+	header := (&Encoder{}).Encode(nil, []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}})
+
+	assert.Equal(t, ErrCodeProtocol, goAwayCode(&Frame{Type: FrameHeaders, StreamID: 2, Flags: FlagEndHeaders | FlagEndStream, Payload: header}))
+	assert.Equal(t, ErrCodeProtocol, goAwayCode(&Frame{Type: FrameData, StreamID: 0, Payload: []byte("x")}))
+	assert.Equal(t, ErrCodeFrameSize, goAwayCode(&Frame{Type: FramePing, Payload: []byte("short")}))
+	assert.Equal(t, ErrCodeProtocol, goAwayCode(&Frame{Type: FrameWindowUpdate, Payload: []byte{0, 0, 0, 0}}))
+	assert.Equal(t, ErrCodeCompression, goAwayCode(&Frame{Type: FrameHeaders, StreamID: 1, Flags: FlagEndHeaders, Payload: []byte{0xff, 0xff}}))
+	many := make([]HeaderField, 0, maxHeaderFields+1)
+	for i := range maxHeaderFields + 1 {
+		many = append(many, HeaderField{"x", fmt.Sprint(i)})
+	}
+	huge := (&Encoder{}).Encode(nil, many)
+	assert.Equal(t, ErrCodeEnhanceYourCalm, goAwayCode(&Frame{Type: FrameHeaders, StreamID: 1, Flags: FlagEndHeaders, Payload: huge}))
+	assert.Equal(t, ErrCodeProtocol, goAwayCode(
+		&Frame{Type: FrameHeaders, StreamID: 1, Payload: header},
+		&Frame{Type: FramePing, Payload: make([]byte, 8)},
+	))
+}
+
+func TestRapidReset(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handler := func(w response.Writer, r *request.Request) {
+		<-release
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go ServeConn(server, bufio.NewReader(server), handler, Timeouts{})
+
+	frames := make(chan *Frame, 4*maxConcurrentStreams)
+	go func() {
+		br := bufio.NewReader(client)
+		for {
+			f, err := ReadFrame(br, 1<<20)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	_, err := client.Write([]byte(Preface))
+	require.NoError(t, err)
+	header := (&Encoder{}).Encode(nil, []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}})
+	cancel := binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel))
+
+	// Test: reset streams whose handlers still run keep counting
+	id := uint32(1)
+	for range maxConcurrentStreams {
+		require.NoError(t, WriteFrame(client, &Frame{Type: FrameHeaders, StreamID: id, Flags: FlagEndHeaders | FlagEndStream, Payload: header}))
+		require.NoError(t, WriteFrame(client, &Frame{Type: FrameRSTStream, StreamID: id, Payload: cancel}))
+		id += 2
+	}
+	require.NoError(t, WriteFrame(client, &Frame{Type: FrameHeaders, StreamID: id, Flags: FlagEndHeaders | FlagEndStream, Payload: header}))
+	for f := range frames {
+		if f.Type == FrameRSTStream {
+			assert.Equal(t, id, f.StreamID)
+			assert.Equal(t, ErrCodeRefusedStream, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+			break
+		}
+	}
+
+	// Test: carrying on past refusals ends the connection
+	for range maxConcurrentStreams {
+		id += 2
+		err := WriteFrame(client, &Frame{Type: FrameHeaders, StreamID: id, Flags: FlagEndHeaders | FlagEndStream, Payload: header})
+		if err != nil {
+			break
+		}
+	}
+	var goAway *Frame
+	for f := range frames {
+		if f.Type == FrameGoAway {
+			goAway = f
+			break
+		}
+	}
+	require.NotNil(t, goAway)
+	assert.Equal(t, ErrCodeEnhanceYourCalm, ErrCode(binary.BigEndian.Uint32(goAway.Payload[4:])))
+}
+
+func TestBufferedBodiesBounded(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go ServeConn(server, bufio.NewReader(server), h2Handler, Timeouts{})
+
+	resets := make(chan *Frame, 1)
+	go func() {
+		br := bufio.NewReader(client)
+		for {
+			f, err := ReadFrame(br, 1<<20)
+			if err != nil {
+				return
+			}
+			if f.Type == FrameRSTStream {
+				resets <- f
+				return
+			}
+		}
+	}()
+
+	_, err := client.Write([]byte(Preface))
+	require.NoError(t, err)
+	header := (&Encoder{}).Encode(nil, []HeaderField{{":method", "POST"}, {":scheme", "http"}, {":path", "/"}})
+	chunk := make([]byte, defaultMaxFrameSize)
+
+	// Test: bodies under maxBodySize each, but over maxBufferedBytes
+	// together, get the later stream refused
+	for _, id := range []uint32{1, 3} {
+		require.NoError(t, WriteFrame(client, &Frame{Type: FrameHeaders, StreamID: id, Flags: FlagEndHeaders, Payload: header}))
+	}
+	sent := 0
+	for id := uint32(1); sent < maxBufferedBytes+len(chunk); id = 4 - id {
+		require.NoError(t, WriteFrame(client, &Frame{Type: FrameData, StreamID: id, Payload: chunk}))
+		sent += len(chunk)
+	}
+
+	f := <-resets
+	assert.Equal(t, ErrCodeRefusedStream, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+}
+
+func TestTimeouts(t *testing.T) {
+	handler := func(w response.Writer, r *request.Request) {
+		if r.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(150 * time.Millisecond)
+		}
+		h2Handler(w, r)
+	}
+	timeouts := Timeouts{Idle: 100 * time.Millisecond, ReadHeader: 50 * time.Millisecond, Read: 50 * time.Millisecond}
+
+	// start sends frames on a new connection and returns the frames it
+	// gets back, up to the connection closing
+	start := func(frames ...*Frame) <-chan *Frame {
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		go ServeConn(server, bufio.NewReader(server), handler, timeouts)
+
+		received := make(chan *Frame, 16)
+		go func() {
+			br := bufio.NewReader(client)
+			for {
+				f, err := ReadFrame(br, 1<<20)
+				if err != nil {
+					close(received)
+					return
+				}
+				received <- f
+			}
+		}()
+		_, err := client.Write([]byte(Preface))
+		require.NoError(t, err)
+		for _, f := range frames {
+			require.NoError(t, WriteFrame(client, f))
+		}
+		return received
+	}
+	// closed waits for the connection to close and returns the GOAWAY
+	// code, 0xff if there was none, and whether a response was sent first
+	closed := func(received <-chan *Frame) (code ErrCode, responded bool) {
+		code = 0xff
+		for f := range received {
+			if f.Type == FrameHeaders {
+				responded = true
+			}
+			if f.Type == FrameGoAway {
+				code = ErrCode(binary.BigEndian.Uint32(f.Payload[4:]))
+			}
+		}
+		return code, responded
+	}
+
+	get := func(id uint32, path string) *Frame {
+		block := (&Encoder{}).Encode(nil, []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", path}})
+		return &Frame{Type: FrameHeaders, StreamID: id, Flags: FlagEndHeaders | FlagEndStream, Payload: block}
+	}
+	post := (&Encoder{}).Encode(nil, []HeaderField{{":method", "POST"}, {":scheme", "http"}, {":path", "/"}})
+
+	// Test: an idle connection is closed with GOAWAY
+	code, _ := closed(start())
+	assert.Equal(t, ErrCodeNo, code)
+
+	// Test: so is one whose request body stops arriving
+	code, responded := closed(start(&Frame{Type: FrameHeaders, StreamID: 1, Flags: FlagEndHeaders, Payload: post}))
+	assert.Equal(t, ErrCodeNo, code)
+	assert.False(t, responded)
+
+	// Test: and one stuck part way through a header block
+	code, _ = closed(start(&Frame{Type: FrameHeaders, StreamID: 1, Payload: post}))
+	assert.Equal(t, ErrCodeNo, code)
+
+	// Test: a handler taking longer than the timeouts is left to finish,
+	// and the idle timeout only starts once it has
+	begun := time.Now()
+	code, responded = closed(start(get(1, "/slow")))
+	assert.Equal(t, ErrCodeNo, code)
+	assert.True(t, responded)
+	assert.GreaterOrEqual(t, time.Since(begun), 250*time.Millisecond)
+}
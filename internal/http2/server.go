@@ -0,0 +1,958 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+)
+
+// Handler has the same shape as server.Handler, which can't be named here
+// because the server package imports this one.
+type Handler = func(w response.Writer, r *request.Request)
+
+const (
+	maxConcurrentStreams = 100
+	maxHeaderListSize    = 1 << 20
+	maxHeaderFields      = 1000
+	maxBodySize          = 10 << 20
+	// maxBufferedBytes bounds the request bodies a connection holds at
+	// once, those still arriving and those handlers are working on.
+	// Handlers get whole bodies, so windows are refilled as data
+	// arrives and this is what stops a client filling memory.
+	maxBufferedBytes = 16 << 20
+)
+
+// HasPreface reports whether the connection starts with the HTTP/2 client
+// preface. It only peeks, and stops as soon as the bytes stop matching, so
+// a short HTTP/1.1 request never blocks it.
+func HasPreface(br *bufio.Reader) bool {
+	for n := 1; n <= len(Preface); n++ {
+		data, err := br.Peek(n)
+		if err != nil || data[n-1] != Preface[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// IsUpgrade reports whether an HTTP/1.1 request asks to switch to h2c with
+// a usable HTTP2-Settings header.
+func IsUpgrade(r *request.Request) bool {
+	if !r.Headers.HasToken("upgrade", "h2c") || !r.Headers.HasToken("connection", "upgrade") {
+		return false
+	}
+	if !r.Headers.HasToken("connection", "http2-settings") {
+		return false
+	}
+	settings, err := r.Headers.GetString("http2-settings")
+	return err == nil && !strings.Contains(settings, ",")
+}
+
+// Timeouts bound how long a connection waits on the client. A zero field
+// means no bound.
+type Timeouts struct {
+	// Idle bounds the wait for a new stream while none are open or being
+	// handled. The connection is then closed with a GOAWAY.
+	Idle time.Duration
+	// ReadHeader bounds reading the preface, and each header block from
+	// its HEADERS frame to its last CONTINUATION.
+	ReadHeader time.Duration
+	// Read bounds receiving each request, from its HEADERS frame to the
+	// end of its body. A request that runs over closes the connection
+	// with a GOAWAY, as an idle one does.
+	Read time.Duration
+}
+
+// ServeConn serves a prior-knowledge HTTP/2 connection whose preface is
+// still waiting in br.
+func ServeConn(conn net.Conn, br *bufio.Reader, handler Handler, timeouts Timeouts) error {
+	sc := newServerConn(conn, br, handler, timeouts)
+	return sc.serve(nil)
+}
+
+// ServeUpgrade answers an h2c upgrade request with 101 Switching Protocols
+// and carries on over HTTP/2, replying to r on stream 1.
+func ServeUpgrade(conn net.Conn, br *bufio.Reader, handler Handler, r *request.Request, timeouts Timeouts) error {
+
+	encoded, _ := r.Headers.GetString("http2-settings")
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return fmt.Errorf("Error: decoding HTTP2-Settings: %w", err)
+	}
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return err
+	}
+
+	w := response.NewWriter(conn)
+	err = w.WriteStatusLine(response.SwitchingProtocols)
+	if err != nil {
+		return err
+	}
+	h := headers.NewHeaders()
+	h.Set("connection", "Upgrade")
+	h.Set("upgrade", "h2c")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+
+	sc := newServerConn(conn, br, handler, timeouts)
+	err = sc.applySettings(settings)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range []string{"upgrade", "http2-settings", "connection"} {
+		r.Headers.Del(key)
+	}
+	r.RequestLine.HttpVersion = "2"
+	return sc.serve(r)
+}
+
+type streamState int
+
+const (
+	stateOpen streamState = iota
+	stateHalfClosedRemote
+)
+
+type stream struct {
+	id    uint32
+	state streamState
+
+	body          bytes.Buffer
+	contentLength int
+	recvWindow    int64
+	opened        time.Time
+
+	// guarded by serverConn.mu
+	sendWindow int64
+	reset      bool
+	req        *request.Request
+	// dispatched is set once a handler has the body; released once the
+	// body no longer counts against serverConn.buffered.
+	dispatched bool
+	released   bool
+}
+
+type serverConn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	handler  Handler
+	timeouts Timeouts
+	dec      *Decoder
+
+	writeMu sync.Mutex
+	bw      *bufio.Writer
+	enc     Encoder
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	connSendWindow    int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	closed            bool
+	// running counts handlers that haven't returned. A stream the client
+	// resets leaves streams at once but its handler runs on, so this,
+	// not len(streams), is what bounds the work a client can start.
+	running int
+	// buffered is the bytes of request bodies held, bounded by
+	// maxBufferedBytes.
+	buffered int64
+	// headerStart is when the header block being read began, zero if
+	// there is none. idleSince is when the connection last went idle,
+	// zero while it isn't.
+	headerStart time.Time
+	idleSince   time.Time
+
+	// owned by the read loop
+	lastStreamID   uint32
+	connRecvWindow int64
+	headerStream   uint32
+	headerFlags    Flags
+	headerBlock    []byte
+	// refused counts streams refused in a row for too many handlers
+	// running; a client that carries on opening them is resetting
+	// streams as fast as it opens them (CVE-2023-44487).
+	refused int
+
+	handlers sync.WaitGroup
+}
+
+func newServerConn(conn net.Conn, br *bufio.Reader, handler Handler, timeouts Timeouts) *serverConn {
+	sc := &serverConn{
+		conn:              conn,
+		br:                br,
+		handler:           handler,
+		timeouts:          timeouts,
+		dec:               NewDecoder(defaultHeaderTableLen, maxHeaderListSize),
+		bw:                bufio.NewWriter(conn),
+		streams:           map[uint32]*stream{},
+		connSendWindow:    defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+		connRecvWindow:    defaultWindowSize,
+	}
+	sc.dec.SetMaxHeaderList(maxHeaderListSize, maxHeaderFields)
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+func (sc *serverConn) serve(upgrade *request.Request) error {
+
+	defer sc.shutdown()
+
+	if sc.timeouts.ReadHeader > 0 {
+		sc.conn.SetReadDeadline(time.Now().Add(sc.timeouts.ReadHeader))
+	}
+	preface := make([]byte, len(Preface))
+	_, err := io.ReadFull(sc.br, preface)
+	if err != nil {
+		return err
+	}
+	if string(preface) != Preface {
+		return fmt.Errorf("Error: bad http2 preface")
+	}
+
+	err = sc.writeFrame(&Frame{Type: FrameSettings, Payload: settingsPayload([]setting{
+		{SettingMaxConcurrentStreams, maxConcurrentStreams},
+		{SettingMaxHeaderListSize, maxHeaderListSize},
+	})})
+	if err != nil {
+		return err
+	}
+
+	if upgrade != nil {
+		st := sc.newStream(1)
+		st.state = stateHalfClosedRemote
+		sc.lastStreamID = 1
+		sc.dispatch(st, upgrade)
+	}
+
+	for {
+		sc.mu.Lock()
+		sc.setReadDeadline()
+		sc.mu.Unlock()
+
+		f, err := ReadFrame(sc.br, defaultMaxFrameSize)
+		if isTimeout(err) {
+			sc.goAway(ErrCodeNo)
+			return nil
+		}
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+
+		var se StreamError
+		if errors.As(err, &se) {
+			sc.resetStream(se)
+			continue
+		}
+		var ce ConnectionError
+		if errors.As(err, &ce) {
+			sc.goAway(ce.Code)
+			return ce
+		}
+		if errors.Is(err, errGoAway) || errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errGoAway = fmt.Errorf("Error: peer sent GOAWAY")
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// idle reports whether the connection has no streams open or being
+// handled, and no header block part way in. sc.mu must be held.
+func (sc *serverConn) idle() bool {
+	return len(sc.streams) == 0 && sc.running == 0 && sc.headerStart.IsZero()
+}
+
+// setReadDeadline sets the deadline for the next frame: the earliest of
+// the header block's and those of requests still arriving, the idle
+// timeout if there is nothing going on, and none while handlers run on
+// requests already in. It is set under sc.mu so a handler finishing
+// can't be overtaken by the read loop setting an older deadline.
+//
+// Handlers only call it once the connection is idle. Otherwise it reads
+// stream states the read loop owns, so only the read loop may. sc.mu
+// must be held.
+func (sc *serverConn) setReadDeadline() {
+
+	if sc.idle() {
+		if sc.idleSince.IsZero() {
+			sc.idleSince = time.Now()
+		}
+		var deadline time.Time
+		if sc.timeouts.Idle > 0 {
+			deadline = sc.idleSince.Add(sc.timeouts.Idle)
+		}
+		sc.conn.SetReadDeadline(deadline)
+		return
+	}
+	sc.idleSince = time.Time{}
+
+	var deadline time.Time
+	earliest := func(t time.Time) {
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	if !sc.headerStart.IsZero() && sc.timeouts.ReadHeader > 0 {
+		earliest(sc.headerStart.Add(sc.timeouts.ReadHeader))
+	}
+	if sc.timeouts.Read > 0 {
+		for _, st := range sc.streams {
+			if st.state == stateOpen {
+				earliest(st.opened.Add(sc.timeouts.Read))
+			}
+		}
+	}
+	sc.conn.SetReadDeadline(deadline)
+}
+
+func (sc *serverConn) processFrame(f *Frame) error {
+
+	if sc.headerBlock != nil && (f.Type != FrameContinuation || f.StreamID != sc.headerStream) {
+		return ConnectionError{ErrCodeProtocol, "expected CONTINUATION"}
+	}
+
+	switch f.Type {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		return sc.processContinuation(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return ConnectionError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return StreamError{f.StreamID, ErrCodeFrameSize, "PRIORITY must be 5 bytes"}
+		}
+		return nil
+	case FrameRSTStream:
+		return sc.processRSTStream(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return ConnectionError{ErrCodeProtocol, "clients cannot push"}
+	case FramePing:
+		if f.StreamID != 0 {
+			return ConnectionError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(f.Payload) != 8 {
+			return ConnectionError{ErrCodeFrameSize, "PING must be 8 bytes"}
+		}
+		if f.Has(FlagAck) {
+			return nil
+		}
+		return sc.writeFrame(&Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return ConnectionError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		return errGoAway
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	default:
+		// unknown frame types are ignored
+		return nil
+	}
+}
+
+func (sc *serverConn) processData(f *Frame) error {
+
+	if f.StreamID == 0 {
+		return ConnectionError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+
+	// flow control counts the whole payload, padding included
+	size := int64(len(f.Payload))
+	sc.connRecvWindow -= size
+	if sc.connRecvWindow < 0 {
+		return ConnectionError{ErrCodeFlowControl, "connection window exceeded"}
+	}
+	if size > 0 {
+		err := sc.windowUpdate(0, uint32(size))
+		if err != nil {
+			return err
+		}
+		sc.connRecvWindow += size
+	}
+
+	sc.mu.Lock()
+	st, ok := sc.streams[f.StreamID]
+	sc.mu.Unlock()
+	if !ok {
+		if f.StreamID > sc.lastStreamID {
+			return ConnectionError{ErrCodeProtocol, "DATA on idle stream"}
+		}
+		return StreamError{f.StreamID, ErrCodeStreamClosed, "DATA on closed stream"}
+	}
+	if st.state != stateOpen {
+		return StreamError{f.StreamID, ErrCodeStreamClosed, "DATA after END_STREAM"}
+	}
+
+	st.recvWindow -= size
+	if st.recvWindow < 0 {
+		return StreamError{f.StreamID, ErrCodeFlowControl, "stream window exceeded"}
+	}
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if st.body.Len()+len(data) > maxBodySize {
+		return StreamError{f.StreamID, ErrCodeRefusedStream, "request body too large"}
+	}
+	sc.mu.Lock()
+	full := sc.buffered+int64(len(data)) > maxBufferedBytes
+	if !full {
+		sc.buffered += int64(len(data))
+		st.body.Write(data)
+	}
+	sc.mu.Unlock()
+	if full {
+		return StreamError{f.StreamID, ErrCodeRefusedStream, "too much request data buffered"}
+	}
+
+	if f.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+	if size > 0 {
+		st.recvWindow += size
+		return sc.windowUpdate(st.id, uint32(size))
+	}
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *Frame) error {
+
+	if f.StreamID == 0 {
+		return ConnectionError{ErrCodeProtocol, "HEADERS on stream 0"}
+	}
+	if f.StreamID%2 == 0 {
+		return ConnectionError{ErrCodeProtocol, "client stream IDs must be odd"}
+	}
+
+	block, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.Has(FlagPriority) {
+		if len(block) < 5 {
+			return ConnectionError{ErrCodeFrameSize, "HEADERS priority fields truncated"}
+		}
+		block = block[5:]
+	}
+
+	sc.headerStream = f.StreamID
+	sc.headerFlags = f.Flags
+	sc.headerBlock = append([]byte{}, block...)
+	sc.mu.Lock()
+	sc.headerStart = time.Now()
+	sc.mu.Unlock()
+	if f.Has(FlagEndHeaders) {
+		return sc.endHeaderBlock()
+	}
+	return nil
+}
+
+func (sc *serverConn) processContinuation(f *Frame) error {
+
+	if sc.headerBlock == nil {
+		return ConnectionError{ErrCodeProtocol, "CONTINUATION without HEADERS"}
+	}
+	if len(sc.headerBlock)+len(f.Payload) > maxHeaderListSize {
+		return ConnectionError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	sc.headerBlock = append(sc.headerBlock, f.Payload...)
+	if f.Has(FlagEndHeaders) {
+		return sc.endHeaderBlock()
+	}
+	return nil
+}
+
+func (sc *serverConn) endHeaderBlock() error {
+
+	id, flags, block := sc.headerStream, sc.headerFlags, sc.headerBlock
+	sc.headerBlock = nil
+	sc.mu.Lock()
+	opened := sc.headerStart
+	sc.headerStart = time.Time{}
+	sc.mu.Unlock()
+
+	// decode even if the stream is going to be refused, so the HPACK
+	// table stays in step with the client's
+	fields, err := sc.dec.Decode(block)
+	if errors.Is(err, ErrHeaderListTooLarge) {
+		return ConnectionError{ErrCodeEnhanceYourCalm, err.Error()}
+	}
+	if err != nil {
+		return ConnectionError{ErrCodeCompression, err.Error()}
+	}
+
+	sc.mu.Lock()
+	st, exists := sc.streams[id]
+	active := max(len(sc.streams), sc.running)
+	sc.mu.Unlock()
+
+	if exists {
+		// trailers: they must end the stream and carry no pseudo-headers
+		if st.state != stateOpen {
+			return StreamError{id, ErrCodeStreamClosed, "HEADERS after END_STREAM"}
+		}
+		if flags&FlagEndStream == 0 {
+			return StreamError{id, ErrCodeProtocol, "trailers without END_STREAM"}
+		}
+		return sc.endRequest(st)
+	}
+
+	if id <= sc.lastStreamID {
+		return ConnectionError{ErrCodeProtocol, "stream ID went backwards"}
+	}
+	sc.lastStreamID = id
+	if active >= maxConcurrentStreams {
+		sc.refused++
+		if sc.refused > maxConcurrentStreams {
+			return ConnectionError{ErrCodeEnhanceYourCalm, "too many streams refused"}
+		}
+		return StreamError{id, ErrCodeRefusedStream, "too many concurrent streams"}
+	}
+	sc.refused = 0
+
+	req, err := requestFromFields(id, fields)
+	if err != nil {
+		return err
+	}
+
+	st = sc.newStream(id)
+	st.opened = opened
+	st.req = req
+	if cl, err := req.Headers.Get("content-length"); err == nil {
+		st.contentLength = cl
+	} else {
+		st.contentLength = -1
+	}
+
+	if flags&FlagEndStream != 0 {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) endRequest(st *stream) error {
+
+	st.state = stateHalfClosedRemote
+	if st.contentLength >= 0 && st.body.Len() != st.contentLength {
+		return StreamError{st.id, ErrCodeProtocol, "body does not match content-length"}
+	}
+
+	req := st.req
+	req.Body = st.body.Bytes()
+	sc.dispatch(st, req)
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f *Frame) error {
+
+	if f.StreamID == 0 {
+		return ConnectionError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.Payload) != 4 {
+		return ConnectionError{ErrCodeFrameSize, "RST_STREAM must be 4 bytes"}
+	}
+	if f.StreamID > sc.lastStreamID {
+		return ConnectionError{ErrCodeProtocol, "RST_STREAM on idle stream"}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st, ok := sc.streams[f.StreamID]; ok {
+		st.reset = true
+		delete(sc.streams, f.StreamID)
+		if !st.dispatched {
+			sc.release(st)
+		}
+		sc.cond.Broadcast()
+	}
+	return nil
+}
+
+func (sc *serverConn) processSettings(f *Frame) error {
+
+	if f.StreamID != 0 {
+		return ConnectionError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return ConnectionError{ErrCodeFrameSize, "SETTINGS ack with a payload"}
+		}
+		return nil
+	}
+
+	settings, err := parseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	err = sc.applySettings(settings)
+	if err != nil {
+		return err
+	}
+	return sc.writeFrame(&Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, s := range settings {
+		switch s.ID {
+		case SettingInitialWindowSize:
+			delta := int64(s.Value) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return ConnectionError{ErrCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.peerInitialWindow = int64(s.Value)
+		case SettingMaxFrameSize:
+			sc.peerMaxFrameSize = s.Value
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f *Frame) error {
+
+	if len(f.Payload) != 4 {
+		return ConnectionError{ErrCodeFrameSize, "WINDOW_UPDATE must be 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.Payload) & 0x7fffffff)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return ConnectionError{ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+		}
+		sc.connSendWindow += increment
+		if sc.connSendWindow > maxWindowSize {
+			return ConnectionError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st, ok := sc.streams[f.StreamID]
+	if !ok {
+		if f.StreamID > sc.lastStreamID {
+			return ConnectionError{ErrCodeProtocol, "WINDOW_UPDATE on idle stream"}
+		}
+		return nil
+	}
+	if increment == 0 {
+		return StreamError{f.StreamID, ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return StreamError{f.StreamID, ErrCodeFlowControl, "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st := &stream{
+		id:         id,
+		state:      stateOpen,
+		recvWindow: defaultWindowSize,
+		sendWindow: sc.peerInitialWindow,
+	}
+	sc.streams[id] = st
+	return st
+}
+
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.streams, st.id)
+}
+
+func (sc *serverConn) dispatch(st *stream, req *request.Request) {
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	sc.mu.Lock()
+	sc.running++
+	st.dispatched = true
+	sc.mu.Unlock()
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer func() {
+			sc.mu.Lock()
+			sc.running--
+			sc.release(st)
+			if sc.idle() {
+				sc.setReadDeadline()
+			}
+			sc.mu.Unlock()
+		}()
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// one stream's handler mustn't take down the connection, let
+			// alone the process
+			if p != response.ErrAbortHandler {
+				fmt.Printf("Error: panic serving stream %d: %v\n%s", st.id, p, debug.Stack())
+			}
+			sc.resetStream(StreamError{StreamID: st.id, Code: ErrCodeInternal})
+		}()
+
+		w := &responseWriter{sc: sc, st: st}
+		sc.handler(w, req)
+		err := w.finish()
+		if err != nil {
+			fmt.Println("Error:", err)
+		}
+		sc.closeStream(st)
+	}()
+}
+
+// release stops counting st's body against the connection. sc.mu must be
+// held.
+func (sc *serverConn) release(st *stream) {
+	if !st.released {
+		sc.buffered -= int64(st.body.Len())
+		st.released = true
+	}
+}
+
+func (sc *serverConn) resetStream(se StreamError) {
+	sc.mu.Lock()
+	if st, ok := sc.streams[se.StreamID]; ok {
+		st.reset = true
+		delete(sc.streams, se.StreamID)
+		if !st.dispatched {
+			sc.release(st)
+		}
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, uint32(se.Code))
+	err := sc.writeFrame(&Frame{Type: FrameRSTStream, StreamID: se.StreamID, Payload: payload})
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+}
+
+func (sc *serverConn) goAway(code ErrCode) {
+	payload := binary.BigEndian.AppendUint32(nil, sc.lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	err := sc.writeFrame(&Frame{Type: FrameGoAway, Payload: payload})
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+}
+
+func (sc *serverConn) windowUpdate(streamID uint32, increment uint32) error {
+	payload := binary.BigEndian.AppendUint32(nil, increment)
+	return sc.writeFrame(&Frame{Type: FrameWindowUpdate, StreamID: streamID, Payload: payload})
+}
+
+// shutdown waits for running handlers, waking any blocked on flow control,
+// and then closes the connection.
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	sc.handlers.Wait()
+	sc.conn.Close()
+}
+
+func (sc *serverConn) writeFrame(f *Frame) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	err := WriteFrame(sc.bw, f)
+	if err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+// writeHeaderBlock sends a header block as HEADERS plus as many
+// CONTINUATION frames as the peer's frame size needs, without letting
+// another stream's frames in between.
+func (sc *serverConn) writeHeaderBlock(streamID uint32, fields []HeaderField, endStream bool) error {
+
+	sc.mu.Lock()
+	maxFrame := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	block := sc.enc.Encode(nil, fields)
+	frameType := FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		n := min(len(block), maxFrame)
+		f := &Frame{Type: frameType, StreamID: streamID, Payload: block[:n]}
+		if first && endStream {
+			f.Flags |= FlagEndStream
+		}
+		if n == len(block) {
+			f.Flags |= FlagEndHeaders
+		}
+		err := WriteFrame(sc.bw, f)
+		if err != nil {
+			return err
+		}
+		block = block[n:]
+		frameType = FrameContinuation
+	}
+	return sc.bw.Flush()
+}
+
+// writeData sends p on the stream, waiting for window from the peer as
+// needed.
+func (sc *serverConn) writeData(st *stream, p []byte, endStream bool) error {
+
+	for first := true; first || len(p) > 0; first = false {
+		sc.mu.Lock()
+		for len(p) > 0 && (sc.connSendWindow <= 0 || st.sendWindow <= 0) && !st.reset && !sc.closed {
+			sc.cond.Wait()
+		}
+		if st.reset {
+			sc.mu.Unlock()
+			return fmt.Errorf("Error: stream %d was reset", st.id)
+		}
+		if sc.closed {
+			sc.mu.Unlock()
+			return net.ErrClosed
+		}
+		n := min(int64(len(p)), sc.connSendWindow, st.sendWindow, int64(sc.peerMaxFrameSize))
+		sc.connSendWindow -= n
+		st.sendWindow -= n
+		sc.mu.Unlock()
+
+		f := &Frame{Type: FrameData, StreamID: st.id, Payload: p[:n]}
+		if endStream && n == int64(len(p)) {
+			f.Flags = FlagEndStream
+		}
+		err := sc.writeFrame(f)
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func requestFromFields(id uint32, fields []HeaderField) (*request.Request, error) {
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "2"},
+		Headers:     headers.NewHeaders(),
+	}
+
+	var scheme, authority string
+	regular := false
+	// repeated fields are collected and joined once at the end; adding
+	// them one at a time copies the value so far each time
+	values := map[string][]string{}
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, StreamError{id, ErrCodeProtocol, "pseudo-header after regular header"}
+			}
+			var target *string
+			switch f.Name {
+			case ":method":
+				target = &req.RequestLine.Method
+			case ":path":
+				target = &req.RequestLine.RequestTarget
+			case ":scheme":
+				target = &scheme
+			case ":authority":
+				target = &authority
+			default:
+				return nil, StreamError{id, ErrCodeProtocol, "unknown pseudo-header " + f.Name}
+			}
+			if *target != "" {
+				return nil, StreamError{id, ErrCodeProtocol, "duplicate " + f.Name}
+			}
+			*target = f.Value
+			continue
+		}
+
+		regular = true
+		// the same checks the HTTP/1 parser makes, plus lower case
+		// names (RFC 9113, section 8.2.1)
+		if f.Name == "" || f.Name != strings.ToLower(f.Name) || !headers.ValidateCharacters([]byte(f.Name)) {
+			return nil, StreamError{id, ErrCodeProtocol, "invalid header name " + strconv.Quote(f.Name)}
+		}
+		if !headers.ValidateValue([]byte(f.Value)) || strings.Trim(f.Value, " \t") != f.Value {
+			return nil, StreamError{id, ErrCodeProtocol, "invalid value for header " + f.Name}
+		}
+		switch f.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return nil, StreamError{id, ErrCodeProtocol, "connection-specific header " + f.Name}
+		case "te":
+			if f.Value != "trailers" {
+				return nil, StreamError{id, ErrCodeProtocol, "te other than trailers"}
+			}
+		}
+		values[f.Name] = append(values[f.Name], f.Value)
+	}
+	for name, vals := range values {
+		req.Headers.AddAll(name, vals)
+	}
+
+	if req.RequestLine.Method == "" || req.RequestLine.RequestTarget == "" || scheme == "" {
+		return nil, StreamError{id, ErrCodeProtocol, "missing required pseudo-header"}
+	}
+	if authority != "" {
+		if _, err := req.Headers.GetString("host"); err != nil {
+			req.Headers.Set("host", authority)
+		}
+	}
+
+	return req, nil
+}
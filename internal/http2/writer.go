@@ -0,0 +1,144 @@
+package http2
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/response"
+)
+
+// responseWriter is the response.Writer handed to handlers for an HTTP/2
+// stream. Chunked writes become plain DATA frames, since HTTP/2 does its
+// own framing.
+type responseWriter struct {
+	sc     *serverConn
+	st     *stream
+	status response.StatusCode
+	state  response.WriterState
+}
+
+func (w *responseWriter) WriteStatusLine(statusCode response.StatusCode) error {
+	if w.state != response.StateStatusLine {
+		return fmt.Errorf("Error: status line already written, state: %d", w.state)
+	}
+	if statusCode.GetCode() < 200 {
+		return fmt.Errorf("Error: HTTP/2 does not support status %d", statusCode.GetCode())
+	}
+	w.status = statusCode
+	w.state = response.StateHeaders
+	return nil
+}
+
+func (w *responseWriter) WriteHeaders(h headers.Headers) error {
+	if w.state != response.StateHeaders {
+		return fmt.Errorf("Error: headers written out of order, state: %d", w.state)
+	}
+
+	fields := []HeaderField{{":status", strconv.Itoa(w.status.GetCode())}}
+	fields = append(fields, headerFields(h)...)
+	err := w.sc.writeHeaderBlock(w.st.id, fields, false)
+	if err != nil {
+		return err
+	}
+	w.state = response.StateBody
+	return nil
+}
+
+func (w *responseWriter) WriteBody(p []byte) (int, error) {
+	if w.state != response.StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", w.state)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	err := w.sc.writeData(w.st, p, false)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *responseWriter) WriteChunkedBody(p []byte) (int, error) {
+	return w.WriteBody(p)
+}
+
+func (w *responseWriter) WriteChunkedBodyDone() (int, error) {
+	if w.state != response.StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", w.state)
+	}
+
+	err := w.sc.writeData(w.st, nil, true)
+	if err != nil {
+		return 0, err
+	}
+	w.state = response.StateDone
+	return 0, nil
+}
+
+func (w *responseWriter) WriteTrailers(h headers.Headers) error {
+	if w.state != response.StateBody {
+		return fmt.Errorf("Error: trailers written before headers, state: %d", w.state)
+	}
+
+	err := w.sc.writeHeaderBlock(w.st.id, headerFields(h), true)
+	if err != nil {
+		return err
+	}
+	w.state = response.StateDone
+	return nil
+}
+
+// Flush is a no-op: every frame is flushed as it is written.
+func (w *responseWriter) Flush() error {
+	return nil
+}
+
+// finish ends the stream once the handler returns, sending an empty 200 if
+// the handler wrote nothing at all.
+func (w *responseWriter) finish() error {
+	switch w.state {
+	case response.StateStatusLine:
+		err := w.WriteStatusLine(response.Ok)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case response.StateHeaders:
+		fields := []HeaderField{{":status", strconv.Itoa(w.status.GetCode())}, {"content-length", "0"}}
+		w.state = response.StateDone
+		return w.sc.writeHeaderBlock(w.st.id, fields, true)
+	case response.StateBody:
+		_, err := w.WriteChunkedBodyDone()
+		return err
+	default:
+		return nil
+	}
+}
+
+// headerFields converts response headers to HTTP/2 fields, dropping the
+// connection-specific ones HTTP/2 forbids.
+func headerFields(h headers.Headers) []HeaderField {
+
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var fields []HeaderField
+	for _, k := range keys {
+		name := strings.ToLower(k)
+		switch name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			continue
+		}
+		for _, v := range strings.Split(h[k], "\n") {
+			fields = append(fields, HeaderField{name, v})
+		}
+	}
+	return fields
+}
@@ -0,0 +1,133 @@
+// Package jsonio reads JSON request bodies and writes JSON responses,
+// with errors sent as RFC 9457 problem details.
+package jsonio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+)
+
+const ContentType = "application/json"
+
+// DefaultMaxBytes is the largest body Decode accepts.
+const DefaultMaxBytes = 1 << 20
+
+type DecodeOptions struct {
+	// MaxBytes is the largest body accepted, after any content coding is
+	// undone. Zero means DefaultMaxBytes.
+	MaxBytes int
+	// AllowUnknownFields accepts object members v has no field for,
+	// rather than refusing the request.
+	AllowUnknownFields bool
+}
+
+// Decode reads r's JSON body into v, refusing unknown fields and bodies
+// over DefaultMaxBytes.
+func Decode(r *request.Request, v any) error {
+	return DecodeWith(r, v, DecodeOptions{})
+}
+
+// DecodeWith reads r's JSON body into v. Errors are *Problem values for
+// the client's mistakes, ready for Error: 415 for a body that isn't JSON,
+// 413 for one that's too large and 400 for one that doesn't fit v.
+func DecodeWith(r *request.Request, v any, opts DecodeOptions) error {
+
+	maxBytes := opts.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	contentType, _ := r.Headers.GetString("content-type")
+	if !isJSON(contentType) {
+		return NewProblem(response.UnsupportedMediaType, "Content-Type must be application/json")
+	}
+
+	if len(r.Body) > maxBytes {
+		return NewProblem(response.ContentTooLarge, fmt.Sprintf("body is larger than %d bytes", maxBytes))
+	}
+	err := r.DecodeBody(maxBytes)
+	if errors.Is(err, request.ErrUnsupportedEncoding) {
+		return NewProblem(response.UnsupportedMediaType, "unsupported Content-Encoding")
+	}
+	if errors.Is(err, request.ErrDecodedBodyTooLarge) {
+		return NewProblem(response.ContentTooLarge, fmt.Sprintf("body is larger than %d bytes", maxBytes))
+	}
+	if err != nil {
+		return NewProblem(response.BadRequest, "body could not be decompressed")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(r.Body))
+	if !opts.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return NewProblem(response.BadRequest, describe(err))
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return NewProblem(response.BadRequest, "body must hold a single JSON value")
+	}
+	return nil
+}
+
+// isJSON reports whether contentType is application/json or another
+// media type with the +json suffix, whatever its parameters.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == ContentType || strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")
+}
+
+// describe turns a decoding error into something fit for the client.
+func describe(err error) string {
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return "body is empty or truncated"
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Sprintf("field %q must be %s", typeErr.Field, typeErr.Type)
+		}
+		return fmt.Sprintf("body must be %s", typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for this
+		return "unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	}
+	return "body does not match the expected shape"
+}
+
+// Write sends v as a JSON response with the given status. If v can't be
+// marshalled, a 500 goes out instead.
+func Write(w response.Writer, status response.StatusCode, v any) error {
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return Error(w, err)
+	}
+	return write(w, status, ContentType, append(body, '\n'))
+}
+
+func write(w response.Writer, status response.StatusCode, contentType string, body []byte) error {
+
+	if err := w.WriteStatusLine(status); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(response.GetDefaultHeaders(len(body), contentType)); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(body)
+	return err
+}
@@ -0,0 +1,121 @@
+package jsonio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type user struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func post(contentType, body string) *servertest.RequestBuilder {
+	return servertest.NewRequest("POST", "/users").Header("Content-Type", contentType).Body([]byte(body))
+}
+
+func TestDecode(t *testing.T) {
+	var u user
+	err := Decode(post("application/json; charset=utf-8", `{"name":"ada","age":36}`).Request(), &u)
+	require.NoError(t, err)
+	assert.Equal(t, user{"ada", 36}, u)
+
+	err = Decode(post("application/merge-patch+json", `{"age":37}`).Request(), &u)
+	require.NoError(t, err)
+	assert.Equal(t, 37, u.Age)
+
+	cases := []struct {
+		req    *servertest.RequestBuilder
+		status response.StatusCode
+		detail string
+	}{
+		{post("text/plain", `{}`), response.UnsupportedMediaType, "Content-Type must be application/json"},
+		{servertest.NewRequest("POST", "/").Body([]byte(`{}`)), response.UnsupportedMediaType, "Content-Type must be application/json"},
+		{post("application/json", ""), response.BadRequest, "body is empty or truncated"},
+		{post("application/json", `{"name":"ada",}`), response.BadRequest, "malformed JSON at offset 15"},
+		{post("application/json", `{"name":"ada","admin":true}`), response.BadRequest, `unknown field "admin"`},
+		{post("application/json", `{"age":"old"}`), response.BadRequest, `field "age" must be int`},
+		{post("application/json", `[]`), response.BadRequest, "body must be jsonio.user"},
+		{post("application/json", `{} {}`), response.BadRequest, "body must hold a single JSON value"},
+		{post("application/json", `{"name":"`+strings.Repeat("a", DefaultMaxBytes)+`"}`), response.ContentTooLarge, fmt.Sprintf("body is larger than %d bytes", DefaultMaxBytes)},
+	}
+	for _, c := range cases {
+		err := Decode(c.req.Request(), &user{})
+		var p *Problem
+		require.ErrorAs(t, err, &p)
+		assert.Equal(t, c.status, p.Status, c.detail)
+		assert.Equal(t, c.detail, p.Detail)
+	}
+
+	// Test: unknown fields on request
+	err = DecodeWith(post("application/json", `{"name":"ada","admin":true}`).Request(), &u, DecodeOptions{AllowUnknownFields: true})
+	assert.NoError(t, err)
+
+	// Test: limits apply after decompression
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"name":"` + strings.Repeat("a", 100) + `"}`))
+	zw.Close()
+	req := post("application/json", gz.String()).Header("Content-Encoding", "gzip").Request()
+	err = DecodeWith(req, &u, DecodeOptions{MaxBytes: 64})
+	var p *Problem
+	require.ErrorAs(t, err, &p)
+	assert.Equal(t, response.ContentTooLarge, p.Status)
+
+	req = post("application/json", gz.String()).Header("Content-Encoding", "gzip").Request()
+	require.NoError(t, Decode(req, &u))
+	assert.Len(t, u.Name, 100)
+}
+
+func TestWrite(t *testing.T) {
+	rec := servertest.NewRecorder()
+	require.NoError(t, Write(rec, response.Ok, user{"ada", 36}))
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "application/json", rec.Header("Content-Type"))
+	assert.Equal(t, "24", rec.Header("Content-Length"))
+	assert.Equal(t, "{\"name\":\"ada\",\"age\":36}\n", rec.Body.String())
+
+	// Test: values that can't be marshalled
+	rec = servertest.NewRecorder()
+	Write(rec, response.Ok, map[string]any{"f": func() {}})
+	assert.Equal(t, response.InternalServerError, rec.Code)
+	assert.Equal(t, ProblemContentType, rec.Header("Content-Type"))
+}
+
+func TestProblem(t *testing.T) {
+	p := NewProblem(response.BadRequest, "age must be positive")
+	p.Type = "https://example.com/probs/validation"
+	p.Instance = "/users/42"
+	p.Extensions = map[string]any{"fields": []string{"age"}, "status": 999}
+
+	rec := servertest.NewRecorder()
+	require.NoError(t, Error(rec, fmt.Errorf("creating user: %w", p)))
+	assert.Equal(t, response.BadRequest, rec.Code)
+	assert.Equal(t, ProblemContentType, rec.Header("Content-Type"))
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, map[string]any{
+		"type":     "https://example.com/probs/validation",
+		"title":    "Bad Request",
+		"status":   float64(400),
+		"detail":   "age must be positive",
+		"instance": "/users/42",
+		"fields":   []any{"age"},
+	}, got)
+
+	// Test: other errors don't leak
+	rec = servertest.NewRecorder()
+	require.NoError(t, Error(rec, fmt.Errorf("Error: db password is hunter2")))
+	assert.Equal(t, response.InternalServerError, rec.Code)
+	assert.Equal(t, "{\"status\":500,\"title\":\"Internal Server Error\"}\n", rec.Body.String())
+}
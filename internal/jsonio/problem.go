@@ -0,0 +1,92 @@
+package jsonio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+
+	"github.com/ratludu/httpfromtcp/internal/response"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 9457 problem details object. It is also an error, so
+// handlers can return one from deep inside and send it with Error.
+type Problem struct {
+	// Type is a URI naming the kind of problem. Empty means "about:blank",
+	// a problem that is no more than its status code.
+	Type     string
+	Title    string
+	Status   response.StatusCode
+	Detail   string
+	Instance string
+	// Extensions are extra members, such as the fields that failed
+	// validation. They can't override the standard members.
+	Extensions map[string]any
+}
+
+// NewProblem returns a problem titled after status, with detail saying
+// what went wrong this time.
+func NewProblem(status response.StatusCode, detail string) *Problem {
+	return &Problem{Title: status.GetMessage(), Status: status, Detail: detail}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("Error: %d %s", p.Status, p.Title)
+	}
+	return fmt.Sprintf("Error: %d %s: %s", p.Status, p.Title, p.Detail)
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+
+	members := make(map[string]any, len(p.Extensions)+5)
+	maps.Copy(members, p.Extensions)
+	if p.Type != "" {
+		members["type"] = p.Type
+	} else {
+		delete(members, "type")
+	}
+	for name, value := range map[string]string{"title": p.Title, "detail": p.Detail, "instance": p.Instance} {
+		if value != "" {
+			members[name] = value
+		} else {
+			delete(members, name)
+		}
+	}
+	if p.Status != 0 {
+		members["status"] = p.Status.GetCode()
+	} else {
+		delete(members, "status")
+	}
+	return json.Marshal(members)
+}
+
+// WriteProblem sends p as an application/problem+json response.
+func WriteProblem(w response.Writer, p *Problem) error {
+
+	status := p.Status
+	if status == 0 {
+		status = response.InternalServerError
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		fmt.Println("Error:", err)
+		body, _ = json.Marshal(NewProblem(status, ""))
+	}
+	return write(w, status, ProblemContentType, append(body, '\n'))
+}
+
+// Error sends err as problem details. A *Problem anywhere in err's chain
+// is sent as it is; any other error is a 500 whose details stay in the
+// log rather than reaching the client.
+func Error(w response.Writer, err error) error {
+
+	var p *Problem
+	if !errors.As(err, &p) {
+		fmt.Println("Error:", err)
+		p = NewProblem(response.InternalServerError, "")
+	}
+	return WriteProblem(w, p)
+}
@@ -0,0 +1,240 @@
+// Package metrics counts what the server does and serves the numbers in
+// the Prometheus text format, without pulling in the client library.
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// DefaultPath is where the metrics are served unless Options.Path says
+// otherwise.
+const DefaultPath = "/metrics"
+
+// DurationBuckets are the latency histogram bounds, in seconds.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// SizeBuckets are the request and response size histogram bounds, in bytes.
+var SizeBuckets = []float64{100, 1000, 10_000, 100_000, 1_000_000, 10_000_000}
+
+// methods are the label values kept as they are. Anything else counts as
+// OTHER, so clients can't create series at will.
+var methods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+// parseErrorTypes labels the parser's errors. The first match wins.
+var parseErrorTypes = []struct {
+	err   error
+	label string
+}{
+	{request.ErrLineTooLong, "line_too_long"},
+	{request.ErrInvalidRequestLine, "invalid_request_line"},
+	{request.ErrLeadingWhitespace, "leading_whitespace"},
+	{request.ErrInvalidContentLength, "invalid_content_length"},
+	{request.ErrConflictingContentLength, "conflicting_content_length"},
+	{request.ErrContentLengthWithTransferEncoding, "content_length_with_transfer_encoding"},
+	{request.ErrChunkedNotFinal, "chunked_not_final"},
+	{request.ErrUnsupportedTransferEncoding, "unsupported_transfer_encoding"},
+	{request.ErrInvalidChunk, "invalid_chunk"},
+	{request.ErrBodyTooLarge, "body_too_large"},
+	{headers.ErrBareLF, "bare_lf"},
+	{headers.ErrBareCR, "bare_cr"},
+	{headers.ErrObsFold, "obs_fold"},
+	{headers.ErrSpaceBeforeColon, "space_before_colon"},
+	{headers.ErrInvalidFieldValue, "invalid_field_value"},
+	{io.ErrUnexpectedEOF, "unexpected_eof"},
+}
+
+// OtherRoute is the route label for requests no route was named for.
+const OtherRoute = "other"
+
+type Options struct {
+	// Path is where the metrics are served. Empty means DefaultPath.
+	Path string
+	// Route names the route a request counts towards. It must only ever
+	// return a bounded set of names, since each one is a series kept for
+	// good; see ByPrefix. Nil counts every request as OtherRoute.
+	Route func(r *request.Request) string
+}
+
+// ByPrefix names routes after the longest of prefixes the request path
+// starts with, and OtherRoute if none does. Clients can't make up new
+// label values, whatever paths they ask for.
+func ByPrefix(prefixes ...string) func(r *request.Request) string {
+	return func(r *request.Request) string {
+		path := pathOnly(r)
+		route := OtherRoute
+		best := -1
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) && len(prefix) > best {
+				route, best = prefix, len(prefix)
+			}
+		}
+		return route
+	}
+}
+
+// Metrics holds every series. Create one with New, then hook it into the
+// server with Middleware, ConnState and ParseError.
+type Metrics struct {
+	path  string
+	route func(r *request.Request) string
+
+	requests     *counterVec
+	duration     *histogramVec
+	requestSize  *histogramVec
+	responseSize *histogramVec
+	active       *counterVec
+	reused       *counterVec
+	parseErrors  *counterVec
+
+	collectors []collector
+
+	mu    sync.Mutex
+	conns map[net.Conn]server.ConnState
+}
+
+func New(opts Options) *Metrics {
+
+	m := &Metrics{
+		path:  opts.Path,
+		route: opts.Route,
+		conns: make(map[net.Conn]server.ConnState),
+	}
+	if m.path == "" {
+		m.path = DefaultPath
+	}
+	if m.route == nil {
+		m.route = func(*request.Request) string { return OtherRoute }
+	}
+
+	m.requests = newCounterVec("http_requests_total", "Requests served, by method, route and status.", "method", "route", "status")
+	m.duration = newHistogramVec("http_request_duration_seconds", "Time spent handling requests.", DurationBuckets, "method", "route")
+	m.requestSize = newHistogramVec("http_request_size_bytes", "Request body sizes.", SizeBuckets, "method", "route")
+	m.responseSize = newHistogramVec("http_response_size_bytes", "Response body sizes.", SizeBuckets, "method", "route")
+	m.active = newGauge("http_active_connections", "Connections currently open.")
+	m.reused = newCounterVec("http_keepalive_reused_total", "Requests served on a kept-alive connection.")
+	m.parseErrors = newCounterVec("http_parse_errors_total", "Requests the parser rejected, by error type.", "type")
+
+	m.collectors = []collector{m.requests, m.duration, m.requestSize, m.responseSize, m.active, m.reused, m.parseErrors}
+
+	return m
+}
+
+// Middleware records each request passing through, and answers requests
+// for the metrics path itself.
+func (m *Metrics) Middleware(next server.Handler) server.Handler {
+	return func(w response.Writer, r *request.Request) {
+
+		if pathOnly(r) == m.path {
+			m.Handler(w, r)
+			return
+		}
+
+		start := time.Now()
+		tw := response.NewTrackingWriter(w)
+		// recorded in a defer so requests whose handler panics count too,
+		// with the 500 the server answers them with
+		returned := false
+		defer func() {
+			method := r.RequestLine.Method
+			if !methods[method] {
+				method = "OTHER"
+			}
+			route := m.route(r)
+			status := tw.Status()
+			if !returned && status == 0 {
+				status = response.InternalServerError
+			}
+
+			m.requests.add(1, method, route, strconv.Itoa(status.GetCode()))
+			m.duration.observe(time.Since(start).Seconds(), method, route)
+			m.requestSize.observe(float64(len(r.Body)), method, route)
+			m.responseSize.observe(float64(tw.BytesWritten()), method, route)
+		}()
+
+		next(tw, r)
+		returned = true
+	}
+}
+
+// Handler writes every series in the text format.
+func (m *Metrics) Handler(w response.Writer, r *request.Request) {
+
+	buf := new(bytes.Buffer)
+	m.WriteText(buf)
+
+	h := response.GetDefaultHeaders(buf.Len(), ContentType)
+	h.Set("cache-control", "no-store")
+	w.WriteStatusLine(response.Ok)
+	w.WriteHeaders(h)
+	if r.RequestLine.Method != "HEAD" {
+		w.WriteBody(buf.Bytes())
+	}
+}
+
+// WriteText writes every series to w in the text format.
+func (m *Metrics) WriteText(w io.Writer) {
+	for _, c := range m.collectors {
+		c.write(w)
+	}
+}
+
+// ConnState tracks open connections and kept-alive reuse. Set it as
+// server.Server.ConnState.
+func (m *Metrics) ConnState(conn net.Conn, state server.ConnState) {
+
+	m.mu.Lock()
+	prev, known := m.conns[conn]
+	switch state {
+	case server.StateHijacked, server.StateClosed:
+		delete(m.conns, conn)
+	default:
+		m.conns[conn] = state
+	}
+	m.mu.Unlock()
+
+	switch {
+	case state == server.StateNew:
+		m.active.add(1)
+	case !known:
+		// a connection opened before the hook was set
+	case state == server.StateHijacked || state == server.StateClosed:
+		m.active.add(-1)
+	case state == server.StateActive && prev == server.StateIdle:
+		m.reused.add(1)
+	}
+}
+
+// ParseError counts a request the parser rejected. Set it as
+// server.Server.ParseError.
+func (m *Metrics) ParseError(err error) {
+	m.parseErrors.add(1, parseErrorType(err))
+}
+
+func parseErrorType(err error) string {
+	for _, t := range parseErrorTypes {
+		if errors.Is(err, t.err) {
+			return t.label
+		}
+	}
+	return "other"
+}
+
+func pathOnly(r *request.Request) string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
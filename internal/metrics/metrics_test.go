@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hello(w response.Writer, r *request.Request) {
+	body := []byte("hello")
+	status := response.Ok
+	if r.RequestLine.RequestTarget == "/missing" {
+		status = response.NotFound
+	}
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body), "text/plain"))
+	w.WriteBody(body)
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	rec := servertest.NewRecorder()
+	m.Middleware(hello)(rec, servertest.NewRequest("GET", "/metrics").Request())
+	require.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, ContentType, rec.Header("content-type"))
+	return rec.Body.String()
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New(Options{Route: ByPrefix("/a", "/missing")})
+	handler := m.Middleware(hello)
+
+	handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/a?page=2").Request())
+	handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/a").Request())
+	handler(servertest.NewRecorder(), servertest.NewRequest("POST", "/a").Body(make([]byte, 500)).Request())
+	handler(servertest.NewRecorder(), servertest.NewRequest("BREW", "/missing").Request())
+
+	out := scrape(t, m)
+	assert.Contains(t, out, "# TYPE http_requests_total counter\n")
+	assert.Contains(t, out, `http_requests_total{method="GET",route="/a",status="200"} 2`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="POST",route="/a",status="200"} 1`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="OTHER",route="/missing",status="404"} 1`+"\n")
+
+	// Test: histogram buckets are cumulative
+	assert.Contains(t, out, "# TYPE http_request_size_bytes histogram\n")
+	assert.Contains(t, out, `http_request_size_bytes_bucket{method="POST",route="/a",le="100"} 0`+"\n")
+	assert.Contains(t, out, `http_request_size_bytes_bucket{method="POST",route="/a",le="1000"} 1`+"\n")
+	assert.Contains(t, out, `http_request_size_bytes_bucket{method="POST",route="/a",le="+Inf"} 1`+"\n")
+	assert.Contains(t, out, `http_request_size_bytes_sum{method="POST",route="/a"} 500`+"\n")
+	assert.Contains(t, out, `http_response_size_bytes_count{method="GET",route="/a"} 2`+"\n")
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET",route="/a"} 2`+"\n")
+
+	// Test: scrapes aren't counted
+	assert.NotContains(t, out, `route="/metrics"`)
+
+	// Test: paths outside the routes share one series
+	handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/made-up/1").Request())
+	handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/made-up/2").Request())
+	out = scrape(t, m)
+	assert.Contains(t, out, `http_requests_total{method="GET",route="other",status="200"} 2`+"\n")
+	assert.NotContains(t, out, "made-up")
+
+	// Test: without a Route, everything is other
+	m = New(Options{})
+	m.Middleware(hello)(servertest.NewRecorder(), servertest.NewRequest("GET", "/a").Request())
+	assert.Contains(t, scrape(t, m), `http_requests_total{method="GET",route="other",status="200"} 1`+"\n")
+}
+
+func TestMiddleware_Panics(t *testing.T) {
+	m := New(Options{})
+	handler := m.Middleware(func(w response.Writer, r *request.Request) {
+		panic("boom")
+	})
+
+	// Test: the panic carries on to the server, and the 500 it answers
+	// with is counted
+	assert.PanicsWithValue(t, "boom", func() {
+		handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/a").Request())
+	})
+	assert.Contains(t, scrape(t, m), `http_requests_total{method="GET",route="other",status="500"} 1`+"\n")
+}
+
+func TestMiddleware_Options(t *testing.T) {
+	m := New(Options{
+		Path: "/internal/stats",
+		Route: func(r *request.Request) string {
+			return "users:" + r.RequestLine.Method
+		},
+	})
+	handler := m.Middleware(hello)
+	handler(servertest.NewRecorder(), servertest.NewRequest("GET", "/users/42").Request())
+
+	rec := servertest.NewRecorder()
+	handler(rec, servertest.NewRequest("GET", "/internal/stats").Request())
+	assert.Contains(t, rec.Body.String(), `http_requests_total{method="GET",route="users:GET",status="200"} 1`)
+
+	// Test: the default path is an ordinary route now
+	rec = servertest.NewRecorder()
+	handler(rec, servertest.NewRequest("GET", "/metrics").Request())
+	assert.Equal(t, "hello", rec.Body.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	c := newCounterVec("x_total", "Help.", "route")
+	c.add(1, "a\"b\\c\nd")
+	buf := new(strings.Builder)
+	c.write(buf)
+	assert.Equal(t, "# HELP x_total Help.\n# TYPE x_total counter\n"+`x_total{route="a\"b\\c\nd"} 1`+"\n", buf.String())
+}
+
+func TestParseErrorType(t *testing.T) {
+	assert.Equal(t, "bare_lf", parseErrorType(fmt.Errorf("%w in request line", headers.ErrBareLF)))
+	assert.Equal(t, "invalid_request_line", parseErrorType(fmt.Errorf("%w: bad method", request.ErrInvalidRequestLine)))
+	assert.Equal(t, "content_length_with_transfer_encoding", parseErrorType(request.ErrContentLengthWithTransferEncoding))
+	assert.Equal(t, "other", parseErrorType(fmt.Errorf("something else")))
+}
+
+func TestConnections(t *testing.T) {
+	m := New(Options{})
+	s := servertest.NewServer(m.Middleware(hello))
+	s.Config().ConnState = m.ConnState
+	s.Config().ParseError = m.ParseError
+	t.Cleanup(s.Close)
+
+	// Test: three requests over one connection
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	for i := range 3 {
+		go conn.Write(servertest.NewRequest("GET", fmt.Sprintf("/%d", i)).Bytes())
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	out := scrape(t, m)
+	assert.Contains(t, out, "http_active_connections 1\n")
+	assert.Contains(t, out, "http_keepalive_reused_total 2\n")
+	conn.Close()
+
+	// Test: parse errors
+	conn, err = s.Dial()
+	require.NoError(t, err)
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost : a\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+	conn.Close()
+
+	s.Close()
+	out = scrape(t, m)
+	assert.Contains(t, out, `http_parse_errors_total{type="space_before_colon"} 1`+"\n")
+	assert.Contains(t, out, "http_active_connections 0\n")
+}
@@ -0,0 +1,258 @@
+// Package negotiate picks which of several representations to send, from
+// the request's Accept, Accept-Language and Accept-Charset headers
+// (RFC 9110, section 12.5).
+//
+// Handlers that pick a representation this way must list the header they
+// looked at in Vary, so caches don't hand one client's choice to another.
+// ByType does that itself.
+package negotiate
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// MediaRange is one element of an Accept header, such as
+// "text/html;level=1;q=0.5".
+type MediaRange struct {
+	Type    string
+	Subtype string
+	// Params are the media type parameters before q, lower cased.
+	Params map[string]string
+	Q      float64
+}
+
+// ParseAccept reads the media ranges of an Accept header, in the order
+// given. Malformed elements are skipped.
+func ParseAccept(value string) []MediaRange {
+
+	var ranges []MediaRange
+	for _, element := range headers.SplitQuoted(value, ',') {
+		params := headers.SplitQuoted(element, ';')
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok || typ == "" || subtype == "" || typ == "*" && subtype != "*" {
+			continue
+		}
+		mr := MediaRange{Type: typ, Subtype: subtype, Q: 1}
+		q, rest, ok := parseParams(params[1:])
+		if !ok {
+			continue
+		}
+		mr.Q, mr.Params = q, rest
+		ranges = append(ranges, mr)
+	}
+	return ranges
+}
+
+// match reports whether mr covers the media type typ/subtype with params,
+// and how specifically: more specific ranges override less specific ones.
+func (mr MediaRange) match(typ, subtype string, params map[string]string) (int, bool) {
+
+	switch {
+	case mr.Type == "*":
+		return 0, true
+	case mr.Type != typ:
+		return 0, false
+	case mr.Subtype == "*":
+		return 1, true
+	case mr.Subtype != subtype:
+		return 0, false
+	}
+	for name, value := range mr.Params {
+		if !strings.EqualFold(params[name], value) {
+			return 0, false
+		}
+	}
+	return 2 + len(mr.Params), true
+}
+
+// ContentType picks the offered media type, e.g. "application/json", that
+// r's Accept header rates highest, preferring earlier offers on a tie. It
+// returns "" if r accepts none of them. Without an Accept header the first
+// offer wins.
+func ContentType(r *request.Request, offers ...string) string {
+
+	accept, err := r.Headers.GetString("accept")
+	if err != nil || strings.TrimSpace(accept) == "" {
+		return first(offers)
+	}
+	ranges := ParseAccept(accept)
+	if len(ranges) == 0 {
+		// nothing usable, so as good as no header
+		return first(offers)
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		mediaType, params, err := mime.ParseMediaType(offer)
+		if err != nil {
+			continue
+		}
+		typ, subtype, _ := strings.Cut(mediaType, "/")
+
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			if s, ok := mr.match(typ, subtype, params); ok && s > specificity {
+				q, specificity = mr.Q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// Language picks the offered language tag, e.g. "en-GB", that r's
+// Accept-Language header rates highest, or "" if it accepts none of them.
+// Ranges match tags they are a prefix of, so "en" covers "en-GB" (RFC
+// 4647, section 3.3.1). Without the header the first offer wins.
+func Language(r *request.Request, offers ...string) string {
+	return pick(r, "accept-language", offers, func(rng, offer string) bool {
+		return len(offer) > len(rng) && offer[len(rng)] == '-' && strings.EqualFold(offer[:len(rng)], rng)
+	})
+}
+
+// Charset picks the offered charset, e.g. "utf-8", that r's
+// Accept-Charset header rates highest, or "" if it accepts none of them.
+// Without the header the first offer wins.
+func Charset(r *request.Request, offers ...string) string {
+	return pick(r, "accept-charset", offers, nil)
+}
+
+// pick negotiates over a header of plain tokens with q values. A token
+// matches offers equal to it, or that prefix accepts; longer matches
+// override shorter ones, and "*" covers anything not matched otherwise.
+func pick(r *request.Request, header string, offers []string, prefix func(rng, offer string) bool) string {
+
+	value, err := r.Headers.GetString(header)
+	if err != nil || strings.TrimSpace(value) == "" {
+		return first(offers)
+	}
+
+	type weighted struct {
+		token string
+		q     float64
+	}
+	var tokens []weighted
+	for _, element := range headers.SplitQuoted(value, ',') {
+		params := headers.SplitQuoted(element, ';')
+		token := strings.TrimSpace(params[0])
+		q, _, ok := parseParams(params[1:])
+		if token != "" && ok {
+			tokens = append(tokens, weighted{token, q})
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, t := range tokens {
+			s := -1
+			switch {
+			case strings.EqualFold(t.token, offer):
+				s = len(offer) + 1
+			case t.token == "*":
+				s = 0
+			case prefix != nil && prefix(t.token, offer):
+				s = len(t.token)
+			}
+			if s > specificity {
+				q, specificity = t.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// Offer is a representation ByType can send.
+type Offer struct {
+	// Type is the media type, e.g. "text/csv".
+	Type    string
+	Handler server.Handler
+}
+
+// ByType returns a handler that sends each request to the offer its Accept
+// header prefers, earlier offers winning ties. Requests accepting none of
+// them get a 406 listing what is available. Responses vary on Accept.
+func ByType(offers ...Offer) server.Handler {
+
+	types := make([]string, len(offers))
+	for i, o := range offers {
+		types[i] = o.Type
+	}
+
+	return func(w response.Writer, r *request.Request) {
+
+		w = response.BeforeHeaders(w, func(h headers.Headers) {
+			h.AddVary("Accept")
+		})
+
+		chosen := ContentType(r, types...)
+		for _, o := range offers {
+			if o.Type == chosen {
+				o.Handler(w, r)
+				return
+			}
+		}
+		NotAcceptable(w, types...)
+	}
+}
+
+// NotAcceptable answers 406, listing the media types that are available.
+func NotAcceptable(w response.Writer, available ...string) {
+	he := server.HandlerError{
+		StatusCode: response.NotAcceptable,
+		Message:    "Not Acceptable\n\nAvailable: " + strings.Join(available, ", "),
+	}
+	he.Write(w)
+}
+
+func first(offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	return offers[0]
+}
+
+// parseParams reads the parameters after a value up to q, lower casing
+// names. Anything after q is an extension and ignored. It reports false
+// if q isn't a valid qvalue.
+func parseParams(params []string) (float64, map[string]string, bool) {
+
+	q := 1.0
+	var rest map[string]string
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if name == "q" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				return 0, nil, false
+			}
+			q = parsed
+			break
+		}
+		if name == "" {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+			value = unquoted
+		}
+		if rest == nil {
+			rest = make(map[string]string)
+		}
+		rest[name] = value
+	}
+	return q, rest, true
+}
@@ -0,0 +1,104 @@
+package negotiate
+
+import (
+	"testing"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func withHeader(name, value string) *request.Request {
+	return servertest.NewRequest("GET", "/").Header(name, value).Request()
+}
+
+func TestParseAccept(t *testing.T) {
+	ranges := ParseAccept(`text/html;level=1, text/*;q=0.3, bogus, */*;q=0.1;ext=1, text/plain;format="a,b";q=0.5, */html, image/png;q=2`)
+	assert.Equal(t, []MediaRange{
+		{Type: "text", Subtype: "html", Params: map[string]string{"level": "1"}, Q: 1},
+		{Type: "text", Subtype: "*", Q: 0.3},
+		{Type: "*", Subtype: "*", Q: 0.1},
+		{Type: "text", Subtype: "plain", Params: map[string]string{"format": "a,b"}, Q: 0.5},
+	}, ranges)
+}
+
+func TestContentType(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/csv"}
+	cases := []struct {
+		accept string
+		want   string
+	}{
+		{"application/json", "application/json"},
+		{"text/csv, application/json;q=0.9", "text/csv"},
+		{"text/*", "text/html"},
+		{"text/*, text/html;q=0", "text/csv"},
+		{"*/*;q=0.1, application/json;q=0.5", "application/json"},
+		{"APPLICATION/JSON", "application/json"},
+		{"image/png", ""},
+		{"application/json;q=0", ""},
+		{"", "text/html"},
+		{"garbage", "text/html"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, ContentType(withHeader("Accept", c.accept), offers...), c.accept)
+	}
+
+	// Test: most specific range wins, parameters included
+	accept := "text/*;q=0.3, text/html;q=0.7, text/html;level=1, */*;q=0.5"
+	r := withHeader("Accept", accept)
+	assert.Equal(t, "text/html;level=1", ContentType(r, "text/plain", "text/html;level=1"))
+	assert.Equal(t, "image/jpeg", ContentType(r, "text/plain", "image/jpeg"))
+	assert.Equal(t, "text/html;level=2", ContentType(r, "text/html;level=2", "text/plain"))
+}
+
+func TestLanguage(t *testing.T) {
+	r := withHeader("Accept-Language", "da, en-gb;q=0.8, en;q=0.7")
+	assert.Equal(t, "en-GB", Language(r, "en-US", "en-GB"))
+	assert.Equal(t, "en-US", Language(r, "en-US", "fr"))
+	assert.Equal(t, "da", Language(r, "en", "da"))
+	assert.Equal(t, "", Language(r, "fr", "de"))
+	assert.Equal(t, "", Language(withHeader("Accept-Language", "en"), "eng"))
+
+	r = withHeader("Accept-Language", "fr;q=0.5, *;q=0.1, de;q=0")
+	assert.Equal(t, "fr-CA", Language(r, "de-AT", "fr-CA"))
+	assert.Equal(t, "it", Language(r, "de", "it"))
+
+	assert.Equal(t, "en", Language(servertest.NewRequest("GET", "/").Request(), "en", "fr"))
+}
+
+func TestCharset(t *testing.T) {
+	r := withHeader("Accept-Charset", "iso-8859-5, UTF-8;q=0.8")
+	assert.Equal(t, "iso-8859-5", Charset(r, "utf-8", "iso-8859-5"))
+	assert.Equal(t, "utf-8", Charset(r, "utf-8", "us-ascii"))
+	assert.Equal(t, "", Charset(r, "us-ascii"))
+	assert.Equal(t, "us-ascii", Charset(withHeader("Accept-Charset", "*"), "us-ascii"))
+}
+
+func TestByType(t *testing.T) {
+	send := func(body string) func(w response.Writer, r *request.Request) {
+		return func(w response.Writer, r *request.Request) {
+			h := response.GetDefaultHeaders(len(body), "text/plain")
+			h.Set("vary", "Accept-Encoding")
+			w.WriteStatusLine(response.Ok)
+			w.WriteHeaders(h)
+			w.WriteBody([]byte(body))
+		}
+	}
+	h := ByType(
+		Offer{Type: "text/html", Handler: send("html")},
+		Offer{Type: "application/json", Handler: send("json")},
+		Offer{Type: "text/csv", Handler: send("csv")},
+	)
+
+	rec := servertest.NewRecorder()
+	h(rec, withHeader("Accept", "text/csv, */*;q=0.1"))
+	assert.Equal(t, "csv", rec.Body.String())
+	assert.Equal(t, "Accept-Encoding, Accept", rec.Header("Vary"))
+
+	rec = servertest.NewRecorder()
+	h(rec, withHeader("Accept", "image/webp"))
+	assert.Equal(t, response.NotAcceptable, rec.Code)
+	assert.Equal(t, "Accept", rec.Header("Vary"))
+	assert.Contains(t, rec.Body.String(), "text/html, application/json, text/csv")
+}
@@ -0,0 +1,491 @@
+// Package nethttp adapts between this server's handlers and net/http, so
+// existing net/http handlers and middleware can run on server.Server and
+// server.Handlers can be mounted on an http.Server.
+package nethttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// MaxBodySize bounds the request body ToHTTP reads into memory, since
+// request.Request carries the whole body.
+const MaxBodySize = 10 << 20
+
+// bufferSize is how much body FromHTTP holds back before committing to a
+// chunked response; a handler that writes less gets a content-length.
+const bufferSize = 4096
+
+// FromHTTP runs an http.Handler as a server.Handler.
+func FromHTTP(h http.Handler) server.Handler {
+	return func(w response.Writer, r *request.Request) {
+
+		req, err := NewHTTPRequest(r)
+		if err != nil {
+			server.HandlerError{
+				StatusCode: response.BadRequest,
+				Message:    "Bad Request",
+			}.Write(w)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		req = req.WithContext(ctx)
+
+		hw := &httpResponseWriter{w: w, header: http.Header{}, head: req.Method == "HEAD"}
+		h.ServeHTTP(hw, req)
+
+		err = hw.finish()
+		if err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+}
+
+// NewHTTPRequest builds the *http.Request net/http handlers expect from a
+// parsed request.
+func NewHTTPRequest(r *request.Request) (*http.Request, error) {
+
+	u, err := parseTarget(r.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method:        r.RequestLine.Method,
+		URL:           u,
+		RequestURI:    r.RequestLine.RequestTarget,
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		RemoteAddr:    r.RemoteAddr,
+		TLS:           r.TLS,
+	}
+	ctx := context.Background()
+	if local, err := netip.ParseAddrPort(r.LocalAddr); err == nil {
+		ctx = context.WithValue(ctx, http.LocalAddrContextKey, net.TCPAddrFromAddrPort(local))
+	}
+	req = req.WithContext(ctx)
+
+	switch r.RequestLine.HttpVersion {
+	case "2":
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	default:
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+
+	for k := range r.Headers {
+		name := strings.ToLower(k)
+		if name == "host" {
+			req.Host, _ = r.Headers.GetString(k)
+			continue
+		}
+		for _, v := range r.Headers.Values(k) {
+			req.Header.Add(name, v)
+		}
+	}
+	if req.Host == "" {
+		req.Host = u.Host
+	}
+	if len(r.Body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	return req, nil
+}
+
+func parseTarget(target string) (*url.URL, error) {
+	if target == "*" {
+		return &url.URL{Path: "*"}, nil
+	}
+	return url.ParseRequestURI(target)
+}
+
+// httpResponseWriter is the http.ResponseWriter handed to net/http
+// handlers. Like net/http it holds back small bodies so they go out with a
+// content-length, and switches to chunked encoding once the body outgrows
+// the buffer or the handler flushes.
+type httpResponseWriter struct {
+	w      response.Writer
+	header http.Header
+	head   bool
+
+	status      int
+	wroteHeader bool
+	committed   bool
+	chunked     bool
+	hijacked    bool
+	buf         bytes.Buffer
+	// trailers are the names announced in the Trailer header when the
+	// headers went out.
+	trailers []string
+}
+
+func (hw *httpResponseWriter) Header() http.Header {
+	return hw.header
+}
+
+func (hw *httpResponseWriter) WriteHeader(code int) {
+	if hw.wroteHeader || hw.hijacked {
+		return
+	}
+	// informational responses have no place in response.Writer's sequence,
+	// apart from 101 which is followed by a hijack
+	if code < 200 && code != http.StatusSwitchingProtocols {
+		return
+	}
+	hw.status = code
+	hw.wroteHeader = true
+
+	if code == http.StatusSwitchingProtocols {
+		err := hw.commit(false)
+		if err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+}
+
+func (hw *httpResponseWriter) Write(p []byte) (int, error) {
+	if hw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowed(hw.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+
+	if !hw.committed {
+		if hw.buf.Len()+len(p) <= bufferSize {
+			return hw.buf.Write(p)
+		}
+		err := hw.commit(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if hw.head {
+		return len(p), nil
+	}
+	if hw.chunked {
+		return hw.w.WriteChunkedBody(p)
+	}
+	return hw.w.WriteBody(p)
+}
+
+// Flush sends the headers and any buffered body straight away.
+func (hw *httpResponseWriter) Flush() {
+	if hw.hijacked {
+		return
+	}
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.committed {
+		err := hw.commit(true)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+	}
+	err := response.Flush(hw.w)
+	if err != nil && !errors.Is(err, response.ErrNotFlushable) {
+		fmt.Println("Error:", err)
+	}
+}
+
+func (hw *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := response.Hijack(hw.w)
+	if err != nil {
+		return nil, nil, err
+	}
+	hw.hijacked = true
+	return conn, rw, nil
+}
+
+// commit writes the status line and headers, followed by whatever body has
+// been buffered. more says whether the handler may still write, in which
+// case a body without a declared length has to be chunked.
+func (hw *httpResponseWriter) commit(more bool) error {
+
+	hw.committed = true
+	h := headers.NewHeaders()
+	for k, vs := range hw.header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		switch name {
+		case "connection", "transfer-encoding", "trailer":
+			continue
+		}
+		for _, v := range vs {
+			h.Add(name, v)
+		}
+	}
+
+	for _, v := range hw.header.Values("Trailer") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				hw.trailers = append(hw.trailers, name)
+			}
+		}
+	}
+
+	if bodyAllowed(hw.status) && hw.status != http.StatusSwitchingProtocols {
+		_, known := h["content-length"]
+		switch {
+		case !known && !hw.head && (more || len(hw.trailers) > 0):
+			hw.chunked = true
+			h.Set("transfer-encoding", "chunked")
+			if len(hw.trailers) > 0 {
+				h.Set("trailer", strings.Join(hw.trailers, ", "))
+			}
+		case !known && !hw.head:
+			h.Set("content-length", strconv.Itoa(hw.buf.Len()))
+		}
+		if _, ok := h["content-type"]; !ok && hw.buf.Len() > 0 {
+			h.Set("content-type", http.DetectContentType(hw.buf.Bytes()))
+		}
+	}
+
+	err := hw.w.WriteStatusLine(response.StatusCode(hw.status))
+	if err != nil {
+		return err
+	}
+	err = hw.w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+
+	if hw.buf.Len() == 0 || hw.head {
+		return nil
+	}
+	if hw.chunked {
+		_, err = hw.w.WriteChunkedBody(hw.buf.Bytes())
+	} else {
+		_, err = hw.w.WriteBody(hw.buf.Bytes())
+	}
+	hw.buf.Reset()
+	return err
+}
+
+// finish completes the response once the handler has returned.
+func (hw *httpResponseWriter) finish() error {
+
+	if hw.hijacked {
+		return nil
+	}
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.committed {
+		err := hw.commit(false)
+		if err != nil {
+			return err
+		}
+	}
+	if !hw.chunked {
+		return nil
+	}
+
+	trailers := headers.NewHeaders()
+	for _, name := range hw.trailers {
+		for _, v := range hw.header.Values(name) {
+			trailers.Add(strings.ToLower(name), v)
+		}
+	}
+	for k, vs := range hw.header {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		for _, v := range vs {
+			trailers.Add(strings.ToLower(strings.TrimPrefix(k, http.TrailerPrefix)), v)
+		}
+	}
+	if len(trailers) > 0 {
+		return hw.w.WriteTrailers(trailers)
+	}
+	_, err := hw.w.WriteChunkedBodyDone()
+	return err
+}
+
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// ToHTTP exposes a server.Handler as an http.Handler.
+func ToHTTP(h server.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		req, err := NewRequest(r)
+		if err != nil {
+			status := http.StatusBadRequest
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		h(&responseWriter{w: w}, req)
+	})
+}
+
+// NewRequest reads r, body included, into a request.Request. Bodies over
+// MaxBodySize fail with an *http.MaxBytesError.
+func NewRequest(r *http.Request) (*request.Request, error) {
+
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, MaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	version := fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+	if r.ProtoMajor == 2 {
+		version = "2"
+	}
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   version,
+			RequestTarget: target,
+			Method:        r.Method,
+		},
+		Headers:    headers.NewHeaders(),
+		Body:       body,
+		RemoteAddr: r.RemoteAddr,
+		TLS:        r.TLS,
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		req.LocalAddr = local.String()
+	}
+	if r.Host != "" {
+		req.Headers.Set("host", r.Host)
+	}
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			req.Headers.Add(strings.ToLower(k), v)
+		}
+	}
+
+	return req, nil
+}
+
+// responseWriter is the response.Writer handed to server.Handlers running
+// under net/http. net/http does its own framing, so chunked writes are
+// plain writes and connection management headers are left to it.
+type responseWriter struct {
+	w      http.ResponseWriter
+	status int
+	state  response.WriterState
+}
+
+func (rw *responseWriter) WriteStatusLine(statusCode response.StatusCode) error {
+	if rw.state != response.StateStatusLine {
+		return fmt.Errorf("Error: status line already written, state: %d", rw.state)
+	}
+	rw.status = statusCode.GetCode()
+	rw.state = response.StateHeaders
+	return nil
+}
+
+func (rw *responseWriter) WriteHeaders(h headers.Headers) error {
+	if rw.state != response.StateHeaders {
+		return fmt.Errorf("Error: headers written out of order, state: %d", rw.state)
+	}
+
+	header := rw.w.Header()
+	chunked := false
+	for k := range h {
+		switch strings.ToLower(k) {
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(h[k]), "chunked")
+			continue
+		case "connection", "keep-alive":
+			continue
+		}
+		for _, v := range strings.Split(h[k], "\n") {
+			header.Add(k, v)
+		}
+	}
+	rw.w.WriteHeader(rw.status)
+	rw.state = response.StateBody
+
+	// flushing now stops net/http from buffering a short chunked body into
+	// a content-length response, which would have no room for trailers
+	if chunked {
+		return rw.Flush()
+	}
+	return nil
+}
+
+func (rw *responseWriter) WriteBody(p []byte) (int, error) {
+	if rw.state != response.StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", rw.state)
+	}
+	return rw.w.Write(p)
+}
+
+func (rw *responseWriter) WriteChunkedBody(p []byte) (int, error) {
+	return rw.WriteBody(p)
+}
+
+func (rw *responseWriter) WriteChunkedBodyDone() (int, error) {
+	if rw.state != response.StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", rw.state)
+	}
+	rw.state = response.StateDone
+	return 0, nil
+}
+
+func (rw *responseWriter) WriteTrailers(h headers.Headers) error {
+	if rw.state != response.StateBody {
+		return fmt.Errorf("Error: trailers written before headers, state: %d", rw.state)
+	}
+
+	header := rw.w.Header()
+	for k := range h {
+		for _, v := range strings.Split(h[k], "\n") {
+			header.Add(http.TrailerPrefix+k, v)
+		}
+	}
+	rw.state = response.StateDone
+	return nil
+}
+
+func (rw *responseWriter) Flush() error {
+	return http.NewResponseController(rw.w).Flush()
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.w).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.state = response.StateHijacked
+	return conn, brw, nil
+}
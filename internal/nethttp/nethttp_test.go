@@ -0,0 +1,167 @@
+package nethttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveFromHTTP(t *testing.T, h http.Handler, raw string) *http.Response {
+	t.Helper()
+	r, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	FromHTTP(h)(response.NewWriter(buf), r)
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestFromHTTP_Request(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	})
+
+	serveFromHTTP(t, h, "POST /items?id=7 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"X-Tag: a\r\n"+
+		"X-Tag: b\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"hello")
+
+	require.NotNil(t, got)
+	assert.Equal(t, "POST", got.Method)
+	assert.Equal(t, "/items", got.URL.Path)
+	assert.Equal(t, "7", got.URL.Query().Get("id"))
+	assert.Equal(t, "/items?id=7", got.RequestURI)
+	assert.Equal(t, "example.com", got.Host)
+	assert.Equal(t, "", got.Header.Get("Host"))
+	assert.Equal(t, "a, b", got.Header.Get("X-Tag"))
+	assert.Equal(t, 1, got.ProtoMajor)
+	assert.Equal(t, int64(5), got.ContentLength)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestFromHTTP_Response(t *testing.T) {
+
+	// Test: a small body is sent with a content-length and sniffed type
+	resp := serveFromHTTP(t, http.NotFoundHandler(), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.Equal(t, "404 Not Found", resp.Status)
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	assert.Equal(t, "404 page not found\n", string(body))
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	// Test: a large body is chunked
+	big := strings.Repeat("x", 3*bufferSize)
+	resp = serveFromHTTP(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, big)
+	}), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, big, string(body))
+
+	// Test: trailers announced up front and set with the prefix
+	resp = serveFromHTTP(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "data")
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Extra", "1")
+	}), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, 202, resp.StatusCode)
+	assert.Equal(t, "data", string(body))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	assert.Equal(t, "1", resp.Trailer.Get("X-Extra"))
+
+	// Test: nothing written at all
+	resp = serveFromHTTP(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int64(0), resp.ContentLength)
+}
+
+func TestToHTTP(t *testing.T) {
+	var got *request.Request
+	h := func(w response.Writer, r *request.Request) {
+		got = r
+		w.WriteStatusLine(response.Ok)
+		h := headers.NewHeaders()
+		h.Set("content-type", "text/plain")
+		h.Set("transfer-encoding", "chunked")
+		h.Set("connection", "close")
+		h.Add("set-cookie", "a=1")
+		h.Add("set-cookie", "b=2")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("part one, "))
+		w.WriteChunkedBody([]byte("part two"))
+		tr := headers.NewHeaders()
+		tr.Set("x-content-sha256", "123")
+		w.WriteTrailers(tr)
+	}
+
+	srv := httptest.NewServer(ToHTTP(h))
+	defer srv.Close()
+
+	req, err := http.NewRequest("PUT", srv.URL+"/upload?x=1", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Add("X-Tag", "a")
+	req.Header.Add("X-Tag", "b")
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.NotNil(t, got)
+	assert.Equal(t, "PUT", got.RequestLine.Method)
+	assert.Equal(t, "/upload?x=1", got.RequestLine.RequestTarget)
+	assert.Equal(t, "1.1", got.RequestLine.HttpVersion)
+	assert.Equal(t, "payload", string(got.Body))
+	tag, _ := got.Headers.GetString("x-tag")
+	assert.Equal(t, "a, b", tag)
+	host, _ := got.Headers.GetString("host")
+	assert.Equal(t, strings.TrimPrefix(srv.URL, "http://"), host)
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "part one, part two", string(body))
+	assert.Equal(t, []string{"a=1", "b=2"}, resp.Header.Values("Set-Cookie"))
+	assert.False(t, resp.Close)
+	assert.Equal(t, "123", resp.Trailer.Get("X-Content-Sha256"))
+}
+
+func TestToHTTP_BodyTooLarge(t *testing.T) {
+	called := false
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", io.LimitReader(zeros{}, MaxBodySize+1))
+
+	ToHTTP(func(w response.Writer, r *request.Request) { called = true }).ServeHTTP(rec, req)
+	assert.False(t, called)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
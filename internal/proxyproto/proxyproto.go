@@ -0,0 +1,250 @@
+// Package proxyproto reads the PROXY protocol header a load balancer sends
+// ahead of the client's bytes, naming the client it is relaying for. Both
+// the v1 text and v2 binary forms are supported.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// maxV1Length is the longest a v1 header can be, line ending included.
+const maxV1Length = 107
+
+var v1Prefix = []byte("PROXY ")
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrNoHeader = fmt.Errorf("Error: connection did not start with a PROXY protocol header")
+var ErrInvalidHeader = fmt.Errorf("Error: malformed PROXY protocol header")
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	Version int
+	// Local is set for connections the proxy made on its own behalf, e.g.
+	// health checks, and for v1 UNKNOWN. They carry no addresses, and the
+	// connection's own should be used.
+	Local       bool
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Read reads a v1 or v2 header from the start of br.
+func Read(br *bufio.Reader) (*Header, error) {
+
+	sig, err := br.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, v2Signature):
+		return readV2(br)
+	case bytes.HasPrefix(sig, v1Prefix):
+		return readV1(br)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+func readV1(br *bufio.Reader) (*Header, error) {
+
+	var line []byte
+	for i := 1; ; i++ {
+		if i > maxV1Length {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+		}
+		peeked, err := br.Peek(i)
+		if err != nil {
+			return nil, err
+		}
+		if peeked[i-1] == '\n' {
+			line = peeked
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header ends in a bare LF", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	switch {
+	case len(fields) >= 2 && fields[1] == "UNKNOWN":
+		h.Local = true
+	case len(fields) == 6 && (fields[1] == "TCP4" || fields[1] == "TCP6"):
+		src, err := parseV1Addr(fields[1], fields[2], fields[4])
+		if err != nil {
+			return nil, err
+		}
+		dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+		if err != nil {
+			return nil, err
+		}
+		h.Source = net.TCPAddrFromAddrPort(src)
+		h.Destination = net.TCPAddrFromAddrPort(dst)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+
+	br.Discard(len(line))
+	return h, nil
+}
+
+func parseV1Addr(proto, ip, port string) (netip.AddrPort, error) {
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Zone() != "" || (proto == "TCP4") != addr.Is4() {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad %s address %q", ErrInvalidHeader, proto, ip)
+	}
+	// ports are 0-65535 without leading zeros or signs
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// v2 command, address family and transport protocol values.
+const (
+	cmdLocal  = 0x0
+	cmdProxy  = 0x1
+	afInet    = 0x1
+	afInet6   = 0x2
+	afUnix    = 0x3
+	protoTCP  = 0x1
+	protoUDP  = 0x2
+	v2Fixed   = 16
+	v2Version = 0x2
+)
+
+func readV2(br *bufio.Reader) (*Header, error) {
+
+	fixed, err := br.Peek(v2Fixed)
+	if err != nil {
+		return nil, err
+	}
+	version, command := fixed[12]>>4, fixed[12]&0x0f
+	family, proto := fixed[13]>>4, fixed[13]&0x0f
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+
+	if version != v2Version {
+		return nil, fmt.Errorf("%w: v2 header with version %d", ErrInvalidHeader, version)
+	}
+	if command != cmdLocal && command != cmdProxy {
+		return nil, fmt.Errorf("%w: v2 header with command %d", ErrInvalidHeader, command)
+	}
+	if v2Fixed+length > br.Size() {
+		return nil, fmt.Errorf("%w: v2 header of %d bytes", ErrInvalidHeader, length)
+	}
+	full, err := br.Peek(v2Fixed + length)
+	if err != nil {
+		return nil, err
+	}
+	payload := full[v2Fixed:]
+
+	h := &Header{Version: 2, Local: command == cmdLocal}
+	if !h.Local {
+		h.Source, h.Destination, err = v2Addrs(family, proto, payload)
+		if err != nil {
+			return nil, err
+		}
+		// unspecified or unix sockets name no address worth using
+		h.Local = h.Source == nil
+	}
+
+	// any TLVs after the addresses are skipped
+	br.Discard(len(full))
+	return h, nil
+}
+
+func v2Addrs(family, proto byte, payload []byte) (src, dst net.Addr, err error) {
+
+	var size int
+	switch family {
+	case afInet:
+		size = 4
+	case afInet6:
+		size = 16
+	case afUnix:
+		if len(payload) < 216 {
+			return nil, nil, fmt.Errorf("%w: v2 unix addresses truncated", ErrInvalidHeader)
+		}
+		return nil, nil, nil
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, fmt.Errorf("%w: v2 addresses truncated", ErrInvalidHeader)
+	}
+
+	srcIP, _ := netip.AddrFromSlice(payload[:size])
+	dstIP, _ := netip.AddrFromSlice(payload[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(payload[2*size:])
+	dstPort := binary.BigEndian.Uint16(payload[2*size+2:])
+	srcAddr := netip.AddrPortFrom(srcIP, srcPort)
+	dstAddr := netip.AddrPortFrom(dstIP, dstPort)
+
+	switch proto {
+	case protoTCP:
+		return net.TCPAddrFromAddrPort(srcAddr), net.TCPAddrFromAddrPort(dstAddr), nil
+	case protoUDP:
+		return net.UDPAddrFromAddrPort(srcAddr), net.UDPAddrFromAddrPort(dstAddr), nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// Conn is a connection that reports the addresses from a PROXY header
+// instead of the load balancer's.
+type Conn struct {
+	net.Conn
+	header *Header
+}
+
+// NewConn wraps conn so RemoteAddr and LocalAddr come from h, unless h is
+// Local.
+func NewConn(conn net.Conn, h *Header) *Conn {
+	return &Conn{Conn: conn, header: h}
+}
+
+// Header is the PROXY header the connection started with.
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Local {
+		return c.Conn.RemoteAddr()
+	}
+	return c.header.Source
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Local {
+		return c.Conn.LocalAddr()
+	}
+	return c.header.Destination
+}
+
+// Trusted reports whether addr is in one of the prefixes.
+func Trusted(addr net.Addr, prefixes []netip.Prefix) bool {
+
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func read(raw string) (*Header, string, error) {
+	br := bufio.NewReader(strings.NewReader(raw))
+	h, err := Read(br)
+	rest, _ := io.ReadAll(br)
+	return h, string(rest), err
+}
+
+func v2(command, family byte, payload []byte) string {
+	fixed := append([]byte(nil), v2Signature...)
+	fixed = append(fixed, 0x20|command, family)
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(payload)))
+	return string(append(fixed, payload...))
+}
+
+func TestReadV1(t *testing.T) {
+	h, rest, err := read("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Version)
+	assert.False(t, h.Local)
+	assert.Equal(t, "192.0.2.10:56324", h.Source.String())
+	assert.Equal(t, "198.51.100.1:443", h.Destination.String())
+	assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+
+	h, _, err = read("PROXY TCP6 2001:db8::1 2001:db8::2 1 65535\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1", h.Source.String())
+
+	// Test: UNKNOWN ignores the rest of the line
+	h, rest, err = read("PROXY UNKNOWN ffff::1 whatever\r\nrest")
+	require.NoError(t, err)
+	assert.True(t, h.Local)
+	assert.Equal(t, "rest", rest)
+
+	invalid := []string{
+		"PROXY TCP4 192.0.2.10 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n",
+		"PROXY TCP6 192.0.2.10 2001:db8::2 1 2\r\n",
+		"PROXY TCP4 192.0.2.10 198.51.100.1 056324 443\r\n",
+		"PROXY TCP4 192.0.2.10 198.51.100.1 65536 443\r\n",
+		"PROXY TCP4  192.0.2.10 198.51.100.1 1 443\r\n",
+		"PROXY UDP4 192.0.2.10 198.51.100.1 1 443\r\n",
+		"PROXY TCP4 192.0.2.10 198.51.100.1 1 443\n",
+		"PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n",
+	}
+	for _, raw := range invalid {
+		_, _, err := read(raw)
+		assert.ErrorIs(t, err, ErrInvalidHeader, raw)
+	}
+
+	_, _, err = read("GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	assert.ErrorIs(t, err, ErrNoHeader)
+}
+
+func TestReadV2(t *testing.T) {
+	payload := []byte{192, 0, 2, 10, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	tlv := []byte{0x04, 0x00, 0x01, 'x'}
+
+	h, rest, err := read(v2(cmdProxy, afInet<<4|protoTCP, append(payload, tlv...)) + "GET")
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.False(t, h.Local)
+	assert.Equal(t, "192.0.2.10:56324", h.Source.String())
+	assert.Equal(t, "198.51.100.1:443", h.Destination.String())
+	assert.IsType(t, &net.TCPAddr{}, h.Source)
+	assert.Equal(t, "GET", rest)
+
+	ip6 := make([]byte, 36)
+	ip6[0], ip6[1], ip6[15] = 0x20, 0x01, 1
+	h, _, err = read(v2(cmdProxy, afInet6<<4|protoTCP, ip6))
+	require.NoError(t, err)
+	assert.Equal(t, "[2001::1]:0", h.Source.String())
+
+	// Test: health checks from the proxy itself
+	h, rest, err = read(v2(cmdLocal, 0, nil) + "GET")
+	require.NoError(t, err)
+	assert.True(t, h.Local)
+	assert.Equal(t, "GET", rest)
+
+	// Test: unix sockets name no usable address
+	h, _, err = read(v2(cmdProxy, afUnix<<4|protoTCP, make([]byte, 216)))
+	require.NoError(t, err)
+	assert.True(t, h.Local)
+
+	_, _, err = read(v2(cmdProxy, afInet<<4|protoTCP, payload[:8]))
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+	_, _, err = read(v2(0x2, afInet<<4|protoTCP, payload))
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+
+	// Test: a header cut short by the connection closing
+	_, _, err = read(v2(cmdProxy, afInet<<4|protoTCP, payload)[:20])
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	h, _, err := read("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n")
+	require.NoError(t, err)
+	conn := NewConn(server, h)
+	assert.Equal(t, "192.0.2.10:56324", conn.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.1:443", conn.LocalAddr().String())
+
+	conn = NewConn(server, &Header{Version: 2, Local: true})
+	assert.Equal(t, server.RemoteAddr(), conn.RemoteAddr())
+}
+
+func TestTrusted(t *testing.T) {
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+
+	assert.True(t, Trusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}, prefixes))
+	assert.True(t, Trusted(&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 80}, prefixes))
+	assert.True(t, Trusted(&net.TCPAddr{IP: net.ParseIP("2001:db8::5"), Port: 80}, prefixes))
+	assert.False(t, Trusted(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}, prefixes))
+	assert.False(t, Trusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}, nil))
+
+	client, _ := net.Pipe()
+	assert.False(t, Trusted(client.RemoteAddr(), prefixes))
+}
@@ -0,0 +1,263 @@
+// Package ratelimit limits how fast each client may send requests, with a
+// token bucket per client. Clients over their limit get a 429.
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// sweepInterval is how often buckets are checked for eviction.
+const sweepInterval = time.Minute
+
+// DefaultMaxBuckets is how many buckets a Limiter holds unless told
+// otherwise.
+const DefaultMaxBuckets = 100_000
+
+// Limit is a token bucket: it holds up to Burst tokens and refills at Rate
+// tokens per second. Each request takes one token. A zero Rate means no
+// limit.
+type Limit struct {
+	Rate float64
+	// Burst is how many requests may arrive at once. Zero means Rate,
+	// rounded up.
+	Burst int
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// KeyFunc names the client a request comes from. Requests with the same
+// key share a bucket.
+type KeyFunc func(r *request.Request) string
+
+// ByRemoteIP keys requests by the client's IP address.
+func ByRemoteIP(r *request.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ByHeader keys requests by a header, e.g. an API key. Requests without
+// it, or whose value valid rejects, fall back to their IP address.
+//
+// Clients choose what they send, so without valid every made-up value
+// gets a fresh bucket of its own. Pass nil only if middleware in front
+// already turns away requests with unknown keys.
+func ByHeader(name string, valid func(string) bool) KeyFunc {
+	name = strings.ToLower(name)
+	return func(r *request.Request) string {
+		v, err := r.Headers.GetString(name)
+		if err != nil || v == "" || (valid != nil && !valid(v)) {
+			return "ip:" + ByRemoteIP(r)
+		}
+		return "key:" + v
+	}
+}
+
+type Options struct {
+	// Limit applies to requests no route matches.
+	Limit Limit
+	// Routes gives paths their own limits, keyed by path prefix. The
+	// longest matching prefix wins, and each route has its own buckets.
+	Routes map[string]Limit
+	// Key names the client. Nil means ByRemoteIP.
+	Key KeyFunc
+	// MaxBuckets caps the buckets held, however many clients there are.
+	// Past it the least recently used bucket goes, and its client starts
+	// over with a full one. Zero means DefaultMaxBuckets.
+	MaxBuckets int
+}
+
+// Limiter holds a bucket for every client seen recently, least recently
+// used at the back of lru. Buckets that have refilled are dropped, since a
+// new one would be the same.
+type Limiter struct {
+	opts Options
+	now  func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*list.Element
+	lru       *list.List
+	lastSweep time.Time
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next token, when Allowed is false.
+	RetryAfter time.Duration
+}
+
+func New(opts Options) *Limiter {
+	if opts.Key == nil {
+		opts.Key = ByRemoteIP
+	}
+	if opts.MaxBuckets <= 0 {
+		opts.MaxBuckets = DefaultMaxBuckets
+	}
+	return &Limiter{
+		opts:    opts,
+		now:     time.Now,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Middleware answers requests over their limit with a 429, and tells every
+// client where it stands in RateLimit-* headers.
+func (l *Limiter) Middleware(next server.Handler) server.Handler {
+	return func(w response.Writer, r *request.Request) {
+
+		route, limit := l.route(r)
+		if limit.Rate <= 0 {
+			next(w, r)
+			return
+		}
+
+		res := l.Take(route+"\x00"+l.opts.Key(r), limit)
+		h := res.headers()
+		if !res.Allowed {
+			h.Set("retry-after", strconv.Itoa(seconds(res.RetryAfter)))
+			he := server.HandlerError{StatusCode: response.TooManyRequests, Message: "Too Many Requests", Headers: h}
+			he.Write(w)
+			return
+		}
+
+		next(response.BeforeHeaders(w, func(out headers.Headers) {
+			for k, v := range h {
+				out.Set(k, v)
+			}
+		}), r)
+	}
+}
+
+// Take takes a token from the bucket for key, creating it if need be.
+func (l *Limiter) Take(key string, limit Limit) Result {
+
+	now := l.now()
+	burst := limit.burst()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	var b *bucket
+	if elem, ok := l.buckets[key]; ok {
+		b = elem.Value.(*bucket)
+		l.lru.MoveToFront(elem)
+	} else {
+		if l.lru.Len() >= l.opts.MaxBuckets {
+			l.remove(l.lru.Back())
+		}
+		b = &bucket{key: key, tokens: burst, last: now, limit: limit}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	b.refill(now)
+
+	res := Result{Limit: int(burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = duration((1 - b.tokens) / limit.Rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = duration((burst - b.tokens) / limit.Rate)
+	return res
+}
+
+// Len is the number of buckets held.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+elapsed*b.limit.Rate)
+		b.last = now
+	}
+}
+
+// sweep drops full buckets, at most once every sweepInterval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for _, elem := range l.buckets {
+		b := elem.Value.(*bucket)
+		b.refill(now)
+		if b.tokens >= b.limit.burst() {
+			l.remove(elem)
+		}
+	}
+}
+
+// remove drops a bucket. l.mu must be held.
+func (l *Limiter) remove(elem *list.Element) {
+	l.lru.Remove(elem)
+	delete(l.buckets, elem.Value.(*bucket).key)
+}
+
+func (l *Limiter) route(r *request.Request) (string, Limit) {
+
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	best := ""
+	limit := l.opts.Limit
+	for prefix, routeLimit := range l.opts.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(best) {
+			best = prefix
+			limit = routeLimit
+		}
+	}
+	return best, limit
+}
+
+func (res Result) headers() headers.Headers {
+	h := headers.NewHeaders()
+	h.Set("ratelimit-limit", strconv.Itoa(res.Limit))
+	h.Set("ratelimit-remaining", strconv.Itoa(res.Remaining))
+	h.Set("ratelimit-reset", strconv.Itoa(seconds(res.Reset)))
+	return h
+}
+
+func duration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// seconds rounds d up to whole seconds, as the headers want.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLimiter(opts Options) (*Limiter, *servertest.Clock) {
+	l, clock := New(opts), servertest.NewClock()
+	l.now = clock.Now
+	return l, clock
+}
+
+func ok(w response.Writer, r *request.Request) {
+	w.WriteStatusLine(response.Ok)
+	w.WriteHeaders(response.GetDefaultHeaders(0, "text/plain"))
+}
+
+func TestMiddleware(t *testing.T) {
+	l, clock := newTestLimiter(Options{Limit: Limit{Rate: 1, Burst: 2}})
+	handler := l.Middleware(ok)
+
+	get := func(remoteAddr string) *servertest.ResponseRecorder {
+		return servertest.Do(handler, servertest.NewRequest("GET", "/").RemoteAddr(remoteAddr))
+	}
+
+	rec := get("192.0.2.1:1000")
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "2", rec.Header("RateLimit-Limit"))
+	assert.Equal(t, "1", rec.Header("RateLimit-Remaining"))
+	assert.Equal(t, "1", rec.Header("RateLimit-Reset"))
+
+	// Test: the port doesn't matter, the burst is shared
+	rec = get("192.0.2.1:2000")
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "0", rec.Header("RateLimit-Remaining"))
+
+	rec = get("192.0.2.1:1000")
+	assert.Equal(t, response.TooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header("Retry-After"))
+	assert.Equal(t, "0", rec.Header("RateLimit-Remaining"))
+	assert.Equal(t, "2", rec.Header("RateLimit-Reset"))
+
+	// Test: other clients have their own bucket
+	assert.Equal(t, response.Ok, get("198.51.100.7:1000").Code)
+
+	// Test: tokens come back over time
+	clock.Advance(1500 * time.Millisecond)
+	assert.Equal(t, response.Ok, get("192.0.2.1:1000").Code)
+	assert.Equal(t, response.TooManyRequests, get("192.0.2.1:1000").Code)
+}
+
+func TestRoutes(t *testing.T) {
+	l, _ := newTestLimiter(Options{
+		Routes: map[string]Limit{
+			"/api/":       {Rate: 1},
+			"/api/login/": {Rate: 0.1},
+		},
+	})
+	handler := l.Middleware(ok)
+	get := func(target string) response.StatusCode {
+		return servertest.Do(handler, servertest.NewRequest("GET", target)).Code
+	}
+
+	// Test: no limit outside the routes
+	for range 5 {
+		assert.Equal(t, response.Ok, get("/static/app.js"))
+	}
+
+	assert.Equal(t, response.Ok, get("/api/items"))
+	assert.Equal(t, response.TooManyRequests, get("/api/users?page=2"))
+
+	// Test: the longer prefix has its own bucket
+	assert.Equal(t, response.Ok, get("/api/login/"))
+	assert.Equal(t, response.TooManyRequests, get("/api/login/"))
+}
+
+func TestByHeader(t *testing.T) {
+	valid := func(key string) bool { return key == "alpha" || key == "beta" }
+	l, _ := newTestLimiter(Options{Limit: Limit{Rate: 1}, Key: ByHeader("X-API-Key", valid)})
+	handler := l.Middleware(ok)
+	get := func(key string) response.StatusCode {
+		b := servertest.NewRequest("GET", "/")
+		if key != "" {
+			b.Header("X-Api-Key", key)
+		}
+		return servertest.Do(handler, b).Code
+	}
+
+	assert.Equal(t, response.Ok, get("alpha"))
+	assert.Equal(t, response.TooManyRequests, get("alpha"))
+	assert.Equal(t, response.Ok, get("beta"))
+
+	// Test: no key falls back to the address
+	assert.Equal(t, response.Ok, get(""))
+	assert.Equal(t, response.TooManyRequests, get(""))
+
+	// Test: so do made-up keys, rather than each getting a bucket
+	assert.Equal(t, response.TooManyRequests, get("gamma"))
+	assert.Equal(t, response.TooManyRequests, get("delta"))
+}
+
+func TestMaxBuckets(t *testing.T) {
+	l, _ := newTestLimiter(Options{MaxBuckets: 3})
+	limit := Limit{Rate: 1, Burst: 1}
+
+	for _, key := range []string{"a", "b", "c"} {
+		l.Take(key, limit)
+	}
+	// a is used again, so b is the least recently used
+	assert.False(t, l.Take("a", limit).Allowed)
+	l.Take("d", limit)
+	assert.Equal(t, 3, l.Len())
+
+	// Test: a and c kept their drained buckets, b starts over
+	assert.False(t, l.Take("a", limit).Allowed)
+	assert.False(t, l.Take("c", limit).Allowed)
+	assert.True(t, l.Take("b", limit).Allowed)
+}
+
+func TestEviction(t *testing.T) {
+	l, clock := newTestLimiter(Options{})
+	limit := Limit{Rate: 10, Burst: 10}
+
+	for i := range 100 {
+		require.True(t, l.Take(fmt.Sprint(i), limit).Allowed)
+	}
+	assert.Equal(t, 100, l.Len())
+
+	// Test: refilled buckets are dropped at the next sweep
+	clock.Advance(sweepInterval)
+	l.Take("new", limit)
+	assert.Equal(t, 1, l.Len())
+
+	// Test: a drained bucket survives a sweep until it refills
+	slow := Limit{Rate: 0.01, Burst: 10}
+	for range 10 {
+		l.Take("busy", slow)
+	}
+	clock.Advance(sweepInterval)
+	l.Take("other", limit)
+	assert.Equal(t, 2, l.Len())
+}
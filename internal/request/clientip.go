@@ -0,0 +1,93 @@
+package request
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// ClientIP is the address of the client the request started from. Proxies
+// in trusted are looked through: header, the one they set, is read from
+// the right, hop by hop, until an address that isn't a trusted proxy.
+// "Forwarded" is read as RFC 7239 has it; any other header, such as
+// "X-Forwarded-For", as a comma-separated list of addresses. Headers from
+// anyone else are ignored, since clients can put whatever they like in
+// them.
+//
+// Only header is read. The proxies have to set it, and it alone: a client
+// can send a header the proxies don't know to strip, so falling back from
+// one to another would let it pick its own address.
+//
+// The result is invalid if RemoteAddr isn't an IP address, e.g. over a
+// net.Pipe.
+func (r *Request) ClientIP(trusted []netip.Prefix, header string) netip.Addr {
+
+	peer, ok := parseNode(r.RemoteAddr)
+	if !ok || !isTrusted(peer, trusted) {
+		return peer
+	}
+
+	hops := forwardedFor(r, header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseNode(hops[i])
+		if !ok {
+			// a trusted proxy couldn't name its client, e.g. for=unknown
+			return peer
+		}
+		if !isTrusted(hop, trusted) {
+			return hop
+		}
+		peer = hop
+	}
+	return peer
+}
+
+// forwardedFor lists the addresses in header, client first: the for=
+// nodes of a Forwarded header, or the elements of any other.
+func forwardedFor(r *Request, header string) []string {
+
+	v, err := r.Headers.GetString(header)
+	if err != nil {
+		return nil
+	}
+
+	var hops []string
+	if strings.EqualFold(header, "forwarded") {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, hop := range strings.Split(v, ",") {
+		hops = append(hops, strings.TrimSpace(hop))
+	}
+	return hops
+}
+
+// parseNode reads an address with or without a port, IPv6 ones in
+// brackets if they have a port, as both headers and RemoteAddr use.
+func parseNode(node string) (netip.Addr, bool) {
+
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
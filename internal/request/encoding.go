@@ -0,0 +1,84 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupportedEncoding = fmt.Errorf("Error: unsupported content encoding")
+var ErrDecodedBodyTooLarge = fmt.Errorf("Error: decoded body is larger than the limit")
+
+// DecodeBody replaces the body with its decoded form according to the
+// Content-Encoding header, and updates content-length to match. Decoding
+// stops with ErrDecodedBodyTooLarge once more than maxSize bytes come out,
+// so a small compressed upload cannot expand without bound.
+func (r *Request) DecodeBody(maxSize int) error {
+
+	contentEncoding, err := r.Headers.GetString("content-encoding")
+	if err != nil {
+		return nil
+	}
+
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		if coding != "gzip" && coding != "x-gzip" && coding != "deflate" {
+			return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, coding)
+		}
+		codings = append(codings, coding)
+	}
+
+	// codings are listed in the order they were applied
+	body := r.Body
+	for _, coding := range slices.Backward(codings) {
+		body, err = decode(coding, body, maxSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Body = body
+	r.Headers.Del("content-encoding")
+	r.Headers.Set("content-length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func decode(coding string, body []byte, maxSize int) ([]byte, error) {
+
+	var rc io.ReadCloser
+	var err error
+	switch coding {
+	case "gzip", "x-gzip":
+		rc, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		rc, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			// some clients send a raw deflate stream without the zlib wrapper
+			rc, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error: decoding %s body: %w", coding, err)
+	}
+	defer rc.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(rc, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("Error: decoding %s body: %w", coding, err)
+	}
+	if len(decoded) > maxSize {
+		return nil, ErrDecodedBodyTooLarge
+	}
+
+	return decoded, nil
+}
@@ -0,0 +1,294 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var ErrNotForm = fmt.Errorf("Error: content type is not a form")
+var ErrTooManyParts = fmt.Errorf("Error: form has too many parts")
+var ErrPartTooLarge = fmt.Errorf("Error: form part is larger than the limit")
+var ErrFormTooLarge = fmt.Errorf("Error: form body is larger than the limit")
+
+// FormOptions limits how much of a form body ParseForm will accept. A zero
+// field means the DefaultFormOptions value, so callers only set the limits
+// they want to change.
+type FormOptions struct {
+	// MaxBodySize caps the whole body, checked before anything is parsed.
+	// Zero means DefaultFormOptions.MaxBodySize.
+	MaxBodySize int64
+	// MaxMemory is how many bytes of file data are copied out of the body
+	// into memory across all file parts; anything past it is written to
+	// temporary files. The body itself is already in memory, so this bounds
+	// the copies ParseForm makes, not what the request holds. Zero means
+	// DefaultFormOptions.MaxMemory.
+	MaxMemory int64
+	// MaxParts caps the number of multipart parts, or of fields in a
+	// urlencoded body. Zero means DefaultFormOptions.MaxParts.
+	MaxParts int
+	// MaxFileSize caps the size of a single file part. Zero means
+	// DefaultFormOptions.MaxFileSize.
+	MaxFileSize int64
+	// MaxValueSize caps the size of a single non-file value, or of a
+	// single name or value in a urlencoded body. Zero means
+	// DefaultFormOptions.MaxValueSize.
+	MaxValueSize int64
+	// TempDir is where large file parts go; "" means os.TempDir().
+	TempDir string
+}
+
+var DefaultFormOptions = FormOptions{
+	MaxBodySize:  128 << 20,
+	MaxMemory:    10 << 20,
+	MaxParts:     1000,
+	MaxFileSize:  100 << 20,
+	MaxValueSize: 1 << 20,
+}
+
+// withDefaults fills in the fields left at zero.
+func (opts FormOptions) withDefaults() FormOptions {
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = DefaultFormOptions.MaxBodySize
+	}
+	if opts.MaxMemory <= 0 {
+		opts.MaxMemory = DefaultFormOptions.MaxMemory
+	}
+	if opts.MaxParts <= 0 {
+		opts.MaxParts = DefaultFormOptions.MaxParts
+	}
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = DefaultFormOptions.MaxFileSize
+	}
+	if opts.MaxValueSize <= 0 {
+		opts.MaxValueSize = DefaultFormOptions.MaxValueSize
+	}
+	return opts
+}
+
+// Form holds the fields and files parsed from a request body.
+type Form struct {
+	Values url.Values
+	Files  map[string][]*FormFile
+}
+
+// FormFile is a file part of a multipart form. Its content is either held in
+// memory or in a temporary file, depending on FormOptions.MaxMemory.
+type FormFile struct {
+	Filename    string
+	ContentType string
+	Size        int64
+
+	content []byte
+	path    string
+}
+
+// Open returns a reader over the file content.
+func (f *FormFile) Open() (io.ReadCloser, error) {
+	if f.path != "" {
+		return os.Open(f.path)
+	}
+	return io.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+// RemoveAll deletes any temporary files created for the form.
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, files := range f.Files {
+		for _, file := range files {
+			if file.path == "" {
+				continue
+			}
+			err := os.Remove(file.path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ParseForm parses an application/x-www-form-urlencoded or
+// multipart/form-data body. Bodies over opts.MaxBodySize are refused with
+// ErrFormTooLarge before parsing. Callers should defer RemoveAll on the
+// result when files may have been written to disk.
+func (r *Request) ParseForm(opts FormOptions) (*Form, error) {
+
+	opts = opts.withDefaults()
+	contentType, err := r.Headers.GetString("content-type")
+	if err != nil {
+		return nil, ErrNotForm
+	}
+	if int64(len(r.Body)) > opts.MaxBodySize {
+		return nil, ErrFormTooLarge
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("Error: parsing content type: %w", err)
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := parseURLEncoded(string(r.Body), opts)
+		if err != nil {
+			return nil, err
+		}
+		return &Form{Values: values, Files: map[string][]*FormFile{}}, nil
+	case "multipart/form-data":
+		boundary := params["boundary"]
+		if boundary == "" {
+			return nil, fmt.Errorf("Error: multipart form has no boundary")
+		}
+		form := &Form{Values: url.Values{}, Files: map[string][]*FormFile{}}
+		err := form.readMultipart(multipart.NewReader(bytes.NewReader(r.Body), boundary), opts)
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+		return form, nil
+	default:
+		return nil, ErrNotForm
+	}
+}
+
+// parseURLEncoded parses body as url.ParseQuery does, but checks MaxParts
+// and MaxValueSize field by field, so an oversized form fails before the
+// rest of it is parsed.
+func parseURLEncoded(body string, opts FormOptions) (url.Values, error) {
+
+	values := url.Values{}
+	fields := 0
+	for body != "" {
+		var field string
+		field, body, _ = strings.Cut(body, "&")
+		if field == "" {
+			continue
+		}
+		fields++
+		if fields > opts.MaxParts {
+			return nil, ErrTooManyParts
+		}
+		if strings.Contains(field, ";") {
+			return nil, fmt.Errorf("Error: parsing form: invalid semicolon separator")
+		}
+
+		name, value, _ := strings.Cut(field, "=")
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, fmt.Errorf("Error: parsing form: %w", err)
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("Error: parsing form: %w", err)
+		}
+		if int64(len(name)) > opts.MaxValueSize || int64(len(value)) > opts.MaxValueSize {
+			return nil, ErrPartTooLarge
+		}
+		values.Add(name, value)
+	}
+	return values, nil
+}
+
+func (f *Form) readMultipart(mr *multipart.Reader, opts FormOptions) error {
+
+	memoryLeft := opts.MaxMemory
+	parts := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error: reading multipart form: %w", err)
+		}
+
+		parts++
+		if parts > opts.MaxParts {
+			return ErrTooManyParts
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			value, err := readLimited(part, opts.MaxValueSize)
+			if err != nil {
+				return err
+			}
+			f.Values.Add(name, string(value))
+			continue
+		}
+
+		file, err := readFilePart(part, memoryLeft, opts)
+		if err != nil {
+			return err
+		}
+		if file.path == "" {
+			memoryLeft -= file.Size
+		}
+		f.Files[name] = append(f.Files[name], file)
+	}
+}
+
+func readFilePart(part *multipart.Part, memoryLeft int64, opts FormOptions) (*FormFile, error) {
+
+	file := &FormFile{
+		Filename:    part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+	}
+
+	// read one byte past the budget to find out whether it fits
+	limit := min(memoryLeft, opts.MaxFileSize)
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, part, limit+1)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Error: reading form file: %w", err)
+	}
+	if n <= limit {
+		file.content = buf.Bytes()
+		file.Size = n
+		return file, nil
+	}
+	if n > opts.MaxFileSize {
+		return nil, ErrPartTooLarge
+	}
+
+	tmp, err := os.CreateTemp(opts.TempDir, "form-*")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+	file.path = tmp.Name()
+
+	size, err := io.Copy(tmp, io.MultiReader(&buf, io.LimitReader(part, opts.MaxFileSize-n+1)))
+	if err != nil {
+		os.Remove(file.path)
+		return nil, err
+	}
+	if size > opts.MaxFileSize {
+		os.Remove(file.path)
+		return nil, ErrPartTooLarge
+	}
+	file.Size = size
+
+	return file, nil
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	value, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("Error: reading form value: %w", err)
+	}
+	if int64(len(value)) > limit {
+		return nil, ErrPartTooLarge
+	}
+	return value, nil
+}
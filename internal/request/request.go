@@ -1,9 +1,12 @@
 package request
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -12,13 +15,39 @@ import (
 
 const crlf = "\r\n"
 
-const bufferSize = 8
+// MaxLineSize bounds the length of the request line and of each header
+// line; readers passed in should be buffered with at least this size.
+const MaxLineSize = 8192
+
+var ErrLineTooLong = fmt.Errorf("Error: request line or header line too long")
+var ErrInvalidRequestLine = fmt.Errorf("Error: malformed request line")
+
+// Errors for requests whose framing other parsers could read differently,
+// the raw material of request smuggling. Each is distinct so rejected
+// requests can be told apart in the logs.
+var ErrLeadingWhitespace = fmt.Errorf("Error: whitespace before the first header")
+var ErrInvalidContentLength = fmt.Errorf("Error: invalid content-length")
+var ErrConflictingContentLength = fmt.Errorf("Error: conflicting content-length values")
+var ErrContentLengthWithTransferEncoding = fmt.Errorf("Error: request has both content-length and transfer-encoding")
+var ErrChunkedNotFinal = fmt.Errorf("Error: chunked is not the final transfer coding")
+var ErrUnsupportedTransferEncoding = fmt.Errorf("Error: unsupported transfer coding")
+var ErrInvalidChunk = fmt.Errorf("Error: malformed chunk")
+
+// ErrBodyTooLarge is returned when a request body, declared or chunked, is
+// bigger than the limit ReadRequest was given.
+var ErrBodyTooLarge = fmt.Errorf("Error: request body is larger than the limit")
+
+// maxChunkSizeDigits keeps a chunk size within an int.
+const maxChunkSizeDigits = 15
 
 const (
 	initialized state = iota
 	done
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingTrailers
 )
 
 type state int
@@ -28,6 +57,27 @@ type Request struct {
 	State       state
 	Headers     headers.Headers
 	Body        []byte
+	// Trailers holds the fields sent after a chunked body, if any.
+	Trailers headers.Headers
+
+	// The rest is filled in by the server from the connection the request
+	// came on; the parser leaves it empty.
+
+	// RemoteAddr is the peer's address as "host:port". Behind a proxy that
+	// is the proxy; see ClientIP.
+	RemoteAddr string
+	// LocalAddr is the address the connection was accepted on.
+	LocalAddr string
+	// TLS is the connection's TLS state, or nil for plain connections.
+	TLS *tls.ConnectionState
+	// ConnID identifies the connection, unique for the server's lifetime.
+	ConnID uint64
+	// Seq counts requests on the connection, starting at 1.
+	Seq int
+
+	chunked        bool
+	chunkRemaining int
+	maxBodySize    int
 }
 
 type RequestLine struct {
@@ -43,45 +93,61 @@ func newRequest() *Request {
 	}
 }
 
+// RequestFromReader parses a single request from reader. When reader is a
+// *bufio.Reader only the bytes belonging to the request are consumed, so
+// whatever the client sent next is still there for the caller.
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return ReadRequest(reader, 0, nil)
+}
 
-	request := newRequest()
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
-	for !(request.State == done) {
+// ReadRequest is RequestFromReader with a limit on the body, zero meaning
+// none. A content-length over maxBodySize fails with ErrBodyTooLarge before
+// any of the body is read, and a chunked body as soon as a chunk would take
+// it over. headersRead, if not nil, is called once the request line and
+// headers are in and before the body is read, e.g. to swap a deadline
+// meant only for the headers for one covering the body.
+func ReadRequest(reader io.Reader, maxBodySize int, headersRead func()) (*Request, error) {
+
+	br, ok := reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(reader, MaxLineSize)
+	}
 
-		if len(buf) == readToIndex {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf[:readToIndex])
-			buf = newBuf
-		}
+	request := newRequest()
+	request.maxBodySize = maxBodySize
+	unparsed := 0
+	for request.State != done {
 
-		n, err := reader.Read(buf[readToIndex:])
+		data, err := br.Peek(max(br.Buffered(), unparsed+1))
 
-		readToIndex += n
-		readN, perr := request.parse(buf[:readToIndex])
+		readN, perr := request.parse(data)
 		if perr != nil {
 			return nil, perr
 		}
+		br.Discard(readN)
+		unparsed = len(data) - readN
 
-		copy(buf, buf[readN:readToIndex])
-		readToIndex -= readN
+		if headersRead != nil && request.State != initialized && request.State != requestStateParsingHeaders {
+			headersRead()
+			headersRead = nil
+		}
 
-		if err == io.EOF {
-			if request.State != done {
-				return nil, fmt.Errorf("incomplete request at EOF")
-			}
-			if readN == 0 {
-				break
-			}
-			continue
+		if request.State == done {
+			break
 		}
 
-		if err != nil {
-			return nil, err
+		if err == bufio.ErrBufferFull && readN == 0 {
+			return nil, ErrLineTooLong
 		}
-		if n == 0 && readN == 0 {
-			break
+		if err == io.EOF && len(data) == 0 && request.State == initialized {
+			// the client closed the connection between requests
+			return nil, io.EOF
+		}
+		if err == io.EOF {
+			return nil, fmt.Errorf("incomplete request at EOF: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
 		}
 	}
 
@@ -104,22 +170,49 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	case done:
 		return 0, fmt.Errorf("parser is done")
 	case requestStateParsingHeaders:
+		// RFC 9112 section 2.2: whitespace between the request line and the
+		// first field could hide a field from other parsers
+		if len(r.Headers) == 0 && len(data) > 0 && (data[0] == ' ' || data[0] == '\t') {
+			return 0, ErrLeadingWhitespace
+		}
+
 		n, isDone, err := r.Headers.Parse(data)
 		if err != nil {
 			return 0, err
 		}
 
 		if isDone {
+			err = r.checkFraming()
+			if err != nil {
+				return 0, err
+			}
 			r.State = requestStateParsingBody
+			if r.chunked {
+				r.State = requestStateParsingChunkSize
+			}
 		}
 
+		return n, nil
+	case requestStateParsingChunkSize:
+		return r.parseChunkSize(data)
+	case requestStateParsingChunkData:
+		return r.parseChunkData(data)
+	case requestStateParsingTrailers:
+		n, isDone, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if isDone {
+			r.finishChunked()
+		}
 		return n, nil
 	case requestStateParsingBody:
 
 		val, err := r.Headers.Get("content-length")
 		if err != nil {
+			// without a content-length the request has no body
 			r.State = done
-			return len(data), nil
+			return 0, nil
 		}
 
 		remaining := val - len(r.Body)
@@ -160,18 +253,165 @@ func (r *Request) parse(data []byte) (int, error) {
 	return totalBytesParsed, nil
 }
 
-func parseRequestLine(requestLine []byte) (int, *RequestLine, error) {
+// checkFraming makes sure there's only one way to read where the body
+// ends, following RFC 9112 section 6.3. A request carrying both
+// content-length and transfer-encoding, or disagreeing content-lengths, is
+// how request smuggling slips past a proxy, so those are rejected outright
+// rather than letting transfer-encoding win.
+func (r *Request) checkFraming() error {
+
+	te, hasTE := r.Headers["transfer-encoding"]
+	cl, hasCL := r.Headers["content-length"]
+	if hasTE && hasCL {
+		return ErrContentLengthWithTransferEncoding
+	}
 
-	idx := bytes.Index(requestLine, []byte(crlf))
+	if hasTE {
+		var codings []string
+		for _, c := range strings.Split(te, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != "" {
+				codings = append(codings, c)
+			}
+		}
+		for i, c := range codings {
+			if c == "chunked" && i != len(codings)-1 {
+				return fmt.Errorf("%w: %s", ErrChunkedNotFinal, te)
+			}
+		}
+		if len(codings) == 0 || codings[len(codings)-1] != "chunked" {
+			return fmt.Errorf("%w: %s", ErrChunkedNotFinal, te)
+		}
+		if len(codings) > 1 {
+			return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, te)
+		}
+		r.chunked = true
+		return nil
+	}
+
+	if !hasCL {
+		return nil
+	}
+
+	// repeated fields arrive joined with ", "; identical copies are
+	// harmless, anything else is ambiguous
+	values := strings.Split(cl, ",")
+	first := strings.TrimSpace(values[0])
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v != first {
+			return fmt.Errorf("%w: %s", ErrConflictingContentLength, cl)
+		}
+	}
+	if first == "" || strings.Trim(first, "0123456789") != "" {
+		return fmt.Errorf("%w: %s", ErrInvalidContentLength, cl)
+	}
+	n, err := strconv.Atoi(first)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidContentLength, cl)
+	}
+	if r.maxBodySize > 0 && n > r.maxBodySize {
+		return fmt.Errorf("%w: content-length %d", ErrBodyTooLarge, n)
+	}
+
+	r.Headers.Set("content-length", first)
+	return nil
+}
+
+// parseChunkSize reads a chunk-size line. Extensions after ";" are allowed
+// and ignored.
+func (r *Request) parseChunkSize(data []byte) (int, error) {
+
+	line, n, err := readLine(data)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	size := line
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		size = line[:i]
+	}
+	size = bytes.TrimRight(size, " \t")
+	if len(size) == 0 || len(size) > maxChunkSizeDigits {
+		return 0, fmt.Errorf("%w: chunk size %q", ErrInvalidChunk, size)
+	}
+	chunkSize, err := strconv.ParseInt(string(size), 16, 64)
+	if err != nil || strings.ContainsAny(string(size), "+-xX_") {
+		return 0, fmt.Errorf("%w: chunk size %q", ErrInvalidChunk, size)
+	}
+
+	if chunkSize == 0 {
+		r.Trailers = headers.NewHeaders()
+		r.State = requestStateParsingTrailers
+		return n, nil
+	}
+	if r.maxBodySize > 0 && int64(len(r.Body))+chunkSize > int64(r.maxBodySize) {
+		return 0, ErrBodyTooLarge
+	}
+	r.chunkRemaining = int(chunkSize)
+	r.State = requestStateParsingChunkData
+	return n, nil
+}
+
+// parseChunkData reads chunk data and the CRLF that must follow it.
+func (r *Request) parseChunkData(data []byte) (int, error) {
+
+	if r.chunkRemaining > 0 {
+		consumed := min(r.chunkRemaining, len(data))
+		r.Body = append(r.Body, data[:consumed]...)
+		r.chunkRemaining -= consumed
+		return consumed, nil
+	}
+
+	if len(data) < len(crlf) {
+		return 0, nil
+	}
+	if string(data[:len(crlf)]) != crlf {
+		return 0, fmt.Errorf("%w: chunk data not followed by CRLF", ErrInvalidChunk)
+	}
+	r.State = requestStateParsingChunkSize
+	return len(crlf), nil
+}
+
+// finishChunked leaves the request looking as if it had been sent with a
+// content-length, as RFC 9112 section 7.1.3 describes.
+func (r *Request) finishChunked() {
+	r.Headers.Del("transfer-encoding")
+	r.Headers.Set("content-length", strconv.Itoa(len(r.Body)))
+	r.State = done
+}
+
+// readLine returns the next CRLF-terminated line without its line ending,
+// and how many bytes it took up. n is 0 while the line is incomplete.
+func readLine(data []byte) (line []byte, n int, err error) {
+
+	idx := bytes.IndexByte(data, '\n')
 	if idx == -1 {
-		return 0, nil, nil
+		return nil, 0, nil
+	}
+	if idx == 0 || data[idx-1] != '\r' {
+		return nil, 0, headers.ErrBareLF
+	}
+	line = data[:idx-1]
+	if bytes.IndexByte(line, '\r') != -1 {
+		return nil, 0, headers.ErrBareCR
 	}
+	return line, idx + 1, nil
+}
 
-	read := idx + len(crlf)
+func parseRequestLine(requestLine []byte) (int, *RequestLine, error) {
 
-	request, err := requestLineFromString(string(requestLine[:idx]))
+	line, read, err := readLine(requestLine)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, fmt.Errorf("%w in request line", err)
+	}
+	if read == 0 {
+		return 0, nil, nil
+	}
+
+	request, err := requestLineFromString(string(line))
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %w", ErrInvalidRequestLine, err)
 	}
 
 	return read, request, nil
@@ -191,8 +431,19 @@ func requestLineFromString(line string) (*RequestLine, error) {
 			return &RequestLine{}, fmt.Errorf("Method is not all upper case")
 		}
 	}
+	if len(method) == 0 || !headers.ValidateCharacters([]byte(method)) {
+		return &RequestLine{}, fmt.Errorf("Method is not a valid token")
+	}
 
 	requestTarget := requestLineParts[1]
+	if len(requestTarget) == 0 {
+		return &RequestLine{}, fmt.Errorf("Request target is empty")
+	}
+	for _, b := range []byte(requestTarget) {
+		if b <= ' ' || b == 0x7f {
+			return &RequestLine{}, fmt.Errorf("Request target contains whitespace or a control character")
+		}
+	}
 
 	version := strings.Split(requestLineParts[2], "/")
 	if len(version) != 2 {
@@ -1,7 +1,15 @@
 package request
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"io"
+	"mime/multipart"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/ratludu/httpfromtcp/internal/headers"
@@ -226,3 +234,380 @@ func TestParse_FullHeader(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+func TestParse_Chunked(t *testing.T) {
+	reader := &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6;ext\r\n world\r\n0\r\nX-Checksum: 42\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(r.Body))
+	assert.Equal(t, "11", r.Headers["content-length"])
+	_, hasTE := r.Headers["transfer-encoding"]
+	assert.False(t, hasTE)
+	assert.Equal(t, "42", r.Trailers["x-checksum"])
+}
+
+func TestReadRequest_MaxBodySize(t *testing.T) {
+	read := func(raw string) (*Request, error) {
+		return ReadRequest(&chunkReader{data: raw, numBytesPerRead: 4}, 10, nil)
+	}
+
+	r, err := read("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\n0123456789")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(r.Body))
+
+	// Test: a declared length over the limit fails before the body is sent
+	_, err = read("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 11\r\n\r\n")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: chunks are counted as they add up
+	r, err = read("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n01234\r\n5\r\n56789\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(r.Body))
+	_, err = read("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n01234\r\n6\r\n")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestDecodeBody(t *testing.T) {
+	payload := `{"agent":"a1","ok":true}`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(payload))
+	zw.Close()
+
+	// Test: gzip body is decoded
+	r := &Request{Headers: headers.NewHeaders(), Body: gz.Bytes()}
+	r.Headers.Set("content-encoding", "gzip")
+	r.Headers.Set("content-length", strconv.Itoa(gz.Len()))
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, payload, string(r.Body))
+	assert.Equal(t, strconv.Itoa(len(payload)), r.Headers["content-length"])
+	_, ok := r.Headers["content-encoding"]
+	assert.False(t, ok)
+
+	// Test: no content-encoding leaves the body alone
+	r = &Request{Headers: headers.NewHeaders(), Body: []byte("plain")}
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, "plain", string(r.Body))
+
+	// Test: decoded size over the limit
+	r = &Request{Headers: headers.NewHeaders(), Body: gz.Bytes()}
+	r.Headers.Set("content-encoding", "gzip")
+	require.ErrorIs(t, r.DecodeBody(10), ErrDecodedBodyTooLarge)
+
+	// Test: unsupported coding
+	r = &Request{Headers: headers.NewHeaders(), Body: []byte("x")}
+	r.Headers.Set("content-encoding", "br")
+	require.ErrorIs(t, r.DecodeBody(1024), ErrUnsupportedEncoding)
+
+	// Test: corrupt gzip
+	r = &Request{Headers: headers.NewHeaders(), Body: []byte("not gzip at all")}
+	r.Headers.Set("content-encoding", "gzip")
+	require.Error(t, r.DecodeBody(1024))
+}
+
+func TestParseForm(t *testing.T) {
+	// Test: urlencoded
+	r := &Request{Headers: headers.NewHeaders(), Body: []byte("name=gopher&tag=a&tag=b")}
+	r.Headers.Set("content-type", "application/x-www-form-urlencoded")
+	form, err := r.ParseForm(DefaultFormOptions)
+	require.NoError(t, err)
+	assert.Equal(t, "gopher", form.Values.Get("name"))
+	assert.Equal(t, []string{"a", "b"}, form.Values["tag"])
+
+	// Test: MaxValueSize applies to each value, not the whole body
+	opts := DefaultFormOptions
+	opts.MaxValueSize = 6
+	_, err = r.ParseForm(opts)
+	require.NoError(t, err)
+	opts.MaxValueSize = 5
+	_, err = r.ParseForm(opts)
+	require.ErrorIs(t, err, ErrPartTooLarge)
+
+	// Test: zero limits fall back to the defaults
+	form, err = r.ParseForm(FormOptions{TempDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, "gopher", form.Values.Get("name"))
+
+	// Test: urlencoded fields count against MaxParts
+	opts = DefaultFormOptions
+	opts.MaxParts = 2
+	_, err = r.ParseForm(opts)
+	require.ErrorIs(t, err, ErrTooManyParts)
+
+	// Test: the whole body is checked before parsing
+	opts = DefaultFormOptions
+	opts.MaxBodySize = 10
+	_, err = r.ParseForm(opts)
+	require.ErrorIs(t, err, ErrFormTooLarge)
+
+	// Test: multipart with a small file in memory and a large one on disk
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "upload")
+	fw, _ := mw.CreateFormFile("small", "small.txt")
+	fw.Write([]byte("tiny"))
+	fw, _ = mw.CreateFormFile("big", "big.bin")
+	fw.Write(bytes.Repeat([]byte("b"), 64))
+	mw.Close()
+
+	opts = DefaultFormOptions
+	opts.MaxMemory = 16
+	opts.TempDir = t.TempDir()
+	r = &Request{Headers: headers.NewHeaders(), Body: body.Bytes()}
+	r.Headers.Set("content-type", mw.FormDataContentType())
+	form, err = r.ParseForm(opts)
+	require.NoError(t, err)
+	defer form.RemoveAll()
+
+	assert.Equal(t, "upload", form.Values.Get("title"))
+	require.Len(t, form.Files["small"], 1)
+	assert.Equal(t, "small.txt", form.Files["small"][0].Filename)
+	assert.Empty(t, form.Files["small"][0].path)
+	require.Len(t, form.Files["big"], 1)
+	big := form.Files["big"][0]
+	assert.Equal(t, int64(64), big.Size)
+	assert.NotEmpty(t, big.path)
+	rc, err := big.Open()
+	require.NoError(t, err)
+	content, _ := io.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, bytes.Repeat([]byte("b"), 64), content)
+
+	require.NoError(t, form.RemoveAll())
+	_, err = os.Stat(big.path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: limits
+	opts.MaxFileSize = 32
+	_, err = r.ParseForm(opts)
+	require.ErrorIs(t, err, ErrPartTooLarge)
+
+	opts = DefaultFormOptions
+	opts.MaxParts = 2
+	_, err = r.ParseForm(opts)
+	require.ErrorIs(t, err, ErrTooManyParts)
+
+	// Test: not a form
+	r.Headers.Set("content-type", "application/json")
+	_, err = r.ParseForm(DefaultFormOptions)
+	require.ErrorIs(t, err, ErrNotForm)
+}
+
+func TestRequestFromReader_LeavesFollowingBytes(t *testing.T) {
+	br := bufio.NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /next HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	r, err := RequestFromReader(br)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+
+	r, err = RequestFromReader(br)
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: a header line longer than the buffer
+	br = bufio.NewReaderSize(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 64) + "\r\n\r\n",
+		numBytesPerRead: 7,
+	}, 32)
+	_, err = RequestFromReader(br)
+	require.ErrorIs(t, err, ErrLineTooLong)
+}
+
+// conformanceCases are derived from RFC 9112. Whatever the RFC leaves open
+// to interpretation, where a proxy in front of us might frame the message
+// differently, has to be rejected.
+var conformanceCases = []struct {
+	name  string
+	raw   string
+	valid bool
+	body  string
+	// err is the specific error an invalid case must fail with, if any
+	err error
+}{
+	{name: "minimal", raw: "GET / HTTP/1.1\r\nHost: a\r\n\r\n", valid: true},
+	{name: "no whitespace after colon", raw: "GET / HTTP/1.1\r\nHost:a\r\n\r\n", valid: true},
+	{name: "empty field value", raw: "GET / HTTP/1.1\r\nHost: a\r\nX-Empty:\r\n\r\n", valid: true},
+	{name: "tabs as optional whitespace", raw: "GET / HTTP/1.1\r\nHost:\ta\t\r\n\r\n", valid: true},
+	{name: "colon in value", raw: "GET / HTTP/1.1\r\nHost: a\r\nX-Time: 12:30:00\r\n\r\n", valid: true},
+	{name: "obs-text in value", raw: "GET / HTTP/1.1\r\nHost: a\r\nX-Name: caf\xe9\r\n\r\n", valid: true},
+	{name: "asterisk-form", raw: "OPTIONS * HTTP/1.1\r\nHost: a\r\n\r\n", valid: true},
+	{name: "absolute-form", raw: "GET http://a/b HTTP/1.1\r\nHost: a\r\n\r\n", valid: true},
+	{name: "authority-form", raw: "CONNECT a:443 HTTP/1.1\r\nHost: a:443\r\n\r\n", valid: true},
+	{name: "content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabc", valid: true, body: "abc"},
+	{name: "zero content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0\r\n\r\n", valid: true},
+	{name: "identical duplicate content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc", valid: true, body: "abc"},
+	{name: "identical content-length list", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 3\r\n\r\nabc", valid: true, body: "abc"},
+	{name: "chunked", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\nA\r\n0123456789\r\n0\r\n\r\n", valid: true, body: "abc0123456789"},
+	{name: "chunked with extensions and trailers", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: Chunked\r\n\r\n3;name=value\r\nabc\r\n0\r\nX-Sum: 1\r\n\r\n", valid: true, body: "abc"},
+
+	{name: "bare LF after request line", raw: "GET / HTTP/1.1\nHost: a\r\n\r\n", err: headers.ErrBareLF},
+	{name: "bare LF after field", raw: "GET / HTTP/1.1\r\nHost: a\n\r\n", err: headers.ErrBareLF},
+	{name: "bare LF ending headers", raw: "GET / HTTP/1.1\r\nHost: a\r\n\n", err: headers.ErrBareLF},
+	{name: "bare LF only", raw: "GET / HTTP/1.1\nHost: a\n\n", err: headers.ErrBareLF},
+	{name: "bare CR in request line", raw: "GET /\r HTTP/1.1\r\nHost: a\r\n\r\n", err: headers.ErrBareCR},
+	{name: "bare CR in value", raw: "GET / HTTP/1.1\r\nHost: a\rX: b\r\n\r\n", err: headers.ErrBareCR},
+	{name: "obs-fold with space", raw: "GET / HTTP/1.1\r\nHost: a\r\nX: b\r\n c\r\n\r\n", err: headers.ErrObsFold},
+	{name: "obs-fold with tab", raw: "GET / HTTP/1.1\r\nHost: a\r\nX: b\r\n\tc\r\n\r\n", err: headers.ErrObsFold},
+	{name: "obs-fold hiding a field", raw: "POST / HTTP/1.1\r\nHost: a\r\nX: b\r\n Content-Length: 3\r\n\r\nabc", err: headers.ErrObsFold},
+	{name: "whitespace before first field", raw: "GET / HTTP/1.1\r\n Host: a\r\n\r\n", err: ErrLeadingWhitespace},
+	{name: "space before colon", raw: "GET / HTTP/1.1\r\nHost : a\r\n\r\n", err: headers.ErrSpaceBeforeColon},
+	{name: "tab before colon", raw: "GET / HTTP/1.1\r\nHost\t: a\r\n\r\n", err: headers.ErrSpaceBeforeColon},
+	{name: "no colon", raw: "GET / HTTP/1.1\r\nHost a\r\n\r\n"},
+	{name: "empty field name", raw: "GET / HTTP/1.1\r\n: a\r\n\r\n"},
+	{name: "non-ASCII field name", raw: "GET / HTTP/1.1\r\nH\xe9st: a\r\n\r\n"},
+	{name: "NUL in value", raw: "GET / HTTP/1.1\r\nHost: a\x00b\r\n\r\n", err: headers.ErrInvalidFieldValue},
+	{name: "conflicting content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd", err: ErrConflictingContentLength},
+	{name: "conflicting content-length list", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 4\r\n\r\nabcd", err: ErrConflictingContentLength},
+	{name: "content-length and transfer-encoding", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", err: ErrContentLengthWithTransferEncoding},
+	{name: "transfer-encoding and content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n0\r\n\r\n", err: ErrContentLengthWithTransferEncoding},
+	{name: "chunked not final", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, gzip\r\n\r\n0\r\n\r\n", err: ErrChunkedNotFinal},
+	{name: "chunked twice", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", err: ErrChunkedNotFinal},
+	{name: "transfer-encoding without chunked", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip\r\n\r\n", err: ErrChunkedNotFinal},
+	{name: "unsupported transfer coding", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", err: ErrUnsupportedTransferEncoding},
+	{name: "chunk size not hex", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\ng\r\n\r\n", err: ErrInvalidChunk},
+	{name: "signed chunk size", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n+3\r\nabc\r\n0\r\n\r\n", err: ErrInvalidChunk},
+	{name: "overlong chunk size", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0000000000000003\r\nabc\r\n0\r\n\r\n", err: ErrInvalidChunk},
+	{name: "chunk data without CRLF", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcd\r\n0\r\n\r\n", err: ErrInvalidChunk},
+	{name: "bare LF after chunk size", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\nabc\r\n0\r\n\r\n", err: headers.ErrBareLF},
+	{name: "missing last chunk", raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n"},
+	{name: "negative content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n", err: ErrInvalidContentLength},
+	{name: "signed content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +3\r\n\r\nabc", err: ErrInvalidContentLength},
+	{name: "hex content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x3\r\n\r\nabc", err: ErrInvalidContentLength},
+	{name: "content-length with inner space", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1 0\r\n\r\n0123456789", err: ErrInvalidContentLength},
+	{name: "empty content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:\r\n\r\n", err: ErrInvalidContentLength},
+	{name: "overflowing content-length", raw: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999\r\n\r\n", err: ErrInvalidContentLength},
+	{name: "empty method", raw: " / HTTP/1.1\r\nHost: a\r\n\r\n"},
+	{name: "invalid method character", raw: "G(T / HTTP/1.1\r\nHost: a\r\n\r\n"},
+	{name: "double space in request line", raw: "GET  / HTTP/1.1\r\nHost: a\r\n\r\n"},
+	{name: "tab in request line", raw: "GET\t/ HTTP/1.1\r\nHost: a\r\n\r\n"},
+	{name: "control character in target", raw: "GET /a\x01 HTTP/1.1\r\nHost: a\r\n\r\n"},
+	{name: "lowercase protocol", raw: "GET / http/1.1\r\nHost: a\r\n\r\n"},
+}
+
+func TestConformance(t *testing.T) {
+	for _, tc := range conformanceCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the outcome must not depend on how the bytes arrive
+			for _, n := range []int{1, 2, 7, len(tc.raw)} {
+				r, err := RequestFromReader(&chunkReader{data: tc.raw, numBytesPerRead: n})
+				if !tc.valid {
+					require.Error(t, err, "read %d bytes at a time", n)
+					if tc.err != nil {
+						require.ErrorIs(t, err, tc.err)
+					}
+					continue
+				}
+				require.NoError(t, err, "read %d bytes at a time", n)
+				assert.Equal(t, tc.body, string(r.Body))
+			}
+		})
+	}
+}
+
+func FuzzRequestFromReader(f *testing.F) {
+	for _, tc := range conformanceCases {
+		f.Add([]byte(tc.raw), 3)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, n int) {
+		whole, err := RequestFromReader(bytes.NewReader(data))
+
+		n = 1 + int(uint(n)%16)
+		split, splitErr := RequestFromReader(&chunkReader{data: string(data), numBytesPerRead: n})
+		require.Equal(t, err == nil, splitErr == nil, "whole: %v, split: %v", err, splitErr)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, whole, split)
+
+		cl, clErr := whole.Headers.Get("content-length")
+		if clErr == nil {
+			assert.Equal(t, cl, len(whole.Body))
+		} else {
+			assert.Empty(t, whole.Body)
+		}
+		for k, v := range whole.Headers {
+			assert.NotContains(t, v, "\r", "header %s", k)
+			if k != "set-cookie" {
+				assert.NotContains(t, v, "\n", "header %s", k)
+			}
+		}
+	})
+}
+
+func FuzzParseRequestLine(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\n"))
+	f.Add([]byte("OPTIONS * HTTP/1.1\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\n"))
+	f.Add([]byte("GET  / HTTP/1.1\r\n"))
+	f.Add([]byte("get / HTTP/1.1\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		n, rl, err := parseRequestLine(data)
+		if err != nil || n == 0 {
+			assert.Equal(t, 0, n)
+			return
+		}
+
+		require.LessOrEqual(t, n, len(data))
+		assert.Equal(t, "\r\n", string(data[n-2:n]))
+		assert.Equal(t, "1.1", rl.HttpVersion)
+		assert.NotEmpty(t, rl.Method)
+		assert.True(t, headers.ValidateCharacters([]byte(rl.Method)))
+		assert.NotEmpty(t, rl.RequestTarget)
+		assert.NotContains(t, rl.RequestTarget, " ")
+		assert.Equal(t, string(data[:n]), rl.Method+" "+rl.RequestTarget+" HTTP/1.1\r\n")
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	clientIPFrom := func(header, remoteAddr string, h ...string) string {
+		r := &Request{Headers: headers.NewHeaders(), RemoteAddr: remoteAddr}
+		for i := 0; i < len(h); i += 2 {
+			r.Headers.Add(h[i], h[i+1])
+		}
+		return r.ClientIP(trusted, header).String()
+	}
+	clientIP := func(remoteAddr string, h ...string) string {
+		return clientIPFrom("X-Forwarded-For", remoteAddr, h...)
+	}
+
+	// Test: untrusted peers can't claim another address
+	assert.Equal(t, "192.0.2.1", clientIP("192.0.2.1:5000", "x-forwarded-for", "198.51.100.1"))
+
+	assert.Equal(t, "198.51.100.1", clientIP("10.0.0.1:5000", "x-forwarded-for", "198.51.100.1"))
+	assert.Equal(t, "10.0.0.1", clientIP("10.0.0.1:5000"))
+
+	// Test: the rightmost untrusted hop wins, not whatever the client put first
+	assert.Equal(t, "198.51.100.1", clientIP("10.0.0.1:5000", "x-forwarded-for", "203.0.113.66, 198.51.100.1, 10.2.2.2"))
+	assert.Equal(t, "198.51.100.1", clientIP("10.0.0.1:5000", "x-forwarded-for", "203.0.113.66", "x-forwarded-for", "198.51.100.1"))
+
+	// Test: only trusted hops all the way
+	assert.Equal(t, "10.3.3.3", clientIP("10.0.0.1:5000", "x-forwarded-for", "10.3.3.3, 10.2.2.2"))
+
+	// Test: garbage stops the walk at the proxy that sent it
+	assert.Equal(t, "10.2.2.2", clientIP("10.0.0.1:5000", "x-forwarded-for", "198.51.100.1, nonsense, 10.2.2.2"))
+
+	// Test: Forwarded has its own syntax
+	assert.Equal(t, "2001:db9::1", clientIPFrom("Forwarded", "[2001:db8::1]:443",
+		"forwarded", `for="[2001:db9::1]:4711";proto=https, for=10.1.1.1;by=10.0.0.1`,
+		"x-forwarded-for", "198.51.100.1"))
+	assert.Equal(t, "192.0.2.43", clientIPFrom("forwarded", "10.0.0.1:5000", "forwarded", `For="192.0.2.43:47011"`))
+	assert.Equal(t, "10.0.0.1", clientIPFrom("forwarded", "10.0.0.1:5000", "forwarded", "for=unknown"))
+
+	// Test: only the named header counts, whatever else the client sent
+	assert.Equal(t, "198.51.100.1", clientIP("10.0.0.1:5000", "forwarded", "for=203.0.113.66", "x-forwarded-for", "198.51.100.1"))
+	assert.Equal(t, "10.0.0.1", clientIPFrom("forwarded", "10.0.0.1:5000", "x-forwarded-for", "203.0.113.66"))
+
+	// Test: IPv4-mapped peers match IPv4 prefixes
+	assert.Equal(t, "198.51.100.1", clientIP("[::ffff:10.0.0.1]:5000", "x-forwarded-for", "198.51.100.1"))
+
+	// Test: no address at all
+	assert.Equal(t, "invalid IP", clientIP("pipe"))
+}
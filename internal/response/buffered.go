@@ -0,0 +1,298 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+)
+
+type bufferMode int
+
+const (
+	bufferUndecided bufferMode = iota
+	bufferBuffering
+	bufferPassthrough
+	// bufferDone drops whatever the handler writes once the response, or
+	// something in its place, has gone out.
+	bufferDone
+)
+
+// BufferHooks are the calls a BufferedWriter leaves to the middleware
+// using it.
+type BufferHooks struct {
+	// Headers is called once the handler has written its status line and
+	// headers, and reports whether to buffer the body. If not, the
+	// response goes through as it is written, unless Headers has already
+	// sent it on its way, or something else in its place. Nil means
+	// buffer every body.
+	Headers func(bw *BufferedWriter) (bool, error)
+	// Overflow is called when a buffered body outgrows Limit, or the
+	// handler flushes, before it is complete. It has to send the response
+	// on its way or drop it. Nil means Pass.
+	Overflow func(bw *BufferedWriter) error
+	// Complete is called once the whole body is buffered: as much as the
+	// content-length promised, the end of a chunked body, or whatever
+	// there is when Close is called. trailers are the handler's, if it
+	// wrote any. Nil means Send.
+	Complete func(bw *BufferedWriter, trailers headers.Headers) error
+}
+
+// BufferedWriter holds back a response until the middleware using it has
+// seen enough of it: the status line and headers until Headers decides,
+// then the body, if buffered, until it is complete or outgrows Limit.
+// Nothing is written to the wrapped Writer before then, so the response
+// can still be changed or replaced. A nil wrapped Writer discards it.
+type BufferedWriter struct {
+	next  Writer
+	out   Writer
+	hooks BufferHooks
+	mode  bufferMode
+
+	// Limit bounds the body buffered, zero meaning no bound. Headers may
+	// set it per response.
+	Limit int
+
+	// Status and Header are the handler's, the latter a copy that can be
+	// changed before it goes out. Chunked and ContentLength are the
+	// framing it asked for, ContentLength being -1 if there is none.
+	Status        StatusCode
+	Header        headers.Headers
+	Chunked       bool
+	ContentLength int
+	// Body holds what has been buffered.
+	Body bytes.Buffer
+}
+
+func NewBufferedWriter(w Writer, hooks BufferHooks) *BufferedWriter {
+	return &BufferedWriter{next: w, hooks: hooks}
+}
+
+func (bw *BufferedWriter) WriteStatusLine(statusCode StatusCode) error {
+	if bw.mode != bufferUndecided || bw.Header != nil {
+		return fmt.Errorf("Error: status line already written")
+	}
+	bw.Status = statusCode
+	return nil
+}
+
+func (bw *BufferedWriter) WriteHeaders(h headers.Headers) error {
+	if bw.mode != bufferUndecided {
+		return fmt.Errorf("Error: headers already written")
+	}
+
+	bw.Header = headers.NewHeaders()
+	maps.Copy(bw.Header, h)
+	bw.Chunked = bw.Header.HasToken("transfer-encoding", "chunked")
+	bw.ContentLength = -1
+	if n, err := bw.Header.Get("content-length"); err == nil && !bw.Chunked {
+		bw.ContentLength = n
+	}
+
+	buffer := true
+	if bw.hooks.Headers != nil {
+		var err error
+		buffer, err = bw.hooks.Headers(bw)
+		if err != nil || bw.mode != bufferUndecided {
+			return err
+		}
+	}
+	if !buffer {
+		return bw.Pass()
+	}
+	bw.mode = bufferBuffering
+	if bw.ContentLength == 0 {
+		return bw.complete(nil)
+	}
+	return nil
+}
+
+func (bw *BufferedWriter) WriteBody(p []byte) (int, error) {
+	switch bw.mode {
+	case bufferPassthrough:
+		if bw.out == nil {
+			return len(p), nil
+		}
+		return bw.out.WriteBody(p)
+	case bufferBuffering:
+		return len(p), bw.buffer(p)
+	case bufferDone:
+		return len(p), nil
+	default:
+		return 0, fmt.Errorf("Error: body written before headers")
+	}
+}
+
+func (bw *BufferedWriter) WriteChunkedBody(p []byte) (int, error) {
+	if bw.mode == bufferPassthrough && bw.out != nil {
+		return bw.out.WriteChunkedBody(p)
+	}
+	return bw.WriteBody(p)
+}
+
+func (bw *BufferedWriter) WriteChunkedBodyDone() (int, error) {
+	switch bw.mode {
+	case bufferPassthrough:
+		if bw.out == nil {
+			return 0, nil
+		}
+		return bw.out.WriteChunkedBodyDone()
+	case bufferBuffering:
+		return 0, bw.complete(nil)
+	case bufferDone:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("Error: body written before headers")
+	}
+}
+
+func (bw *BufferedWriter) WriteTrailers(h headers.Headers) error {
+	switch bw.mode {
+	case bufferPassthrough:
+		if bw.out == nil {
+			return nil
+		}
+		return bw.out.WriteTrailers(h)
+	case bufferBuffering:
+		return bw.complete(h)
+	case bufferDone:
+		return nil
+	default:
+		return fmt.Errorf("Error: trailers written before headers")
+	}
+}
+
+func (bw *BufferedWriter) Unwrap() Writer {
+	return bw.next
+}
+
+// Flush gives up buffering so the client sees the data now.
+func (bw *BufferedWriter) Flush() error {
+	if bw.mode == bufferBuffering {
+		err := bw.overflow()
+		if err != nil {
+			return err
+		}
+	}
+	w := bw.next
+	if bw.mode == bufferPassthrough {
+		w = bw.out
+	}
+	if w == nil {
+		return nil
+	}
+	return Flush(w)
+}
+
+// Close completes a body the handler left unfinished, e.g. one shorter
+// than its content-length. Middleware calls it once the handler returns.
+func (bw *BufferedWriter) Close() error {
+	if bw.mode == bufferBuffering {
+		return bw.complete(nil)
+	}
+	return nil
+}
+
+// Buffering reports whether the body is still being held back.
+func (bw *BufferedWriter) Buffering() bool {
+	return bw.mode == bufferBuffering
+}
+
+// Pass sends the status line, headers and anything buffered, and lets the
+// rest of the body through as it is written.
+func (bw *BufferedWriter) Pass() error {
+	return bw.PassTo(bw.next)
+}
+
+// PassTo is Pass with the body, buffered and still to come, written to w
+// instead, e.g. an encoder that writes to the wrapped Writer in turn.
+func (bw *BufferedWriter) PassTo(w Writer) error {
+	bw.mode = bufferPassthrough
+	bw.out = w
+	if bw.next == nil {
+		return nil
+	}
+
+	err := bw.writeHead()
+	if err != nil || bw.Body.Len() == 0 {
+		return err
+	}
+	if bw.Chunked {
+		_, err = bw.out.WriteChunkedBody(bw.Body.Bytes())
+	} else {
+		_, err = bw.out.WriteBody(bw.Body.Bytes())
+	}
+	bw.Body.Reset()
+	return err
+}
+
+// Send sends the response with the body buffered, framed the way the
+// handler framed it, and drops anything written afterwards.
+func (bw *BufferedWriter) Send(trailers headers.Headers) error {
+	bw.mode = bufferDone
+	if bw.next == nil {
+		return nil
+	}
+
+	err := bw.writeHead()
+	if err != nil {
+		return err
+	}
+	if !bw.Chunked {
+		_, err = bw.next.WriteBody(bw.Body.Bytes())
+		return err
+	}
+	if bw.Body.Len() > 0 {
+		_, err = bw.next.WriteChunkedBody(bw.Body.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	if trailers != nil {
+		return bw.next.WriteTrailers(trailers)
+	}
+	_, err = bw.next.WriteChunkedBodyDone()
+	return err
+}
+
+// Discard drops the response, e.g. once something has been sent in its
+// place.
+func (bw *BufferedWriter) Discard() {
+	bw.mode = bufferDone
+	bw.Body.Reset()
+}
+
+func (bw *BufferedWriter) buffer(p []byte) error {
+	bw.Body.Write(p)
+	if bw.Limit > 0 && bw.Body.Len() > bw.Limit {
+		return bw.overflow()
+	}
+	if bw.ContentLength >= 0 && bw.Body.Len() >= bw.ContentLength {
+		return bw.complete(nil)
+	}
+	return nil
+}
+
+func (bw *BufferedWriter) overflow() error {
+	if bw.hooks.Overflow == nil {
+		return bw.Pass()
+	}
+	return bw.hooks.Overflow(bw)
+}
+
+func (bw *BufferedWriter) complete(trailers headers.Headers) error {
+	bw.mode = bufferDone
+	if bw.hooks.Complete == nil {
+		return bw.Send(trailers)
+	}
+	return bw.hooks.Complete(bw, trailers)
+}
+
+func (bw *BufferedWriter) writeHead() error {
+	err := bw.next.WriteStatusLine(bw.Status)
+	if err != nil {
+		return err
+	}
+	return bw.next.WriteHeaders(bw.Header)
+}
@@ -0,0 +1,48 @@
+package response
+
+import (
+	"github.com/ratludu/httpfromtcp/internal/headers"
+)
+
+// BeforeHeaders wraps w so fn can adjust the headers a handler writes just
+// before they go out, e.g. to add headers of a middleware's own.
+func BeforeHeaders(w Writer, fn func(h headers.Headers)) Writer {
+	return &headerHook{next: w, fn: fn}
+}
+
+type headerHook struct {
+	next Writer
+	fn   func(h headers.Headers)
+}
+
+func (hw *headerHook) WriteStatusLine(statusCode StatusCode) error {
+	return hw.next.WriteStatusLine(statusCode)
+}
+
+func (hw *headerHook) WriteHeaders(h headers.Headers) error {
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	hw.fn(h)
+	return hw.next.WriteHeaders(h)
+}
+
+func (hw *headerHook) WriteBody(p []byte) (int, error) {
+	return hw.next.WriteBody(p)
+}
+
+func (hw *headerHook) WriteChunkedBody(p []byte) (int, error) {
+	return hw.next.WriteChunkedBody(p)
+}
+
+func (hw *headerHook) WriteChunkedBodyDone() (int, error) {
+	return hw.next.WriteChunkedBodyDone()
+}
+
+func (hw *headerHook) WriteTrailers(h headers.Headers) error {
+	return hw.next.WriteTrailers(h)
+}
+
+func (hw *headerHook) Unwrap() Writer {
+	return hw.next
+}
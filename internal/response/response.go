@@ -1,96 +1,360 @@
 package response
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/ratludu/httpfromtcp/internal/headers"
 )
 
+const crlf = "\r\n"
+
 type StatusCode int
 type WriterState int
 
 const (
-	Ok StatusCode = iota
-	BadRequest
-	InternalServerError
+	SwitchingProtocols   StatusCode = 101
+	Ok                   StatusCode = 200
+	NoContent            StatusCode = 204
+	NotModified          StatusCode = 304
+	BadRequest           StatusCode = 400
+	Unauthorized         StatusCode = 401
+	Forbidden            StatusCode = 403
+	NotFound             StatusCode = 404
+	MethodNotAllowed     StatusCode = 405
+	NotAcceptable        StatusCode = 406
+	PreconditionFailed   StatusCode = 412
+	ContentTooLarge      StatusCode = 413
+	UnsupportedMediaType StatusCode = 415
+	UpgradeRequired      StatusCode = 426
+	TooManyRequests      StatusCode = 429
+	InternalServerError  StatusCode = 500
+	NotImplemented       StatusCode = 501
+	ServiceUnavailable   StatusCode = 503
 )
 
 const (
 	StateStatusLine WriterState = iota
 	StateHeaders
 	StateBody
+	StateDone
+	StateHijacked
 )
 
-type Writer struct {
+var ErrNotHijackable = fmt.Errorf("Error: writer does not support hijacking")
+var ErrNotFlushable = fmt.Errorf("Error: writer does not support flushing")
+var ErrHijacked = fmt.Errorf("Error: connection has been hijacked")
+
+// ErrAbortHandler is a panic value for cutting a response short without
+// the panic being logged. The server closes the connection, or resets the
+// stream over HTTP/2, so the client can tell the response is incomplete.
+var ErrAbortHandler = fmt.Errorf("Error: handler aborted")
+
+// Writer is what a handler uses to send its response. ConnWriter is the
+// implementation the server hands out; middleware wraps it to change what
+// ends up on the wire. Middleware writers have an Unwrap method returning
+// the Writer they wrap, so Hijack and Flush can reach the connection.
+type Writer interface {
+	WriteStatusLine(statusCode StatusCode) error
+	WriteHeaders(headers headers.Headers) error
+	WriteBody(p []byte) (int, error)
+	WriteChunkedBody(p []byte) (int, error)
+	WriteChunkedBodyDone() (int, error)
+	WriteTrailers(h headers.Headers) error
+}
+
+// Hijacker is implemented by writers that can hand the underlying
+// connection over to the handler, e.g. after a 101 Switching Protocols.
+type Hijacker interface {
+	Hijack() (net.Conn, *bufio.ReadWriter, error)
+}
+
+// Hijack takes over the connection behind w, looking through any middleware
+// writers wrapping it.
+func Hijack(w Writer) (net.Conn, *bufio.ReadWriter, error) {
+	for {
+		if h, ok := w.(Hijacker); ok {
+			return h.Hijack()
+		}
+		u, ok := w.(interface{ Unwrap() Writer })
+		if !ok {
+			return nil, nil, ErrNotHijackable
+		}
+		w = u.Unwrap()
+	}
+}
+
+// Flusher is implemented by writers that can push buffered data to the
+// client straight away, e.g. for streaming responses.
+type Flusher interface {
+	Flush() error
+}
+
+// Flush sends any data buffered in w, or in the writers it wraps, to the
+// client.
+func Flush(w Writer) error {
+	for {
+		if f, ok := w.(Flusher); ok {
+			return f.Flush()
+		}
+		u, ok := w.(interface{ Unwrap() Writer })
+		if !ok {
+			return ErrNotFlushable
+		}
+		w = u.Unwrap()
+	}
+}
+
+// ConnWriter writes an HTTP/1.1 response to the underlying io.Writer and
+// enforces that the status line, headers and body are written in order.
+type ConnWriter struct {
 	writer io.Writer
 	state  WriterState
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// what KeepAlive needs to know about the response
+	status        StatusCode
+	close         bool
+	chunked       bool
+	contentLength int
+	bodyBytes     int
 }
 
-func NewWriter(w io.Writer) *Writer {
-	return &Writer{
+func NewWriter(w io.Writer) *ConnWriter {
+	return &ConnWriter{
 		writer: w,
 		state:  StateStatusLine,
 	}
 }
-func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	statusLine := statusCode.CreateHTTPMessage()
+
+// NewConnWriter returns a writer for conn that can be hijacked. reader is
+// the buffered reader the request was parsed from, so bytes the client sent
+// after the request are not lost.
+func NewConnWriter(conn net.Conn, reader *bufio.Reader) *ConnWriter {
+	return &ConnWriter{
+		writer: conn,
+		state:  StateStatusLine,
+		conn:   conn,
+		reader: reader,
+	}
+}
+
+// Hijack hands the connection to the caller, who becomes responsible for
+// closing it. Nothing else can be written through w afterwards.
+func (w *ConnWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.conn == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if w.state == StateHijacked {
+		return nil, nil, ErrHijacked
+	}
+
+	w.state = StateHijacked
+	return w.conn, bufio.NewReadWriter(w.reader, bufio.NewWriter(w.conn)), nil
+}
+
+// Flush flushes the underlying writer if it buffers; writes to a plain
+// connection already go straight out.
+func (w *ConnWriter) Flush() error {
+	if w.state == StateHijacked {
+		return ErrHijacked
+	}
+	if f, ok := w.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Hijacked reports whether Hijack has been called.
+func (w *ConnWriter) Hijacked() bool {
+	return w.state == StateHijacked
+}
+
+// KeepAlive reports whether the connection can carry another request once
+// this response is finished: the response has to be complete, framed by a
+// content-length or chunked encoding, and not marked "connection: close".
+func (w *ConnWriter) KeepAlive() bool {
+
+	if w.close || w.state == StateStatusLine || w.state == StateHeaders || w.state == StateHijacked {
+		return false
+	}
+	if w.status == 204 || w.status == 304 || w.status < 200 {
+		return true
+	}
+	if w.chunked {
+		return w.state == StateDone
+	}
+	return w.contentLength >= 0 && w.bodyBytes == w.contentLength
+}
+
+// State reports how far through the response the writer is.
+func (w *ConnWriter) State() WriterState {
+	return w.state
+}
+
+func (w *ConnWriter) WriteStatusLine(statusCode StatusCode) error {
+	if w.state != StateStatusLine {
+		return fmt.Errorf("Error: status line already written, state: %d", w.state)
+	}
+
+	statusLine := statusCode.CreateHTTPMessage() + crlf
 	_, err := w.writer.Write([]byte(statusLine))
 	if err != nil {
 		return err
 	}
+	w.status = statusCode
+	w.state = StateHeaders
 	return nil
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
-
-	var msgHeaders string
-	for k, v := range headers {
-		msgHeaders += fmt.Sprintf("%s: %s\r\n", k, v)
+func (w *ConnWriter) WriteHeaders(h headers.Headers) error {
+	if w.state != StateHeaders {
+		return fmt.Errorf("Error: headers written out of order, state: %d", w.state)
 	}
-	msgHeaders += "\r\n"
 
-	_, err := w.writer.Write([]byte(msgHeaders))
+	_, err := w.writer.Write([]byte(formatHeaders(h)))
 	if err != nil {
 		return err
 	}
+
+	// handlers may Set keys in any case; Add lower-cases them
+	sent := headers.NewHeaders()
+	for k, v := range h {
+		sent.Add(k, v)
+	}
+	w.close = sent.HasToken("connection", "close")
+	w.chunked = sent.HasToken("transfer-encoding", "chunked")
+	w.contentLength = -1
+	if n, err := sent.Get("content-length"); err == nil {
+		w.contentLength = n
+	}
+	w.state = StateBody
 	return nil
 }
 
-func (w *Writer) WriteBody(p []byte) (int, error) {
-	n, err := w.writer.Write([]byte(p))
+func (w *ConnWriter) WriteBody(p []byte) (int, error) {
+	if w.state != StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", w.state)
+	}
+
+	n, err := w.writer.Write(p)
+	w.bodyBytes += n
 	if err != nil {
 		return n, err
 	}
 	return n, nil
 }
 
-func (s StatusCode) GetCode() int {
-	switch s {
-	case Ok:
-		return 200
-	case BadRequest:
-		return 400
-	default:
-		return 500
+// WriteChunkedBody writes p as a single chunk. The caller is responsible for
+// having sent "transfer-encoding: chunked" in the headers.
+func (w *ConnWriter) WriteChunkedBody(p []byte) (int, error) {
+	if w.state != StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", w.state)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	chunk := fmt.Sprintf("%x%s%s%s", len(p), crlf, p, crlf)
+	_, err := w.writer.Write([]byte(chunk))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteChunkedBodyDone writes the last chunk and ends the response. Use
+// WriteTrailers instead when the response has trailer fields.
+func (w *ConnWriter) WriteChunkedBodyDone() (int, error) {
+	if w.state != StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", w.state)
+	}
+
+	n, err := w.writer.Write([]byte("0" + crlf + crlf))
+	if err != nil {
+		return n, err
 	}
+	w.state = StateDone
+	return n, nil
+}
+
+// WriteTrailers writes the last chunk followed by the trailer fields in h
+// and ends the response.
+func (w *ConnWriter) WriteTrailers(h headers.Headers) error {
+	if w.state != StateBody {
+		return fmt.Errorf("Error: trailers written before headers, state: %d", w.state)
+	}
+
+	_, err := w.writer.Write([]byte("0" + crlf + formatHeaders(h)))
+	if err != nil {
+		return err
+	}
+	w.state = StateDone
+	return nil
+}
+
+func formatHeaders(h headers.Headers) string {
+
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var msgHeaders string
+	for _, k := range keys {
+		// set-cookie values are stored one per line, see headers.Add
+		for _, v := range strings.Split(h[k], "\n") {
+			msgHeaders += fmt.Sprintf("%s: %s%s", k, v, crlf)
+		}
+	}
+	msgHeaders += crlf
+
+	return msgHeaders
+}
+
+func (s StatusCode) GetCode() int {
+	return int(s)
 }
 
 func (s StatusCode) GetMessage() string {
 	switch s {
+	case SwitchingProtocols:
+		return "Switching Protocols"
 	case Ok:
 		return "OK"
 	case BadRequest:
 		return "Bad Request"
-	default:
+	case Forbidden:
+		return "Forbidden"
+	case MethodNotAllowed:
+		return "Method Not Allowed"
+	case ContentTooLarge:
+		return "Content Too Large"
+	case UnsupportedMediaType:
+		return "Unsupported Media Type"
+	case UpgradeRequired:
+		return "Upgrade Required"
+	case InternalServerError:
 		return "Internal Server Error"
+	case NotImplemented:
+		return "Not Implemented"
+	default:
+		return http.StatusText(int(s))
 	}
 
 }
 
 func (s StatusCode) CreateHTTPMessage() string {
-	return fmt.Sprintf("HTTP/1.1 %d %s\n", s.GetCode(), s.GetMessage())
+	return fmt.Sprintf("HTTP/1.1 %d %s", s.GetCode(), s.GetMessage())
 }
 
 func GetDefaultHeaders(contentLen int, contentType string) headers.Headers {
@@ -98,7 +362,6 @@ func GetDefaultHeaders(contentLen int, contentType string) headers.Headers {
 	header := headers.NewHeaders()
 	strContentLen := strconv.Itoa(contentLen)
 	header["content-length"] = strContentLen
-	header["connection"] = "close"
 	header["content-type"] = contentType
 
 	return header
@@ -1,9 +1,13 @@
 package response
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
+	"github.com/ratludu/httpfromtcp/internal/headers"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHeader(t *testing.T) {
@@ -23,3 +27,164 @@ func TestHeader(t *testing.T) {
 	msg = s.CreateHTTPMessage()
 	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", msg)
 }
+
+func TestWriter_Chunked(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+
+	_, err := w.WriteBody([]byte("early"))
+	require.Error(t, err)
+
+	require.NoError(t, w.WriteStatusLine(Ok))
+	h := headers.NewHeaders()
+	h.Set("transfer-encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("x-sum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nx-sum: abc\r\n\r\n", buf.String())
+}
+
+func TestTrackingWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := NewTrackingWriter(NewWriter(buf))
+	assert.Equal(t, StatusCode(0), tw.Status())
+
+	require.NoError(t, tw.WriteStatusLine(BadRequest))
+	require.NoError(t, tw.WriteHeaders(GetDefaultHeaders(5, "text/plain")))
+	_, err := tw.WriteBody([]byte("oops!"))
+	require.NoError(t, err)
+
+	assert.Equal(t, BadRequest, tw.Status())
+	assert.Equal(t, 5, tw.BytesWritten())
+	assert.Equal(t, StateBody, tw.State())
+
+	// Test: a rejected write doesn't move the state along
+	require.Error(t, tw.WriteStatusLine(Ok))
+	assert.Equal(t, BadRequest, tw.Status())
+}
+
+func TestWriter_KeepAlive(t *testing.T) {
+	respond := func(h headers.Headers, body string) *ConnWriter {
+		w := NewWriter(new(bytes.Buffer))
+		w.WriteStatusLine(Ok)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+		return w
+	}
+
+	h := headers.Headers{"content-length": "5"}
+	assert.True(t, respond(h, "hello").KeepAlive())
+
+	// Test: a short body leaves the connection out of sync
+	assert.False(t, respond(h, "hel").KeepAlive())
+
+	// Test: the default headers leave the connection open
+	assert.True(t, respond(GetDefaultHeaders(5, "text/plain"), "hello").KeepAlive())
+
+	// Test: the handler can still ask for close, in any case
+	h = GetDefaultHeaders(5, "text/plain")
+	h.Set("Connection", "Close")
+	assert.False(t, respond(h, "hello").KeepAlive())
+
+	// Test: no framing means the body ends when the connection does
+	assert.False(t, respond(headers.Headers{}, "hello").KeepAlive())
+
+	// Test: chunked bodies have to be finished
+	w := NewWriter(new(bytes.Buffer))
+	w.WriteStatusLine(Ok)
+	w.WriteHeaders(headers.Headers{"transfer-encoding": "chunked"})
+	w.WriteChunkedBody([]byte("hello"))
+	assert.False(t, w.KeepAlive())
+	w.WriteChunkedBodyDone()
+	assert.True(t, w.KeepAlive())
+}
+
+func TestBufferedWriter(t *testing.T) {
+	upper := BufferHooks{
+		Complete: func(bw *BufferedWriter, trailers headers.Headers) error {
+			body := bytes.ToUpper(bw.Body.Bytes())
+			bw.Body.Reset()
+			bw.Body.Write(body)
+			return bw.Send(trailers)
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	bw := NewBufferedWriter(NewWriter(buf), upper)
+	require.NoError(t, bw.WriteStatusLine(Ok))
+	require.NoError(t, bw.WriteHeaders(GetDefaultHeaders(5, "text/plain")))
+	assert.Empty(t, buf.String())
+	_, err := bw.WriteBody([]byte("hel"))
+	require.NoError(t, err)
+	assert.True(t, bw.Buffering())
+	_, err = bw.WriteBody([]byte("lo"))
+	require.NoError(t, err)
+	assert.False(t, bw.Buffering())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 5\r\ncontent-type: text/plain\r\n\r\nHELLO", buf.String())
+
+	// Test: chunked bodies keep their framing and trailers
+	buf.Reset()
+	bw = NewBufferedWriter(NewWriter(buf), upper)
+	bw.WriteStatusLine(Ok)
+	bw.WriteHeaders(headers.Headers{"transfer-encoding": "chunked"})
+	bw.WriteChunkedBody([]byte("hi"))
+	require.NoError(t, bw.WriteTrailers(headers.Headers{"x-sum": "abc"}))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n2\r\nHI\r\n0\r\nx-sum: abc\r\n\r\n", buf.String())
+
+	// Test: bodies over the limit go through as they are
+	buf.Reset()
+	bw = NewBufferedWriter(NewWriter(buf), upper)
+	bw.Limit = 2
+	bw.WriteStatusLine(Ok)
+	bw.WriteHeaders(GetDefaultHeaders(5, "text/plain"))
+	bw.WriteBody([]byte("he"))
+	assert.Empty(t, buf.String())
+	bw.WriteBody([]byte("llo"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 5\r\ncontent-type: text/plain\r\n\r\nhello", buf.String())
+
+	// Test: Close sends a body the handler left short
+	buf.Reset()
+	bw = NewBufferedWriter(NewWriter(buf), upper)
+	bw.WriteStatusLine(Ok)
+	bw.WriteHeaders(GetDefaultHeaders(5, "text/plain"))
+	bw.WriteBody([]byte("hel"))
+	require.NoError(t, bw.Close())
+	assert.Contains(t, buf.String(), "\r\n\r\nHEL")
+
+	// Test: responses Headers doesn't buffer, or drops, never wait
+	buf.Reset()
+	bw = NewBufferedWriter(NewWriter(buf), BufferHooks{
+		Headers: func(bw *BufferedWriter) (bool, error) {
+			if bw.Status == NotFound {
+				bw.Discard()
+			}
+			return false, nil
+		},
+	})
+	bw.WriteStatusLine(NotFound)
+	bw.WriteHeaders(GetDefaultHeaders(5, "text/plain"))
+	bw.WriteBody([]byte("hello"))
+	assert.Empty(t, buf.String())
+	bw = NewBufferedWriter(NewWriter(buf), BufferHooks{
+		Headers: func(bw *BufferedWriter) (bool, error) { return false, nil },
+	})
+	bw.WriteStatusLine(Ok)
+	bw.WriteHeaders(GetDefaultHeaders(5, "text/plain"))
+	assert.Contains(t, buf.String(), "HTTP/1.1 200 OK")
+	bw.WriteBody([]byte("hello"))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+
+	// Test: a nil writer discards
+	bw = NewBufferedWriter(nil, BufferHooks{})
+	bw.Limit = 1
+	bw.WriteStatusLine(Ok)
+	bw.WriteHeaders(nil)
+	_, err = bw.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, bw.Flush())
+}
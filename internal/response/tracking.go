@@ -0,0 +1,88 @@
+package response
+
+import (
+	"github.com/ratludu/httpfromtcp/internal/headers"
+)
+
+// TrackingWriter wraps a Writer and remembers the status sent and how many
+// body bytes went out, for middleware that reports on the response once the
+// handler is done.
+type TrackingWriter struct {
+	next   Writer
+	status StatusCode
+	bytes  int
+	state  WriterState
+}
+
+func NewTrackingWriter(w Writer) *TrackingWriter {
+	return &TrackingWriter{next: w}
+}
+
+// Status is the status line written so far, or 0 if there hasn't been one.
+func (tw *TrackingWriter) Status() StatusCode {
+	return tw.status
+}
+
+// BytesWritten counts body bytes, not headers or chunk framing.
+func (tw *TrackingWriter) BytesWritten() int {
+	return tw.bytes
+}
+
+// State reports how far the response got. Only calls that succeeded move
+// it along.
+func (tw *TrackingWriter) State() WriterState {
+	return tw.state
+}
+
+func (tw *TrackingWriter) WriteStatusLine(statusCode StatusCode) error {
+	err := tw.next.WriteStatusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	tw.status = statusCode
+	tw.state = StateHeaders
+	return nil
+}
+
+func (tw *TrackingWriter) WriteHeaders(h headers.Headers) error {
+	err := tw.next.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	tw.state = StateBody
+	return nil
+}
+
+func (tw *TrackingWriter) WriteBody(p []byte) (int, error) {
+	n, err := tw.next.WriteBody(p)
+	tw.bytes += n
+	return n, err
+}
+
+func (tw *TrackingWriter) WriteChunkedBody(p []byte) (int, error) {
+	n, err := tw.next.WriteChunkedBody(p)
+	tw.bytes += n
+	return n, err
+}
+
+func (tw *TrackingWriter) WriteChunkedBodyDone() (int, error) {
+	n, err := tw.next.WriteChunkedBodyDone()
+	if err != nil {
+		return n, err
+	}
+	tw.state = StateDone
+	return n, nil
+}
+
+func (tw *TrackingWriter) WriteTrailers(h headers.Headers) error {
+	err := tw.next.WriteTrailers(h)
+	if err != nil {
+		return err
+	}
+	tw.state = StateDone
+	return nil
+}
+
+func (tw *TrackingWriter) Unwrap() Writer {
+	return tw.next
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/response"
+)
+
+// DefaultQueueTimeout is how long a request waits for an in-flight slot
+// before it is turned away.
+const DefaultQueueTimeout = 5 * time.Second
+
+// DefaultRetryAfter is what 503 responses tell clients to wait before
+// trying again.
+const DefaultRetryAfter = 5 * time.Second
+
+// limiter hands out a fixed number of slots. Callers that can't get one
+// straight away wait in a queue, which may itself be bounded.
+type limiter struct {
+	slots    chan struct{}
+	maxQueue int64
+	queued   atomic.Int64
+}
+
+func newLimiter(n, maxQueue int) *limiter {
+	return &limiter{slots: make(chan struct{}, n), maxQueue: int64(maxQueue)}
+}
+
+func (l *limiter) tryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire waits up to timeout for a slot, or for as long as it takes if
+// timeout isn't positive. It gives up at once if the queue is full.
+func (l *limiter) acquire(timeout time.Duration) bool {
+
+	if l.tryAcquire() {
+		return true
+	}
+
+	queued := l.queued.Add(1)
+	defer l.queued.Add(-1)
+	if l.maxQueue > 0 && queued > l.maxQueue {
+		return false
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+// initLimits sets up the limiters from the exported fields, once, since
+// servers are usually built as struct literals.
+func (s *Server) initLimits() {
+	s.limitsOnce.Do(func() {
+		if s.MaxConns > 0 {
+			s.conns = newLimiter(s.MaxConns, 0)
+		}
+		if s.MaxInFlight > 0 {
+			s.inFlight = newLimiter(s.MaxInFlight, s.MaxQueue)
+		}
+	})
+}
+
+// overloaded is the 503 sent when the server is saturated.
+func (s *Server) overloaded() HandlerError {
+
+	retryAfter := s.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	seconds := max(1, int((retryAfter+time.Second-1)/time.Second))
+
+	h := headers.NewHeaders()
+	h.Set("retry-after", strconv.Itoa(seconds))
+	return HandlerError{StatusCode: response.ServiceUnavailable, Message: "Service Unavailable", Headers: h}
+}
+
+// shedConn turns away a connection over MaxConns. The deadline keeps a
+// client that never reads from holding on to the goroutine.
+func (s *Server) shedConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	s.overloaded().Write(response.NewConnWriter(conn, nil))
+	conn.Close()
+}
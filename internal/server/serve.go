@@ -1,48 +1,191 @@
 package server
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/http2"
+	"github.com/ratludu/httpfromtcp/internal/proxyproto"
 	"github.com/ratludu/httpfromtcp/internal/request"
 	"github.com/ratludu/httpfromtcp/internal/response"
 )
 
+// DefaultIdleTimeout is how long a kept-alive connection may sit between
+// requests before it is closed.
+const DefaultIdleTimeout = 2 * time.Minute
+
+// DefaultReadHeaderTimeout is how long a client has to send a request's
+// line and headers once it has started it.
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// DefaultReadTimeout is how long a client has to send a whole request,
+// body included, once it has started it.
+const DefaultReadTimeout = time.Minute
+
+// DefaultMaxBodySize is the largest request body accepted, the same limit
+// HTTP/2 streams are held to.
+const DefaultMaxBodySize = 10 << 20
+
 type Server struct {
 	Closed   atomic.Bool
 	Listener net.Listener
 	Handler  Handler
 	Port     int
+
+	// IdleTimeout bounds the wait for the next request on a kept-alive
+	// connection, or for a new stream on an HTTP/2 one with none left
+	// open. Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout bounds reading the request line and headers of
+	// every request, and a PROXY protocol header or HTTP/2 preface before
+	// them, so a client can't hold a connection by sending nothing. For
+	// HTTP/2 it bounds each header block. Zero means
+	// DefaultReadHeaderTimeout.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading a whole request, from its first byte to
+	// the end of its body, so a client can't hold a connection by sending
+	// the body slowly once the headers are in. HTTP/2 requests are timed
+	// from their HEADERS frame. Zero means DefaultReadTimeout.
+	ReadTimeout time.Duration
+	// MaxBodySize caps HTTP/1.1 request bodies; larger ones are answered
+	// with a 413 and the connection closed. Zero means DefaultMaxBodySize.
+	MaxBodySize int
+	// ConnState, if set, is called whenever a connection changes state.
+	ConnState func(net.Conn, ConnState)
+	// ParseError, if set, is called with each request the parser rejects.
+	ParseError func(error)
+	// Panic, if set, is called with each handler panic the server
+	// recovers, e.g. to report it to an error tracker.
+	Panic func(*PanicInfo)
+
+	// MaxConns caps the connections served at once. Zero means no cap.
+	// Connections over it wait to be served, or are answered with a 503
+	// and closed if ShedLoad is set.
+	MaxConns int
+	ShedLoad bool
+	// MaxInFlight caps the requests being handled at once, across all
+	// connections. Zero means no cap. Requests over it queue for up to
+	// QueueTimeout (zero means DefaultQueueTimeout), with at most MaxQueue
+	// waiting (zero means no bound), and are answered with a 503 if they
+	// don't get a turn.
+	MaxInFlight  int
+	MaxQueue     int
+	QueueTimeout time.Duration
+	// RetryAfter is sent with 503s. Zero means DefaultRetryAfter.
+	RetryAfter time.Duration
+
+	// TrustedProxies lists the load balancers allowed to use the PROXY
+	// protocol. Connections from them have to start with a v1 or v2
+	// header, and are served as coming from the client it names.
+	// Connections from anywhere else are served as they are.
+	TrustedProxies []netip.Prefix
+
+	connIDs    atomic.Uint64
+	limitsOnce sync.Once
+	conns      *limiter
+	inFlight   *limiter
+}
+
+// PanicInfo describes a recovered handler panic.
+type PanicInfo struct {
+	Value   any
+	Stack   []byte
+	Request *request.Request
 }
 
-type Handler func(w *response.Writer, r *request.Request)
+// ConnState is where a connection is in its life, as reported to
+// Server.ConnState.
+type ConnState int
+
+const (
+	// StateNew is a connection that has just been accepted.
+	StateNew ConnState = iota
+	// StateActive is a connection with a request being handled.
+	StateActive
+	// StateIdle is a kept-alive connection waiting for its next request.
+	StateIdle
+	// StateHijacked is a connection a handler took over. It is final: the
+	// server doesn't report it closing.
+	StateHijacked
+	// StateClosed is a connection the server has closed.
+	StateClosed
+)
+
+type Handler func(w response.Writer, r *request.Request)
 
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    string
+	// Headers are sent alongside the default ones, e.g. Retry-After.
+	Headers headers.Headers
+}
+
+// Write sends the error to w as a plain text response.
+func (he HandlerError) Write(w response.Writer) {
+
+	body := []byte(he.Message + "\n")
+	h := response.GetDefaultHeaders(len(body), "text/plain")
+	for k, v := range he.Headers {
+		h.Set(k, v)
+	}
+
+	err := w.WriteStatusLine(he.StatusCode)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	_, err = w.WriteBody(body)
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
 }
 
 func Serve(port int, handlerFunc Handler) (*Server, error) {
 	// creates a net.listener and returns a new Server
 	// starts listening for requests using a go routine
 
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	s := &Server{
+		Closed:  atomic.Bool{},
+		Handler: handlerFunc,
+		Port:    port,
+	}
+	err := s.Start()
 	if err != nil {
 		fmt.Println("Error:", err)
 		return nil, err
 	}
-	s := &Server{
-		Closed:   atomic.Bool{},
-		Listener: l,
-		Handler:  handlerFunc,
-		Port:     port,
+
+	return s, nil
+}
+
+// Start listens on s.Port and accepts connections in the background. It is
+// Serve for a Server whose fields the caller set up first.
+func (s *Server) Start() error {
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return err
 	}
+	s.Listener = l
 
 	go s.listen()
 
-	return s, nil
+	return nil
 }
 
 func (s *Server) Close() error {
@@ -58,6 +201,7 @@ func (s *Server) Close() error {
 func (s *Server) listen() {
 	//  Uses a loop to .Accept new connections as they come in, and handles each one in a new goroutine. I used an atomic.Bool to track whether the server is closed or not so that I can ignore connection errors after the server is closed.
 
+	s.initLimits()
 	for {
 		conn, err := s.Listener.Accept()
 		if err != nil {
@@ -65,47 +209,255 @@ func (s *Server) listen() {
 			return
 		}
 
+		if s.conns != nil {
+			if s.ShedLoad {
+				if !s.conns.tryAcquire() {
+					go s.shedConn(conn)
+					continue
+				}
+			} else {
+				s.conns.acquire(0)
+			}
+		}
+
 		if s.Closed.Load() {
+			conn.Close()
 			return
 		}
 
-		go s.handle(conn)
+		go func() {
+			s.ServeConn(conn)
+			if s.conns != nil {
+				s.conns.release()
+			}
+		}()
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
+// ServeConn serves a single connection that was accepted elsewhere, e.g.
+// one end of a net.Pipe in tests. Requests are read one after another for
+// as long as the responses allow the connection to be kept alive. It
+// returns once the connection is done.
+func (s *Server) ServeConn(conn net.Conn) {
 
-	defer conn.Close()
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		fmt.Println("Error:", err)
+	idleTimeout := s.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	headerTimeout := s.ReadHeaderTimeout
+	if headerTimeout <= 0 {
+		headerTimeout = DefaultReadHeaderTimeout
+	}
+	readTimeout := s.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = DefaultReadTimeout
+	}
+	maxBodySize := s.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+
+	reader := bufio.NewReaderSize(conn, request.MaxLineSize)
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	if proxyproto.Trusted(conn.RemoteAddr(), s.TrustedProxies) {
+		// from here on the connection reports the client's address
+		h, err := proxyproto.Read(reader)
+		if err != nil {
+			fmt.Println("Error:", err)
+			conn.Close()
+			return
+		}
+		conn = proxyproto.NewConn(conn, h)
+	}
+
+	s.setState(conn, StateNew)
+	info := &connInfo{id: s.connIDs.Add(1), conn: conn}
+	timeouts := http2.Timeouts{Idle: idleTimeout, ReadHeader: headerTimeout, Read: readTimeout}
+	if http2.HasPreface(reader) {
+		s.setState(conn, StateActive)
+		s.serveHTTP2(conn, reader, nil, info, timeouts)
 		return
 	}
 
-	buf := new(bytes.Buffer)
+	for first := true; ; first = false {
+		if !first {
+			// idle until the next request starts, then the same time
+			// for its headers as the first one had
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+			_, err := reader.Peek(1)
+			if err != nil {
+				break
+			}
+		}
+		start := time.Now()
+		conn.SetReadDeadline(start.Add(headerTimeout))
+		req, err := request.ReadRequest(reader, maxBodySize, func() {
+			conn.SetReadDeadline(start.Add(readTimeout))
+		})
+		if err != nil {
+			// a client hanging up between requests is the normal end of
+			// a kept-alive connection
+			if !errors.Is(err, io.EOF) && !isTimeout(err) {
+				fmt.Println("Error:", err)
+				if s.ParseError != nil {
+					s.ParseError(err)
+				}
+				rejectRequest(conn, err)
+			}
+			break
+		}
+		// the handler, or whoever hijacks the connection, sets its own
+		conn.SetReadDeadline(time.Time{})
+		s.setState(conn, StateActive)
 
-	w := response.NewWriter(conn)
+		if first && http2.IsUpgrade(req) {
+			s.serveHTTP2(conn, reader, req, info, timeouts)
+			return
+		}
+		info.fill(req)
 
-	s.Handler(w, req)
+		w := response.NewConnWriter(conn, reader)
 
-	defaultHeaders := response.GetDefaultHeaders(buf.Len(), "text/html")
-	statusOk := response.Ok
-	err = w.WriteStatusLine(statusOk)
-	if err != nil {
-		fmt.Println("Error:", err)
-		return
+		abort := s.handle(w, req)
+
+		// a hijacked connection belongs to the handler now
+		if w.Hijacked() && !abort {
+			s.setState(conn, StateHijacked)
+			return
+		}
+		if abort || !w.KeepAlive() || req.Headers.HasToken("connection", "close") {
+			break
+		}
+		s.setState(conn, StateIdle)
 	}
 
-	err = w.WriteHeaders(defaultHeaders)
-	if err != nil {
-		fmt.Println("Error:", err)
+	conn.Close()
+	s.setState(conn, StateClosed)
+}
+
+// handle runs the handler once there is an in-flight slot for it, or
+// answers 503 if there isn't one in time. A panic in the handler is
+// answered with a 500 if nothing has been sent yet; otherwise handle
+// reports abort, since the response was cut short and the connection
+// can't be reused.
+func (s *Server) handle(w response.Writer, req *request.Request) (abort bool) {
+
+	s.initLimits()
+	if s.inFlight != nil {
+		queueTimeout := s.QueueTimeout
+		if queueTimeout <= 0 {
+			queueTimeout = DefaultQueueTimeout
+		}
+		if !s.inFlight.acquire(queueTimeout) {
+			s.overloaded().Write(w)
+			return false
+		}
+		defer s.inFlight.release()
+	}
+
+	tw := response.NewTrackingWriter(w)
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		abort = true
+		if p == response.ErrAbortHandler {
+			return
+		}
+
+		info := &PanicInfo{Value: p, Stack: debug.Stack(), Request: req}
+		fmt.Printf("Error: panic serving %s %s for %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, req.RemoteAddr, p, info.Stack)
+		if s.Panic != nil {
+			s.Panic(info)
+		}
+
+		if tw.State() == response.StateStatusLine {
+			HandlerError{StatusCode: response.InternalServerError, Message: "Internal Server Error"}.Write(tw)
+			abort = false
+		}
+	}()
+
+	s.Handler(tw, req)
+	return false
+}
+
+// handleHTTP2 serves HTTP/2 streams through handle, turning an aborted
+// response into a stream reset.
+func (s *Server) handleHTTP2(w response.Writer, req *request.Request) {
+	if s.handle(w, req) {
+		panic(response.ErrAbortHandler)
+	}
+}
+
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	if s.ConnState != nil {
+		s.ConnState(conn, state)
+	}
+}
+
+// connInfo is what requests learn about the connection they came on.
+type connInfo struct {
+	id   uint64
+	conn net.Conn
+	// HTTP/2 streams are numbered as they are handled, concurrently
+	seq atomic.Int64
+}
+
+func (ci *connInfo) fill(req *request.Request) {
+	req.RemoteAddr = ci.conn.RemoteAddr().String()
+	req.LocalAddr = ci.conn.LocalAddr().String()
+	req.ConnID = ci.id
+	req.Seq = int(ci.seq.Add(1))
+	if tc, ok := ci.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tc.ConnectionState()
+		req.TLS = &state
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// rejectRequest answers a request the parser refused. Nothing is sent if
+// the client went away, since there is nobody left to tell.
+func rejectRequest(conn net.Conn, err error) {
+
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
 		return
 	}
 
-	_, err = w.WriteBody(buf.Bytes())
+	he := HandlerError{StatusCode: response.BadRequest, Message: "Bad Request"}
+	if errors.Is(err, request.ErrUnsupportedTransferEncoding) {
+		he = HandlerError{StatusCode: response.NotImplemented, Message: "Not Implemented"}
+	}
+	if errors.Is(err, request.ErrBodyTooLarge) {
+		he = HandlerError{StatusCode: response.ContentTooLarge, Message: "Content Too Large"}
+	}
+	he.Write(response.NewConnWriter(conn, nil))
+}
+
+// serveHTTP2 hands the connection to the HTTP/2 server, either straight
+// away for prior knowledge or after answering an h2c upgrade request. The
+// connection's timeouts carry over to its frames.
+func (s *Server) serveHTTP2(conn net.Conn, reader *bufio.Reader, upgrade *request.Request, info *connInfo, timeouts http2.Timeouts) {
+
+	handler := func(w response.Writer, req *request.Request) {
+		info.fill(req)
+		s.handleHTTP2(w, req)
+	}
+
+	var err error
+	if upgrade != nil {
+		err = http2.ServeUpgrade(conn, reader, handler, upgrade, timeouts)
+	} else {
+		err = http2.ServeConn(conn, reader, handler, timeouts)
+	}
 	if err != nil {
 		fmt.Println("Error:", err)
-		return
 	}
-
+	conn.Close()
+	s.setState(conn, StateClosed)
 }
@@ -0,0 +1,307 @@
+// Package servertest provides utilities for testing server.Handlers
+// without opening a port: a recorder that captures what a handler writes, a
+// builder for requests, a clock to control time with, and an in-process
+// server reached over net.Pipe.
+package servertest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// DefaultHost is the host header NewRequest fills in when none is given.
+const DefaultHost = "example.com"
+
+// DefaultRemoteAddr is the client address NewRequest fills in, from the
+// TEST-NET-1 documentation range.
+const DefaultRemoteAddr = "192.0.2.1:1234"
+
+// ResponseRecorder is a response.Writer that keeps everything the handler
+// wrote. Chunked bodies are recorded already de-chunked. Writes out of order
+// fail the same way they do on a connection.
+type ResponseRecorder struct {
+	Code     response.StatusCode
+	Headers  headers.Headers
+	Body     *bytes.Buffer
+	Trailers headers.Headers
+	// Chunked is set once the handler writes a chunked body.
+	Chunked bool
+	// Flushed is set once the handler calls Flush.
+	Flushed bool
+
+	state response.WriterState
+}
+
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{
+		Body: new(bytes.Buffer),
+	}
+}
+
+// State reports how far the handler got through the response.
+func (rec *ResponseRecorder) State() response.WriterState {
+	return rec.state
+}
+
+func (rec *ResponseRecorder) WriteStatusLine(statusCode response.StatusCode) error {
+	if rec.state != response.StateStatusLine {
+		return fmt.Errorf("Error: status line already written, state: %d", rec.state)
+	}
+	rec.Code = statusCode
+	rec.state = response.StateHeaders
+	return nil
+}
+
+func (rec *ResponseRecorder) WriteHeaders(h headers.Headers) error {
+	if rec.state != response.StateHeaders {
+		return fmt.Errorf("Error: headers written out of order, state: %d", rec.state)
+	}
+	rec.Headers = headers.NewHeaders()
+	for k, v := range h {
+		rec.Headers[strings.ToLower(k)] = v
+	}
+	rec.state = response.StateBody
+	return nil
+}
+
+func (rec *ResponseRecorder) WriteBody(p []byte) (int, error) {
+	if rec.state != response.StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", rec.state)
+	}
+	return rec.Body.Write(p)
+}
+
+func (rec *ResponseRecorder) WriteChunkedBody(p []byte) (int, error) {
+	if rec.state != response.StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", rec.state)
+	}
+	rec.Chunked = true
+	return rec.Body.Write(p)
+}
+
+func (rec *ResponseRecorder) WriteChunkedBodyDone() (int, error) {
+	if rec.state != response.StateBody {
+		return 0, fmt.Errorf("Error: body written before headers, state: %d", rec.state)
+	}
+	rec.Chunked = true
+	rec.state = response.StateDone
+	return 0, nil
+}
+
+func (rec *ResponseRecorder) WriteTrailers(h headers.Headers) error {
+	if rec.state != response.StateBody {
+		return fmt.Errorf("Error: trailers written before headers, state: %d", rec.state)
+	}
+	rec.Chunked = true
+	rec.Trailers = headers.NewHeaders()
+	for k, v := range h {
+		rec.Trailers[strings.ToLower(k)] = v
+	}
+	rec.state = response.StateDone
+	return nil
+}
+
+func (rec *ResponseRecorder) Flush() error {
+	rec.Flushed = true
+	return nil
+}
+
+// Header returns a recorded header value, or "" if it was not sent.
+func (rec *ResponseRecorder) Header(key string) string {
+	v, _ := rec.Headers.GetString(strings.ToLower(key))
+	return v
+}
+
+// RequestBuilder assembles a *request.Request as the parser would have
+// produced it.
+type RequestBuilder struct {
+	req *request.Request
+}
+
+// NewRequest starts an HTTP/1.1 request for target. The host header
+// defaults to DefaultHost and the client address to DefaultRemoteAddr.
+func NewRequest(method, target string) *RequestBuilder {
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "1.1",
+			RequestTarget: target,
+			Method:        method,
+		},
+		Headers:    headers.NewHeaders(),
+		RemoteAddr: DefaultRemoteAddr,
+	}
+	req.Headers.Set("host", DefaultHost)
+	return &RequestBuilder{req: req}
+}
+
+// Header adds a header, joining it with any earlier value the same way the
+// parser does for repeated fields.
+func (b *RequestBuilder) Header(key, value string) *RequestBuilder {
+	key = strings.ToLower(key)
+	if key == "host" {
+		b.req.Headers.Set(key, value)
+		return b
+	}
+	b.req.Headers.Add(key, value)
+	return b
+}
+
+// Body sets the body and a matching content-length.
+func (b *RequestBuilder) Body(body []byte) *RequestBuilder {
+	b.req.Body = body
+	b.req.Headers.Set("content-length", strconv.Itoa(len(body)))
+	return b
+}
+
+// RemoteAddr sets the client address the request appears to come from.
+func (b *RequestBuilder) RemoteAddr(addr string) *RequestBuilder {
+	b.req.RemoteAddr = addr
+	return b
+}
+
+// Request returns the built request. The builder can keep being used; each
+// call returns a fresh copy.
+func (b *RequestBuilder) Request() *request.Request {
+	req := *b.req
+	req.Headers = headers.NewHeaders()
+	for k, v := range b.req.Headers {
+		req.Headers[k] = v
+	}
+	req.Body = bytes.Clone(b.req.Body)
+	return &req
+}
+
+// Bytes returns the request as it would go over the wire.
+func (b *RequestBuilder) Bytes() []byte {
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s %s HTTP/%s\r\n", b.req.RequestLine.Method, b.req.RequestLine.RequestTarget, b.req.RequestLine.HttpVersion)
+	for _, k := range slices.Sorted(maps.Keys(b.req.Headers)) {
+		for _, line := range strings.Split(b.req.Headers[k], "\n") {
+			fmt.Fprintf(buf, "%s: %s\r\n", k, line)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(b.req.Body)
+	return buf.Bytes()
+}
+
+// Do runs h on the request b builds and returns what it wrote.
+func Do(h server.Handler, b *RequestBuilder) *ResponseRecorder {
+	rec := NewRecorder()
+	h(rec, b.Request())
+	return rec
+}
+
+// Clock is a clock that only moves when told to, for code that reads the
+// time through a now func, so tests can skip ahead instead of sleeping.
+type Clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewClock returns a Clock stopped at the start of 2024, UTC.
+func NewClock() *Clock {
+	return &Clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// Server runs a handler the way server.Server does, but each connection
+// is one end of a net.Pipe, so nothing listens on a port. Pipes have no
+// buffering: a write blocks until the other side reads it, so tests where
+// both sides write at once (e.g. websocket pings) want a real listener.
+type Server struct {
+	srv *server.Server
+
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func NewServer(handler server.Handler) *Server {
+	return &Server{
+		srv:   &server.Server{Handler: handler},
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Config is the server.Server connections are served by. Set hooks and
+// timeouts on it before the first Dial.
+func (s *Server) Config() *server.Server {
+	return s.srv
+}
+
+// Dial opens a new connection to the server and returns the client end.
+func (s *Server) Dial() (net.Conn, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+
+	client, conn := net.Pipe()
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.srv.ServeConn(conn)
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	return client, nil
+}
+
+// Client returns an http.Client whose connections all go to s, whatever
+// host the URL names.
+func (s *Server) Client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return s.Dial()
+			},
+		},
+	}
+}
+
+// Close closes every open connection and waits for their handlers to
+// return.
+func (s *Server) Close() {
+
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
@@ -0,0 +1,514 @@
+package servertest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(w response.Writer, r *request.Request) {
+	tag, _ := r.Headers.GetString("x-tag")
+	host, _ := r.Headers.GetString("host")
+	body := []byte(fmt.Sprintf("%s %s host=%s tag=%s body=%s", r.RequestLine.Method, r.RequestLine.RequestTarget, host, tag, r.Body))
+	w.WriteStatusLine(response.Ok)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body), "text/plain"))
+	w.WriteBody(body)
+}
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder()
+	req := NewRequest("POST", "/submit").Header("X-Tag", "a").Header("x-tag", "b").Body([]byte("hi")).Request()
+	echo(rec, req)
+
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "text/plain", rec.Header("Content-Type"))
+	assert.Equal(t, "POST /submit host=example.com tag=a, b body=hi", rec.Body.String())
+	assert.Equal(t, response.StateBody, rec.State())
+	assert.False(t, rec.Chunked)
+
+	// Test: chunked bodies and trailers
+	rec = NewRecorder()
+	require.NoError(t, rec.WriteStatusLine(response.Ok))
+	require.NoError(t, rec.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"}))
+	_, err := rec.WriteChunkedBody([]byte("one "))
+	require.NoError(t, err)
+	_, err = rec.WriteChunkedBody([]byte("two"))
+	require.NoError(t, err)
+	require.NoError(t, rec.WriteTrailers(headers.Headers{"X-Sum": "3"}))
+	assert.True(t, rec.Chunked)
+	assert.Equal(t, "one two", rec.Body.String())
+	assert.Equal(t, "3", rec.Trailers["x-sum"])
+	assert.Equal(t, response.StateDone, rec.State())
+
+	// Test: writes out of order fail
+	rec = NewRecorder()
+	_, err = rec.WriteBody([]byte("early"))
+	require.Error(t, err)
+	require.Error(t, rec.WriteHeaders(headers.NewHeaders()))
+}
+
+func TestRequestBuilder(t *testing.T) {
+	b := NewRequest("PUT", "/item").Header("Host", "api.test").Body([]byte("data"))
+
+	// Test: the wire form parses back to the same request
+	parsed, err := request.RequestFromReader(strings.NewReader(string(b.Bytes())))
+	require.NoError(t, err)
+	built := b.Request()
+	assert.Equal(t, built.RequestLine, parsed.RequestLine)
+	assert.Equal(t, built.Headers, parsed.Headers)
+	assert.Equal(t, built.Body, parsed.Body)
+
+	// Test: requests don't share state with the builder
+	built.Headers.Set("x-changed", "1")
+	_, err = b.Request().Headers.GetString("x-changed")
+	require.ErrorIs(t, err, headers.ErrKeyNotFound)
+}
+
+func TestDo(t *testing.T) {
+	rec := Do(func(w response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(response.GetDefaultHeaders(len(r.Body), "text/plain"))
+		w.WriteBody(r.Body)
+	}, NewRequest("POST", "/echo").Body([]byte("hi")))
+	assert.Equal(t, response.Ok, rec.Code)
+	assert.Equal(t, "hi", rec.Body.String())
+}
+
+func TestClock(t *testing.T) {
+	c := NewClock()
+	start := c.Now()
+	assert.Equal(t, start, c.Now())
+	c.Advance(time.Minute)
+	assert.Equal(t, time.Minute, c.Now().Sub(start))
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(echo)
+	// parallel subtests outlive the function body, so not defer
+	t.Cleanup(s.Close)
+
+	// Test: raw requests over a dialed connection
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	_, err = conn.Write(NewRequest("GET", "/raw").Bytes())
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	conn.Close()
+	assert.Equal(t, "GET /raw host=example.com tag= body=", string(body))
+
+	// Test: parallel requests through the client
+	client := s.Client()
+	for i := range 5 {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			resp, err := client.Post(fmt.Sprintf("http://any.host/%d", i), "text/plain", strings.NewReader("x"))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, fmt.Sprintf("POST /%d host=any.host tag= body=x", i), string(body))
+		})
+	}
+}
+
+func TestServer_KeepAlive(t *testing.T) {
+	s := NewServer(echo)
+	defer s.Close()
+	s.Config().IdleTimeout = 50 * time.Millisecond
+
+	// Test: requests follow one another on the same connection
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for _, target := range []string{"/one", "/two", "/three"} {
+		go conn.Write(NewRequest("GET", target).Bytes())
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "GET "+target+" host=example.com tag= body=", string(body))
+		assert.False(t, resp.Close)
+	}
+
+	// Test: the connection is closed once it has sat idle
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection: close ends it after the response
+	conn, err = s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	br = bufio.NewReader(conn)
+	go conn.Write(NewRequest("GET", "/last").Header("Connection", "close").Bytes())
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "GET /last host=example.com tag= body=", string(body))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServer_CloseUnblocksHandlers(t *testing.T) {
+	started := make(chan struct{})
+	s := NewServer(func(w response.Writer, r *request.Request) {
+		close(started)
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(response.GetDefaultHeaders(0, "text/plain"))
+	})
+
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(NewRequest("GET", "/").Bytes())
+	require.NoError(t, err)
+	<-started
+
+	// nobody reads the response, so only Close lets the handler finish
+	s.Close()
+	_, err = s.Dial()
+	require.Error(t, err)
+}
+
+func TestServer_RejectsMalformedRequests(t *testing.T) {
+	called := false
+	s := NewServer(func(w response.Writer, r *request.Request) { called = true })
+	defer s.Close()
+
+	send := func(raw string) *http.Response {
+		conn, err := s.Dial()
+		require.NoError(t, err)
+		defer conn.Close()
+		go conn.Write([]byte(raw))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := send("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp = send("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n")
+	assert.Equal(t, 501, resp.StatusCode)
+
+	// Test: bodies over MaxBodySize, declared or chunked
+	resp = send(fmt.Sprintf("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: %d\r\n\r\n", server.DefaultMaxBodySize+1))
+	assert.Equal(t, 413, resp.StatusCode)
+	resp = send(fmt.Sprintf("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n", server.DefaultMaxBodySize+1))
+	assert.Equal(t, 413, resp.StatusCode)
+	assert.False(t, called)
+}
+
+func TestServer_RecoversPanics(t *testing.T) {
+	s := NewServer(func(w response.Writer, r *request.Request) {
+		switch r.RequestLine.RequestTarget {
+		case "/early":
+			panic("boom")
+		case "/late":
+			w.WriteStatusLine(response.Ok)
+			w.WriteHeaders(response.GetDefaultHeaders(10, "text/plain"))
+			w.WriteBody([]byte("part"))
+			panic("boom")
+		case "/abort":
+			panic(response.ErrAbortHandler)
+		}
+		echo(w, r)
+	})
+	var panics []*server.PanicInfo
+	s.Config().Panic = func(p *server.PanicInfo) { panics = append(panics, p) }
+	t.Cleanup(s.Close)
+
+	send := func(target string) (*http.Response, error) {
+		conn, err := s.Dial()
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		go conn.Write(NewRequest("GET", target).Bytes())
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	// Test: nothing written yet, so the client gets a 500
+	resp, err := send("/early")
+	require.NoError(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	require.Len(t, panics, 1)
+	assert.Equal(t, "boom", panics[0].Value)
+	assert.Equal(t, "/early", panics[0].Request.RequestLine.RequestTarget)
+	assert.Contains(t, string(panics[0].Stack), "TestServer_RecoversPanics")
+
+	// Test: a response cut short ends with the connection
+	resp, err = send("/late")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Len(t, panics, 2)
+
+	// Test: ErrAbortHandler closes the connection without reporting
+	_, err = send("/abort")
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Len(t, panics, 2)
+
+	// Test: the server carries on
+	resp, err = send("/fine")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestServer_InFlightLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	s := NewServer(func(w response.Writer, r *request.Request) {
+		started <- struct{}{}
+		<-release
+		echo(w, r)
+	})
+	s.Config().MaxInFlight = 1
+	s.Config().MaxQueue = 1
+	s.Config().QueueTimeout = 50 * time.Millisecond
+	s.Config().RetryAfter = 1500 * time.Millisecond
+	t.Cleanup(s.Close)
+
+	send := func() <-chan *http.Response {
+		conn, err := s.Dial()
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		go conn.Write(NewRequest("GET", "/").Bytes())
+		ch := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err == nil {
+				io.ReadAll(resp.Body)
+			}
+			ch <- resp
+		}()
+		return ch
+	}
+
+	first := send()
+	<-started
+
+	// Test: the second request waits in the queue, the third finds it full
+	second := send()
+	time.Sleep(10 * time.Millisecond)
+	resp := <-send()
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	// Test: the queued request times out
+	resp = <-second
+	assert.Equal(t, 503, resp.StatusCode)
+
+	close(release)
+	resp = <-first
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestServer_ConnLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	s := &server.Server{
+		Handler: func(w response.Writer, r *request.Request) {
+			started <- struct{}{}
+			<-release
+			echo(w, r)
+		},
+		MaxConns: 1,
+		ShedLoad: true,
+	}
+	require.NoError(t, s.Start())
+	t.Cleanup(func() { s.Close() })
+	addr := s.Listener.Addr().String()
+
+	get := func() (*http.Response, error) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write(NewRequest("GET", "/").Header("Connection", "close").Bytes())
+		require.NoError(t, err)
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	first := make(chan *http.Response)
+	go func() {
+		resp, _ := get()
+		first <- resp
+	}()
+	<-started
+
+	// Test: a second connection is shed
+	resp, err := get()
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+
+	close(release)
+	assert.Equal(t, 200, (<-first).StatusCode)
+
+	// Test: the slot is free again once the first connection closes
+	require.Eventually(t, func() bool {
+		resp, err := get()
+		return err == nil && resp.StatusCode == 200
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_ReadHeaderTimeout(t *testing.T) {
+	s := NewServer(echo)
+	defer s.Close()
+	s.Config().ReadHeaderTimeout = 50 * time.Millisecond
+
+	// Test: a client that sends nothing is hung up on
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: so is one stuck part way through its headers
+	conn, err = s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+
+	// Test: the timeout covers headers, not a body sent slowly after them
+	conn, err = s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		conn.Write([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\na"))
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte("b"))
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestServer_ReadTimeout(t *testing.T) {
+	s := NewServer(echo)
+	defer s.Close()
+	s.Config().ReadTimeout = 50 * time.Millisecond
+
+	// Test: a body that never finishes arriving is hung up on
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	go conn.Write([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\na"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+
+	// Test: one that arrives in time is served
+	conn, err = s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	go conn.Write([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\nab"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	start := func(trusted ...string) string {
+		s := &server.Server{
+			Handler: func(w response.Writer, r *request.Request) {
+				body := []byte(r.RemoteAddr)
+				w.WriteStatusLine(response.Ok)
+				w.WriteHeaders(response.GetDefaultHeaders(len(body), "text/plain"))
+				w.WriteBody(body)
+			},
+		}
+		for _, p := range trusted {
+			s.TrustedProxies = append(s.TrustedProxies, netip.MustParsePrefix(p))
+		}
+		require.NoError(t, s.Start())
+		t.Cleanup(func() { s.Close() })
+		return s.Listener.Addr().String()
+	}
+
+	send := func(addr, raw string) (string, error) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	addr := start("127.0.0.0/8", "::1/128")
+	req := string(NewRequest("GET", "/").Bytes())
+	remote, err := send(addr, "PROXY TCP4 192.0.2.10 127.0.0.1 56324 443\r\n"+req)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.10:56324", remote)
+
+	// Test: LOCAL keeps the proxy's own address
+	remote, err = send(addr, "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"+req)
+	require.NoError(t, err)
+	assert.NotContains(t, remote, "192.0.2.10")
+	assert.NotEmpty(t, remote)
+
+	// Test: trusted sources have to send a header
+	_, err = send(addr, req)
+	require.Error(t, err)
+
+	// Test: nobody else may
+	addr = start("10.0.0.0/8")
+	remote, err = send(addr, "PROXY TCP4 192.0.2.10 127.0.0.1 56324 443\r\n"+req)
+	require.NoError(t, err)
+	assert.Equal(t, "Bad Request\n", remote)
+}
+
+func TestServer_ConnectionInfo(t *testing.T) {
+	s := NewServer(func(w response.Writer, r *request.Request) {
+		body := []byte(fmt.Sprintf("conn=%d seq=%d remote=%s local=%s tls=%t", r.ConnID, r.Seq, r.RemoteAddr, r.LocalAddr, r.TLS != nil))
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(headers.Headers{"content-length": fmt.Sprint(len(body))})
+		w.WriteBody(body)
+	})
+	t.Cleanup(s.Close)
+
+	get := func(conn net.Conn, reader *bufio.Reader) string {
+		go conn.Write(NewRequest("GET", "/").Bytes())
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	first, err := s.Dial()
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := s.Dial()
+	require.NoError(t, err)
+	defer second.Close()
+
+	r1, r2 := bufio.NewReader(first), bufio.NewReader(second)
+	assert.Equal(t, "conn=1 seq=1 remote=pipe local=pipe tls=false", get(first, r1))
+	assert.Equal(t, "conn=1 seq=2 remote=pipe local=pipe tls=false", get(first, r1))
+	assert.Equal(t, "conn=2 seq=1 remote=pipe local=pipe tls=false", get(second, r2))
+}
@@ -0,0 +1,174 @@
+package sse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+)
+
+var ErrInvalidField = fmt.Errorf("Error: event field contains a line break")
+var ErrStreamClosed = fmt.Errorf("Error: event stream is closed")
+
+// Event is one message on a text/event-stream. Data may span several lines;
+// each one goes out as its own data field.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry tells the browser how long to wait before reconnecting. Zero
+	// leaves the field out.
+	Retry time.Duration
+}
+
+// Stream writes events to a client. Send and Comment are safe to call from
+// several goroutines.
+type Stream struct {
+	w           response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewStream writes the event-stream response headers and returns a Stream
+// to send events on.
+func NewStream(w response.Writer, r *request.Request) (*Stream, error) {
+
+	h := response.GetDefaultHeaders(0, "text/event-stream")
+	h.Del("content-length")
+	h.Set("transfer-encoding", "chunked")
+	h.Set("cache-control", "no-cache")
+
+	err := w.WriteStatusLine(response.Ok)
+	if err != nil {
+		return nil, err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+	err = response.Flush(w)
+	if err != nil {
+		return nil, err
+	}
+
+	lastEventID, _ := r.Headers.GetString("last-event-id")
+	return &Stream{w: w, lastEventID: lastEventID}, nil
+}
+
+// LastEventID is the Last-Event-ID the browser sent when reconnecting, so
+// the handler can resume after it. It is "" on a first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Send writes e and flushes it to the client.
+func (s *Stream) Send(e Event) error {
+	msg, err := e.format()
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+// Comment writes a comment line, which clients ignore. An empty comment is
+// the usual heartbeat to keep proxies from timing the connection out.
+func (s *Stream) Comment(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return ErrInvalidField
+	}
+	return s.write(":" + text + "\n\n")
+}
+
+// Close ends the response.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
+
+// Run sends every event from events, with a heartbeat comment whenever the
+// stream has been quiet for the heartbeat interval. It returns nil once
+// events is closed, or the write error as soon as the client goes away.
+func (s *Stream) Run(events <-chan Event, heartbeat time.Duration) error {
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return s.Close()
+			}
+			err := s.Send(e)
+			if err != nil {
+				return err
+			}
+			ticker.Reset(heartbeat)
+		case <-ticker.C:
+			err := s.Comment("")
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Stream) write(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStreamClosed
+	}
+	_, err := s.w.WriteChunkedBody([]byte(msg))
+	if err != nil {
+		s.closed = true
+		return err
+	}
+	err = response.Flush(s.w)
+	if err != nil {
+		s.closed = true
+		return err
+	}
+	return nil
+}
+
+func (e Event) format() (string, error) {
+
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return "", ErrInvalidField
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+
+	return b.String(), nil
+}
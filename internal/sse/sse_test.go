@@ -0,0 +1,90 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventFormat(t *testing.T) {
+	msg, err := Event{ID: "7", Event: "update", Data: "line one\nline two", Retry: 3 * time.Second}.format()
+	require.NoError(t, err)
+	assert.Equal(t, "id: 7\nevent: update\nretry: 3000\ndata: line one\ndata: line two\n\n", msg)
+
+	msg, err = Event{Data: ""}.format()
+	require.NoError(t, err)
+	assert.Equal(t, "data: \n\n", msg)
+
+	_, err = Event{ID: "a\nb"}.format()
+	require.ErrorIs(t, err, ErrInvalidField)
+}
+
+func TestStream(t *testing.T) {
+	r := &request.Request{Headers: headers.NewHeaders()}
+	r.Headers.Set("last-event-id", "41")
+
+	buf := new(bytes.Buffer)
+	s, err := NewStream(response.NewWriter(buf), r)
+	require.NoError(t, err)
+	assert.Equal(t, "41", s.LastEventID())
+
+	events := make(chan Event, 2)
+	events <- Event{ID: "42", Data: "hello"}
+	events <- Event{ID: "43", Data: "world"}
+	close(events)
+	require.NoError(t, s.Run(events, time.Hour))
+	require.ErrorIs(t, s.Send(Event{Data: "late"}), ErrStreamClosed)
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	body := new(strings.Builder)
+	_, err = bufio.NewReader(resp.Body).WriteTo(body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 42\ndata: hello\n\nid: 43\ndata: world\n\n", body.String())
+}
+
+func TestStream_StopsWhenClientLeaves(t *testing.T) {
+	done := make(chan error, 1)
+	s := servertest.NewServer(func(w response.Writer, r *request.Request) {
+		stream, err := NewStream(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		events := make(chan Event, 1)
+		events <- Event{Data: "first"}
+		done <- stream.Run(events, 5*time.Millisecond)
+	})
+	defer s.Close()
+
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+	conn.Close()
+
+	select {
+	case err := <-done:
+		require.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream kept running after the client disconnected")
+	}
+}
@@ -0,0 +1,176 @@
+// Package vhost dispatches requests to a handler per host name, so one
+// server can carry several sites.
+package vhost
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+var ErrMissingHost = fmt.Errorf("Error: request has no host header")
+var ErrMultipleHosts = fmt.Errorf("Error: request has more than one host header")
+var ErrInvalidHost = fmt.Errorf("Error: invalid host")
+
+// Mux picks a handler by the host a request is for. Exact names win over
+// wildcards, and longer wildcards over shorter ones. Requests for no known
+// host go to Default, or get a 404 if it's nil.
+//
+// Each host's handler is an ordinary server.Handler, so a path router can
+// sit under a host, and a Mux can sit under a path.
+type Mux struct {
+	Default server.Handler
+
+	exact     map[string]server.Handler
+	wildcards map[string]server.Handler
+}
+
+func New() *Mux {
+	return &Mux{
+		exact:     make(map[string]server.Handler),
+		wildcards: make(map[string]server.Handler),
+	}
+}
+
+// Handle registers h for pattern: a host name such as "example.com", or
+// "*.example.com" for every subdomain of example.com at any depth, but
+// not example.com itself. Patterns are case insensitive and ports are
+// ignored. Handle panics if pattern isn't a valid host.
+func (m *Mux) Handle(pattern string, h server.Handler) {
+	host, err := splitHost(pattern)
+	if err != nil {
+		panic(err)
+	}
+	pattern = normalize(host)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		m.wildcards["."+suffix] = h
+		return
+	}
+	m.exact[pattern] = h
+}
+
+// Handler dispatches r, or answers 400 if its host is missing or
+// malformed.
+func (m *Mux) Handler(w response.Writer, r *request.Request) {
+
+	host, err := Host(r)
+	if err != nil {
+		he := server.HandlerError{StatusCode: response.BadRequest, Message: "Bad Request"}
+		he.Write(w)
+		return
+	}
+
+	h := m.match(host)
+	if h == nil {
+		he := server.HandlerError{StatusCode: response.NotFound, Message: "Not Found"}
+		he.Write(w)
+		return
+	}
+	h(w, r)
+}
+
+func (m *Mux) match(host string) server.Handler {
+
+	if h, ok := m.exact[host]; ok {
+		return h
+	}
+
+	var best string
+	var h server.Handler
+	for suffix, wh := range m.wildcards {
+		if strings.HasSuffix(host, suffix) && len(host) > len(suffix) && len(suffix) > len(best) {
+			best, h = suffix, wh
+		}
+	}
+	if h != nil {
+		return h
+	}
+	return m.Default
+}
+
+// Host is the host name r is for, lower case and without the port. An
+// absolute-form target names the host itself; otherwise it comes from the
+// Host header, which HTTP/1.1 requests have to carry exactly once
+// (RFC 9112, section 3.2).
+func Host(r *request.Request) (string, error) {
+
+	value, err := r.Headers.GetString("host")
+	if err != nil {
+		if r.RequestLine.HttpVersion == "1.1" {
+			return "", ErrMissingHost
+		}
+	} else if strings.Contains(value, ",") {
+		// repeated fields are joined with commas, which no host contains
+		return "", ErrMultipleHosts
+	}
+
+	target := r.RequestLine.RequestTarget
+	if scheme, rest, ok := strings.Cut(target, "://"); ok && (strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https")) {
+		value, _, _ = strings.Cut(rest, "/")
+		value, _, _ = strings.Cut(value, "?")
+	}
+
+	host, err := splitHost(value)
+	if err != nil {
+		return "", err
+	}
+	return normalize(host), nil
+}
+
+// splitHost checks value is a uri-host with an optional port, and returns
+// the host.
+func splitHost(value string) (string, error) {
+
+	host, port := value, ""
+	if strings.HasPrefix(value, "[") {
+		end := strings.IndexByte(value, ']')
+		if end == -1 {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+		addr, err := netip.ParseAddr(value[1:end])
+		if err != nil || !addr.Is6() || addr.Zone() != "" {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+		host, port = value[:end+1], value[end+1:]
+		if port != "" && port[0] != ':' {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+	} else {
+		if i := strings.LastIndexByte(value, ':'); i != -1 {
+			host, port = value[:i], value[i:]
+		}
+		if host == "" {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+		for i := 0; i < len(host); i++ {
+			if !isRegNameChar(host[i]) {
+				return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+			}
+		}
+	}
+
+	for i := 1; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+	}
+	return host, nil
+}
+
+// isRegNameChar reports whether c may appear in a reg-name: unreserved,
+// sub-delims (bar the comma) or part of a percent-encoding.
+func isRegNameChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("-._~!$&'()*+;=%", c) != -1
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
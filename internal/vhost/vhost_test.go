@@ -0,0 +1,111 @@
+package vhost
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func site(name string) func(w response.Writer, r *request.Request) {
+	return func(w response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(response.GetDefaultHeaders(len(name), "text/plain"))
+		w.WriteBody([]byte(name))
+	}
+}
+
+func TestMux(t *testing.T) {
+	m := New()
+	m.Handle("example.com", site("apex"))
+	m.Handle("*.example.com", site("any"))
+	m.Handle("*.api.example.com", site("api"))
+	m.Handle("Blog.Example.com:8080", site("blog"))
+
+	get := func(host string) *servertest.ResponseRecorder {
+		rec := servertest.NewRecorder()
+		m.Handler(rec, servertest.NewRequest("GET", "/").Header("Host", host).Request())
+		return rec
+	}
+
+	assert.Equal(t, "apex", get("example.com").Body.String())
+	assert.Equal(t, "apex", get("EXAMPLE.com:443").Body.String())
+	assert.Equal(t, "apex", get("example.com.").Body.String())
+	assert.Equal(t, "blog", get("blog.example.com").Body.String())
+	assert.Equal(t, "any", get("www.example.com").Body.String())
+	assert.Equal(t, "any", get("a.b.example.com").Body.String())
+	assert.Equal(t, "api", get("v1.api.example.com").Body.String())
+
+	// Test: wildcards need a subdomain, and a real one
+	assert.Equal(t, response.NotFound, get("api.example.com.evil").Code)
+	assert.Equal(t, response.NotFound, get("notexample.com").Code)
+
+	// Test: default
+	m.Default = site("default")
+	assert.Equal(t, "default", get("other.org").Body.String())
+	assert.Equal(t, "default", get("[2001:db8::1]:8080").Body.String())
+}
+
+func TestHost(t *testing.T) {
+	host := func(b *servertest.RequestBuilder) (string, error) {
+		return Host(b.Request())
+	}
+
+	h, err := host(servertest.NewRequest("GET", "/").Header("Host", "Example.COM:80"))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", h)
+
+	h, err = host(servertest.NewRequest("GET", "/").Header("Host", "[2001:DB8::1]"))
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]", h)
+
+	// Test: absolute-form targets win over the header
+	h, err = host(servertest.NewRequest("GET", "http://other.org:8080/path?q=1").Header("Host", "example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, "other.org", h)
+
+	// Test: repeated host fields, as the parser hands them over
+	parsed, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a.com\r\nHost: b.com\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = Host(parsed)
+	assert.ErrorIs(t, err, ErrMultipleHosts)
+
+	req := servertest.NewRequest("GET", "/").Request()
+	req.Headers.Del("host")
+	_, err = Host(req)
+	assert.ErrorIs(t, err, ErrMissingHost)
+
+	invalid := []string{"", ":80", "exa mple.com", "example.com:8o", "[::1", "[192.0.2.1]", "[::1]x", "a/b"}
+	for _, v := range invalid {
+		req := servertest.NewRequest("GET", "/").Request()
+		req.Headers.Set("host", v)
+		_, err := Host(req)
+		assert.ErrorIs(t, err, ErrInvalidHost, v)
+	}
+
+	// Test: HTTP/2 requests without a host are fine with an :authority
+	req = servertest.NewRequest("GET", "http://example.com/").Request()
+	req.RequestLine.HttpVersion = "2"
+	req.Headers.Del("host")
+	h, err = Host(req)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", h)
+}
+
+func TestMux_BadHost(t *testing.T) {
+	m := New()
+	m.Default = site("default")
+
+	req := servertest.NewRequest("GET", "/").Request()
+	req.Headers.Add("host", "b.com")
+	rec := servertest.NewRecorder()
+	m.Handler(rec, req)
+	assert.Equal(t, response.BadRequest, rec.Code)
+
+	// Test: invalid patterns are a programming error
+	assert.Panics(t, func() { m.Handle("bad host", site("x")) })
+}
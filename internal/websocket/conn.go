@@ -0,0 +1,266 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Close codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// closeTimeout is how long Close waits for the peer to answer a close frame.
+const closeTimeout = 5 * time.Second
+
+var ErrCloseSent = fmt.Errorf("Error: websocket close frame already sent")
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Conn is the server side of a websocket connection. Reads must come from a
+// single goroutine; writes are safe to make concurrently.
+type Conn struct {
+	conn           net.Conn
+	rw             *bufio.ReadWriter
+	subprotocol    string
+	maxMessageSize int64
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, rw *bufio.ReadWriter, subprotocol string, maxMessageSize int64) *Conn {
+	return &Conn{
+		conn:           conn,
+		rw:             rw,
+		subprotocol:    subprotocol,
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// Subprotocol returns the subprotocol agreed during the handshake, if any.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// ReadMessage returns the next complete text or binary message, putting
+// fragmented messages back together. Pings are answered and pongs dropped
+// along the way. When the peer closes, the close is echoed and a
+// *CloseError is returned.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+
+	var msgType Opcode
+	var msg []byte
+	for {
+		f, err := ReadFrame(c.rw, c.maxMessageSize)
+		if errors.Is(err, ErrFrameTooLarge) {
+			return 0, nil, c.fail(CloseMessageTooBig, err)
+		}
+		if errors.Is(err, ErrProtocol) {
+			return 0, nil, c.fail(CloseProtocolError, err)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if !f.Masked {
+			return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: client frame is not masked", ErrProtocol))
+		}
+
+		switch f.Opcode {
+		case OpPing:
+			err = c.writeFrame(&Frame{Fin: true, Opcode: OpPong, Payload: f.Payload})
+			if err != nil && !errors.Is(err, ErrCloseSent) {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			return 0, nil, c.handleClose(f.Payload)
+		case OpText, OpBinary:
+			if msgType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: new message before the last one finished", ErrProtocol))
+			}
+			msgType = f.Opcode
+		case OpContinuation:
+			if msgType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: continuation without a message", ErrProtocol))
+			}
+		}
+
+		if int64(len(msg)+len(f.Payload)) > c.maxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, ErrFrameTooLarge)
+		}
+		msg = append(msg, f.Payload...)
+
+		if f.Fin {
+			if msgType == OpText && !utf8.Valid(msg) {
+				return 0, nil, c.fail(CloseInvalidPayload, fmt.Errorf("%w: text message is not valid UTF-8", ErrProtocol))
+			}
+			return msgType, msg, nil
+		}
+	}
+}
+
+// WriteMessage sends data as a single text or binary frame.
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	return c.writeFrame(&Frame{Fin: true, Opcode: op, Payload: data})
+}
+
+// WriteFragmented sends data as a message split into frames of at most
+// fragmentSize bytes.
+func (c *Conn) WriteFragmented(op Opcode, data []byte, fragmentSize int) error {
+
+	if fragmentSize <= 0 {
+		return fmt.Errorf("Error: fragment size must be positive")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	for first := true; first || len(data) > 0; first = false {
+		n := min(fragmentSize, len(data))
+		f := &Frame{Fin: n == len(data), Opcode: OpContinuation, Payload: data[:n]}
+		if first {
+			f.Opcode = op
+		}
+		err := c.writeFrameLocked(f)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Ping sends a ping control frame.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return ErrFrameTooLarge
+	}
+	return c.writeFrame(&Frame{Fin: true, Opcode: OpPing, Payload: data})
+}
+
+// Close starts the closing handshake, waits briefly for the peer's close
+// frame and then closes the connection.
+func (c *Conn) Close(code int, reason string) error {
+
+	err := c.writeClose(code, reason)
+	if err != nil && !errors.Is(err, ErrCloseSent) {
+		c.conn.Close()
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	for {
+		f, err := ReadFrame(c.rw, c.maxMessageSize)
+		if err != nil || f.Opcode == OpClose {
+			break
+		}
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, fmt.Errorf("%w: close payload of one byte", ErrProtocol))
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) || !utf8.ValidString(closeErr.Reason) {
+			return c.fail(CloseProtocolError, fmt.Errorf("%w: invalid close frame", ErrProtocol))
+		}
+	}
+
+	// echo the status code back, or an empty close if the peer sent none
+	var err error
+	if closeErr.Code == CloseNoStatus {
+		err = c.writeFrame(&Frame{Fin: true, Opcode: OpClose})
+	} else {
+		err = c.writeClose(closeErr.Code, "")
+	}
+	if err != nil && !errors.Is(err, ErrCloseSent) {
+		fmt.Println("Error:", err)
+	}
+	c.conn.Close()
+
+	return closeErr
+}
+
+// fail sends a close frame for a protocol-level error and drops the
+// connection. It returns cause so callers can pass it straight up.
+func (c *Conn) fail(code int, cause error) error {
+	c.writeClose(code, "")
+	c.conn.Close()
+	return cause
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(&Frame{Fin: true, Opcode: OpClose, Payload: payload})
+}
+
+func (c *Conn) writeFrame(f *Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(f)
+}
+
+func (c *Conn) writeFrameLocked(f *Frame) error {
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if f.Opcode == OpClose {
+		c.closeSent = true
+	}
+
+	err := WriteFrame(c.rw, f)
+	if err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// maxControlPayload is the largest payload a control frame may carry.
+const maxControlPayload = 125
+
+var ErrProtocol = fmt.Errorf("Error: websocket protocol violation")
+var ErrFrameTooLarge = fmt.Errorf("Error: websocket frame too large")
+
+// Frame is a single websocket frame as it appears on the wire. Payload is
+// always unmasked; Masked and MaskKey describe how it was or will be sent.
+type Frame struct {
+	Fin     bool
+	Opcode  Opcode
+	Masked  bool
+	MaskKey [4]byte
+	Payload []byte
+}
+
+func (o Opcode) isControl() bool {
+	return o&0x8 != 0
+}
+
+// ReadFrame reads one frame from r and unmasks its payload. Frames whose
+// payload is longer than maxPayload are rejected with ErrFrameTooLarge.
+func ReadFrame(r io.Reader, maxPayload int64) (*Frame, error) {
+
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Frame{
+		Fin:    head[0]&0x80 != 0,
+		Opcode: Opcode(head[0] & 0x0f),
+		Masked: head[1]&0x80 != 0,
+	}
+	if head[0]&0x70 != 0 {
+		return nil, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	switch f.Opcode {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+	default:
+		return nil, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, f.Opcode)
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+		if length&(1<<63) != 0 {
+			return nil, fmt.Errorf("%w: payload length has the top bit set", ErrProtocol)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Opcode.isControl() {
+		if !f.Fin {
+			return nil, fmt.Errorf("%w: fragmented control frame", ErrProtocol)
+		}
+		if length > maxControlPayload {
+			return nil, fmt.Errorf("%w: control frame payload over %d bytes", ErrProtocol, maxControlPayload)
+		}
+	}
+	if length > uint64(maxPayload) {
+		return nil, ErrFrameTooLarge
+	}
+
+	if f.Masked {
+		_, err = io.ReadFull(r, f.MaskKey[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f.Payload = make([]byte, length)
+	_, err = io.ReadFull(r, f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if f.Masked {
+		mask(f.MaskKey, f.Payload)
+	}
+
+	return f, nil
+}
+
+// WriteFrame writes f to w, masking the payload with f.MaskKey when
+// f.Masked is set. f.Payload itself is left untouched.
+func WriteFrame(w io.Writer, f *Frame) error {
+
+	buf := make([]byte, 0, 14+len(f.Payload))
+
+	b0 := byte(f.Opcode)
+	if f.Fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var b1 byte
+	if f.Masked {
+		b1 = 0x80
+	}
+	length := len(f.Payload)
+	switch {
+	case length <= 125:
+		buf = append(buf, b1|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if f.Masked {
+		buf = append(buf, f.MaskKey[:]...)
+	}
+	start := len(buf)
+	buf = append(buf, f.Payload...)
+	if f.Masked {
+		mask(f.MaskKey, buf[start:])
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// mask XORs p with key in place; masking and unmasking are the same thing.
+func mask(key [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,145 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ratludu/httpfromtcp/internal/headers"
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+)
+
+// acceptGUID is the fixed GUID from RFC 6455 section 1.3.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const defaultMaxMessageSize = 1 << 20
+
+var ErrBadHandshake = fmt.Errorf("Error: bad websocket handshake")
+
+// Upgrader turns a handshake request into a websocket Conn.
+type Upgrader struct {
+	// Subprotocols the server supports, in order of preference.
+	Subprotocols []string
+	// CheckOrigin decides whether to accept the request's Origin. When nil,
+	// only requests without an Origin or from the same host are accepted.
+	CheckOrigin func(r *request.Request) bool
+	// MaxMessageSize caps the size of a reassembled message; 0 means 1MB.
+	MaxMessageSize int64
+}
+
+// Upgrade completes the handshake with the default Upgrader.
+func Upgrade(w response.Writer, r *request.Request) (*Conn, error) {
+	return (&Upgrader{}).Upgrade(w, r)
+}
+
+// Upgrade validates the handshake, replies with 101 Switching Protocols and
+// takes over the connection. On failure an error response has already been
+// written to w.
+func (u *Upgrader) Upgrade(w response.Writer, r *request.Request) (*Conn, error) {
+
+	if r.RequestLine.Method != "GET" {
+		return nil, u.reject(w, response.MethodNotAllowed, "websocket handshake must be a GET", nil)
+	}
+	if !r.Headers.HasToken("connection", "upgrade") || !r.Headers.HasToken("upgrade", "websocket") {
+		return nil, u.reject(w, response.BadRequest, "missing websocket upgrade headers", nil)
+	}
+	if version, _ := r.Headers.GetString("sec-websocket-version"); version != "13" {
+		h := headers.NewHeaders()
+		h.Set("sec-websocket-version", "13")
+		return nil, u.reject(w, response.UpgradeRequired, "unsupported websocket version", h)
+	}
+	key, _ := r.Headers.GetString("sec-websocket-key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return nil, u.reject(w, response.BadRequest, "invalid Sec-WebSocket-Key", nil)
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return nil, u.reject(w, response.Forbidden, "origin not allowed", nil)
+	}
+
+	h := headers.NewHeaders()
+	h.Set("upgrade", "websocket")
+	h.Set("connection", "Upgrade")
+	h.Set("sec-websocket-accept", AcceptKey(key))
+	subprotocol := u.selectSubprotocol(r)
+	if subprotocol != "" {
+		h.Set("sec-websocket-protocol", subprotocol)
+	}
+
+	err = w.WriteStatusLine(response.SwitchingProtocols)
+	if err != nil {
+		return nil, err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+
+	netConn, rw, err := response.Hijack(w)
+	if err != nil {
+		return nil, err
+	}
+
+	maxMessageSize := u.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+
+	return newConn(netConn, rw, subprotocol, maxMessageSize), nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a client key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (u *Upgrader) reject(w response.Writer, status response.StatusCode, msg string, h headers.Headers) error {
+	server.HandlerError{
+		StatusCode: status,
+		Message:    msg,
+		Headers:    h,
+	}.Write(w)
+	return fmt.Errorf("%w: %s", ErrBadHandshake, msg)
+}
+
+func (u *Upgrader) selectSubprotocol(r *request.Request) string {
+
+	requested, err := r.Headers.GetString("sec-websocket-protocol")
+	if err != nil {
+		return ""
+	}
+
+	offered := strings.Split(requested, ",")
+	for _, supported := range u.Subprotocols {
+		for _, p := range offered {
+			if strings.TrimSpace(p) == supported {
+				return supported
+			}
+		}
+	}
+	return ""
+}
+
+func sameOrigin(r *request.Request) bool {
+
+	origin, err := r.Headers.GetString("origin")
+	if err != nil {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _ := r.Headers.GetString("host")
+	return strings.EqualFold(u.Host, host)
+}
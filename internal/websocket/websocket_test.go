@@ -0,0 +1,195 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/ratludu/httpfromtcp/internal/request"
+	"github.com/ratludu/httpfromtcp/internal/response"
+	"github.com/ratludu/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const handshake = "GET /chat HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: keep-alive, Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"Sec-WebSocket-Protocol: chat, superchat\r\n" +
+	"\r\n"
+
+func TestAcceptKey(t *testing.T) {
+	// example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestFrame_RoundTrip(t *testing.T) {
+	for _, size := range []int{0, 5, 125, 126, 65535, 65536} {
+		payload := bytes.Repeat([]byte("p"), size)
+		buf := new(bytes.Buffer)
+		f := &Frame{Fin: true, Opcode: OpBinary, Masked: true, MaskKey: [4]byte{1, 2, 3, 4}, Payload: payload}
+		require.NoError(t, WriteFrame(buf, f))
+		assert.Equal(t, bytes.Repeat([]byte("p"), size), payload, "WriteFrame must not mask in place")
+
+		got, err := ReadFrame(buf, 1<<20)
+		require.NoError(t, err)
+		assert.True(t, got.Fin)
+		assert.Equal(t, OpBinary, got.Opcode)
+		assert.Equal(t, payload, got.Payload)
+	}
+
+	// Test: control frames can't be fragmented or large
+	buf := new(bytes.Buffer)
+	require.NoError(t, WriteFrame(buf, &Frame{Opcode: OpPing}))
+	_, err := ReadFrame(buf, 1<<20)
+	require.ErrorIs(t, err, ErrProtocol)
+
+	// Test: reserved bits
+	_, err = ReadFrame(bytes.NewReader([]byte{0xC1, 0x00}), 1<<20)
+	require.ErrorIs(t, err, ErrProtocol)
+
+	// Test: payload limit
+	buf.Reset()
+	require.NoError(t, WriteFrame(buf, &Frame{Fin: true, Opcode: OpText, Payload: make([]byte, 200)}))
+	_, err = ReadFrame(buf, 100)
+	require.ErrorIs(t, err, ErrFrameTooLarge)
+}
+
+func dial(t *testing.T, handler server.Handler) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Write([]byte(handshake))
+	require.NoError(t, err)
+	return conn, bufio.NewReader(conn)
+}
+
+func clientFrame(t *testing.T, conn net.Conn, fin bool, op Opcode, payload []byte) {
+	t.Helper()
+	err := WriteFrame(conn, &Frame{Fin: fin, Opcode: op, Masked: true, MaskKey: [4]byte{9, 8, 7, 6}, Payload: payload})
+	require.NoError(t, err)
+}
+
+func TestUpgrade_Echo(t *testing.T) {
+	u := &Upgrader{Subprotocols: []string{"superchat"}}
+	done := make(chan error, 1)
+	conn, br := dial(t, func(w response.Writer, r *request.Request) {
+		ws, err := u.Upgrade(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		for {
+			op, msg, err := ws.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			ws.WriteMessage(op, msg)
+		}
+	})
+
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "superchat", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// Test: fragmented message with a ping in the middle
+	clientFrame(t, conn, false, OpText, []byte("hel"))
+	clientFrame(t, conn, true, OpPing, []byte("are you there"))
+	clientFrame(t, conn, true, OpContinuation, []byte("lo"))
+
+	pong, err := ReadFrame(br, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, OpPong, pong.Opcode)
+	assert.Equal(t, "are you there", string(pong.Payload))
+
+	echo, err := ReadFrame(br, 1<<20)
+	require.NoError(t, err)
+	assert.False(t, echo.Masked)
+	assert.Equal(t, OpText, echo.Opcode)
+	assert.Equal(t, "hello", string(echo.Payload))
+
+	// Test: close handshake echoes the code
+	clientFrame(t, conn, true, OpClose, binary.BigEndian.AppendUint16(nil, CloseGoingAway))
+	closing, err := ReadFrame(br, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, OpClose, closing.Opcode)
+	assert.Equal(t, uint16(CloseGoingAway), binary.BigEndian.Uint16(closing.Payload))
+
+	var closeErr *CloseError
+	require.ErrorAs(t, <-done, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+}
+
+func TestUpgrade_UnmaskedFrameFails(t *testing.T) {
+	done := make(chan error, 1)
+	conn, br := dial(t, func(w response.Writer, r *request.Request) {
+		ws, err := Upgrade(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		_, _, err = ws.ReadMessage()
+		done <- err
+	})
+
+	_, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.NoError(t, WriteFrame(conn, &Frame{Fin: true, Opcode: OpText, Payload: []byte("hi")}))
+
+	closing, err := ReadFrame(br, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, OpClose, closing.Opcode)
+	assert.Equal(t, uint16(CloseProtocolError), binary.BigEndian.Uint16(closing.Payload))
+	require.ErrorIs(t, <-done, ErrProtocol)
+}
+
+func TestUpgrade_BadHandshake(t *testing.T) {
+	cases := map[string]struct {
+		req    string
+		status int
+	}{
+		"wrong version": {
+			req:    "GET / HTTP/1.1\r\nHost: h\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n\r\n",
+			status: 426,
+		},
+		"missing upgrade": {
+			req:    "GET / HTTP/1.1\r\nHost: h\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+			status: 400,
+		},
+		"cross origin": {
+			req:    "GET / HTTP/1.1\r\nHost: h\r\nOrigin: http://evil.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+			status: 403,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := request.RequestFromReader(bytes.NewReader([]byte(tc.req)))
+			require.NoError(t, err)
+
+			buf := new(bytes.Buffer)
+			_, err = Upgrade(response.NewWriter(buf), r)
+			require.ErrorIs(t, err, ErrBadHandshake)
+
+			resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+			require.NoError(t, err)
+			assert.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}